@@ -0,0 +1,174 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// when a write is acknowledged.
+const (
+	ACK_ENQUEUE = "enqueue" // queued in memory of backends
+	ACK_DURABLE = "durable" // appended to files of backends
+	ACK_QUORUM  = "quorum"  // taken by quorum of backends of every line
+)
+
+var (
+	ErrIllegalAck   = errors.New("illegal ack mode")
+	ErrNotConfirmed = errors.New("write not confirmed by backend")
+	ErrNotCached    = errors.New("write neither sent nor cached")
+	ErrNotDurable   = errors.New("write not durable")
+	ErrNoQuorum     = errors.New("write not confirmed by quorum of backends")
+)
+
+// ParseAck reads ack mode and quorum of a request, empty ones are of node.
+func ParseAck(mode string, quorum string) (ack string, n int, err error) {
+	switch mode {
+	case "", ACK_ENQUEUE, ACK_DURABLE, ACK_QUORUM:
+	default:
+		return "", 0, ErrIllegalAck
+	}
+	if quorum != "" {
+		n, err = strconv.Atoi(quorum)
+		if err != nil || n < 0 {
+			return "", 0, ErrIllegalAck
+		}
+	}
+	return mode, n, nil
+}
+
+// ackOf params, or of node if not set.
+func (ic *InfluxCluster) ackOf(params *WriteParams) (mode string, quorum int) {
+	mode, quorum = params.Ack, params.Quorum
+	if mode == "" {
+		mode = ic.writeAck
+	}
+	if quorum == 0 {
+		quorum = ic.writeQuorum
+	}
+	return
+}
+
+// Quorum of n backends, the majority if q is 0.
+func Quorum(q int, n int) int {
+	if q <= 0 {
+		q = n/2 + 1
+	}
+	if q > n {
+		q = n
+	}
+	return q
+}
+
+// Delivered tells if a write acked with err reached the backend or its file.
+func Delivered(err error) bool {
+	switch err {
+	case nil, ErrNotConfirmed, ErrBadRequest, ErrNotFound, ErrUnauthorized:
+		return true
+	}
+	return false
+}
+
+// enqueue p to api, the record of params in wal is kept until api has it.
+func (ic *InfluxCluster) enqueue(api BackendAPI, p []byte, params *WriteParams) (err error) {
+	aw, ok := api.(AckWriter)
+	if params.wal == nil || !ok {
+		return api.Write(p, params)
+	}
+	ack, err := aw.WriteConfirmed(p, params)
+	if err != nil {
+		return
+	}
+	params.wal.track(ack)
+	return
+}
+
+// writeDurable returns when every backend has the lines in file.
+// Backends can't do it are only queued.
+func (ic *InfluxCluster) writeDurable(wb *writeBatch, params *WriteParams) (err error) {
+	for _, api := range wb.apis {
+		var e error
+		if aw, ok := api.(AckWriter); ok {
+			e = aw.WriteDurable(wb.bufs[api].Bytes(), params)
+		} else {
+			e = api.Write(wb.bufs[api].Bytes(), params)
+		}
+		if e != nil {
+			log.Printf("cluster write fail: %d lines, %s\n", wb.lines[api], e)
+			atomic.AddInt64(&ic.stats.PointsWrittenFail, wb.lines[api])
+			err = ErrNotDurable
+		}
+	}
+	return
+}
+
+// writeConfirmed returns when every line is taken by quorum of its backends,
+// or ic.ackTimeout passed. Backends can't tell it take lines queued.
+func (ic *InfluxCluster) writeConfirmed(wb *writeBatch, params *WriteParams, quorum int) (err error) {
+	results := make(map[BackendAPI]error, len(wb.apis))
+	acks := make(map[BackendAPI]<-chan error, len(wb.apis))
+	for _, api := range wb.apis {
+		if aw, ok := api.(AckWriter); ok {
+			var ack <-chan error
+			ack, results[api] = aw.WriteConfirmed(wb.bufs[api].Bytes(), params)
+			if ack != nil {
+				acks[api] = params.wal.track(ack)
+			}
+		} else {
+			results[api] = api.Write(wb.bufs[api].Bytes(), params)
+		}
+	}
+
+	var timeout <-chan time.Time
+	if ic.ackTimeout > 0 {
+		timer := time.NewTimer(ic.ackTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	expired := false
+	for _, api := range wb.apis {
+		ack := acks[api]
+		if ack == nil {
+			continue
+		}
+		if expired {
+			select {
+			case results[api] = <-ack:
+			default:
+				results[api] = ErrNotConfirmed
+			}
+			continue
+		}
+		select {
+		case results[api] = <-ack:
+		case <-timeout:
+			expired = true
+			results[api] = ErrNotConfirmed
+		}
+	}
+
+	for _, api := range wb.apis {
+		if e := results[api]; e != nil {
+			log.Printf("cluster write fail: %d lines, %s\n", wb.lines[api], e)
+			atomic.AddInt64(&ic.stats.PointsWrittenFail, wb.lines[api])
+		}
+	}
+	for _, set := range wb.sets {
+		confirmed := 0
+		for _, api := range set {
+			if results[api] == nil {
+				confirmed++
+			}
+		}
+		if confirmed < Quorum(quorum, len(set)) {
+			err = ErrNoQuorum
+		}
+	}
+	return
+}
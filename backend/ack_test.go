@@ -0,0 +1,121 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseAck(t *testing.T) {
+	ack, n, err := ParseAck("quorum", "2")
+	if err != nil || ack != ACK_QUORUM || n != 2 {
+		t.Errorf("wrong ack: %s, %d, %v", ack, n, err)
+	}
+	ack, n, err = ParseAck("", "")
+	if err != nil || ack != "" || n != 0 {
+		t.Errorf("wrong ack: %s, %d, %v", ack, n, err)
+	}
+	for _, c := range [][]string{{"sync", ""}, {"quorum", "x"}, {"quorum", "-1"}} {
+		if _, _, err = ParseAck(c[0], c[1]); err != ErrIllegalAck {
+			t.Errorf("%v: %v", c, err)
+		}
+	}
+}
+
+func TestQuorum(t *testing.T) {
+	for _, c := range [][3]int{{0, 1, 1}, {0, 2, 2}, {0, 3, 2}, {1, 3, 1}, {5, 3, 3}} {
+		if q := Quorum(c[0], c[1]); q != c[2] {
+			t.Errorf("quorum %d of %d: %d", c[0], c[1], q)
+		}
+	}
+}
+
+func createAckBackends(t *testing.T, name string, code int) (bs *Backends, ts *httptest.Server) {
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(code)
+	}))
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.Interval = 10 * time.Millisecond
+	bs, err := NewBackends(cfg, name)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	return
+}
+
+func TestInfluxdbClusterWriteAck(t *testing.T) {
+	good, ts1 := createAckBackends(t, "ack_good", 204)
+	defer ts1.Close()
+	bad, ts2 := createAckBackends(t, "ack_bad", 500)
+	defer ts2.Close()
+	defer os.Remove("ack_good.dat")
+	defer os.Remove("ack_good.rec")
+	defer os.Remove("ack_bad.dat")
+	defer os.Remove("ack_bad.rec")
+
+	ic := NewInfluxCluster(&RedisConfigSource{}, &NodeConfig{WriteAckTimeout: time.Second})
+	ic.router = NewRouter(map[string][]BackendAPI{"cpu": {good, bad}, "mem": {good}}, nil)
+
+	err := ic.Write([]byte("cpu value=1\nmem value=1\n"), &WriteParams{DB: "test", Ack: ACK_QUORUM, Quorum: 1})
+	if err != nil {
+		t.Errorf("quorum of 1: %v", err)
+	}
+	err = ic.Write([]byte("cpu value=1\n"), &WriteParams{DB: "test", Ack: ACK_QUORUM})
+	if err != ErrNoQuorum {
+		t.Errorf("quorum of majority: %v", err)
+	}
+	if ic.stats.WriteAcksFail != 1 {
+		t.Errorf("%d acks failed", ic.stats.WriteAcksFail)
+	}
+
+	err = ic.Write([]byte("cpu value=2\n"), &WriteParams{DB: "test", Ack: ACK_DURABLE})
+	if err != nil {
+		t.Errorf("durable: %v", err)
+	}
+	// the good one may have sent it already.
+	if !bad.fb.IsData() {
+		t.Errorf("durable write not in file")
+	}
+}
+
+func TestBackendsWriteDurable(t *testing.T) {
+	written := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			written <- req.URL.Query().Get("db")
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.RewriteInterval = 10 * time.Second
+	bs, err := NewBackends(cfg, "durable")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer os.Remove("durable.dat")
+	defer os.Remove("durable.rec")
+	defer bs.Close()
+
+	// on local disk when acked, sent soon after, not by the next tick.
+	err = bs.WriteDurable([]byte("cpu value=1\n"), &WriteParams{DB: "test"})
+	if err != nil {
+		t.Errorf("error: %s", err)
+	}
+	select {
+	case db := <-written:
+		if db != "test" {
+			t.Errorf("written to %s", db)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("durable write not sent in time")
+	}
+}
@@ -0,0 +1,608 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// aggregates which shards can compute in partials, and the proxy reduces.
+// mean is sum and count, spread is max and min.
+var mergeable = map[string]bool{
+	"count":  true,
+	"sum":    true,
+	"mean":   true,
+	"min":    true,
+	"max":    true,
+	"spread": true,
+}
+
+// how to reduce a partial from many shards.
+var reduceOps = map[string]string{
+	"count": "sum",
+	"sum":   "sum",
+	"min":   "min",
+	"max":   "max",
+}
+
+// functions working on every row, fine in raw queries.
+var rowwise = map[string]bool{
+	"abs": true, "acos": true, "asin": true, "atan": true, "atan2": true,
+	"ceil": true, "cos": true, "exp": true, "floor": true, "ln": true,
+	"log": true, "log2": true, "log10": true, "pow": true, "round": true,
+	"sin": true, "sqrt": true, "tan": true,
+}
+
+// AggregateError tells the client which part of query can't run on shards.
+type AggregateError struct {
+	Expr string
+}
+
+func (e *AggregateError) Error() string {
+	return "can't merge " + e.Expr + " across shards"
+}
+
+// QueryPlan is the query sent to every shard, and how to merge the results.
+type QueryPlan struct {
+	Query  string
+	Merges []MergeOptions
+}
+
+// PlanQuery rewrites q to run on shards. Limits are widened, so the merge
+// could cut them right, and aggregates are split into partials.
+// Queries can't be parsed are refused, shards would give wrong answers.
+func PlanQuery(q string) (plan *QueryPlan, err error) {
+	stmts, err := ParseQuery(q)
+	if err != nil {
+		return
+	}
+
+	plan = &QueryPlan{}
+
+	queries := make([]string, len(stmts))
+	plan.Merges = make([]MergeOptions, len(stmts))
+	for i, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *SelectStatement:
+			plan.Merges[i], err = planSelect(s)
+			if err != nil {
+				return nil, err
+			}
+		case *ShowStatement:
+			plan.Merges[i].Distinct = true
+		}
+		queries[i] = stmt.String()
+	}
+	plan.Query = strings.Join(queries, "; ")
+	return
+}
+
+func planSelect(s *SelectStatement) (opt MergeOptions, err error) {
+	opt = MergeOptions{
+		Descending: s.Descending,
+		Limit:      s.Limit,
+		Offset:     s.Offset,
+		SLimit:     s.SLimit,
+		SOffset:    s.SOffset,
+	}
+
+	// every shard gives its first limit+offset, the merged ones are in them.
+	if s.Limit > 0 {
+		s.Limit += s.Offset
+	}
+	s.Offset = 0
+	if s.SLimit > 0 {
+		s.SLimit += s.SOffset
+	}
+	s.SOffset = 0
+
+	// every shard would write its own part into the target.
+	if s.Into != "" {
+		return opt, &AggregateError{Expr: "INTO " + s.Into}
+	}
+
+	for _, m := range s.Sources {
+		if m.SubQuery != nil && !rawSubQuery(m.SubQuery) {
+			return opt, &AggregateError{Expr: m.String()}
+		}
+	}
+
+	if !hasAggregate(s) || groupBySeries(s) {
+		return
+	}
+	opt.Aggregate, err = NewAggregate(s)
+	return
+}
+
+func hasAggregate(s *SelectStatement) (found bool) {
+	for _, f := range s.Fields {
+		WalkExpr(f.Expr, func(e Expr) bool {
+			if c, ok := e.(*Call); ok && !rowwise[c.Name] {
+				found = true
+			}
+			return !found
+		})
+	}
+	return
+}
+
+// rawSubQuery tells if rows of sub on every shard are just the rows on it.
+func rawSubQuery(sub *SelectStatement) bool {
+	if hasAggregate(sub) || sub.Limit > 0 || sub.Offset > 0 || sub.SLimit > 0 || sub.SOffset > 0 {
+		return false
+	}
+	for _, m := range sub.Sources {
+		if m.SubQuery != nil && !rawSubQuery(m.SubQuery) {
+			return false
+		}
+	}
+	return true
+}
+
+// groupBySeries tells if every group is one series, which is in one shard.
+func groupBySeries(s *SelectStatement) bool {
+	for _, d := range s.Dimensions {
+		if _, ok := d.(*Wildcard); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Aggregate splits the aggregates of a statement into partials, which
+// every shard computes, and reduces partials from shards to the fields.
+type Aggregate struct {
+	Ops      []string // reduce of every partial, sum, min or max
+	Fields   []Expr   // aggregates in them are replaced by partialRef
+	Columns  []string
+	Interval bool // group by time(), reduce by time bucket
+	Fill     *Call
+
+	// a lone min or max keeps the time of its point.
+	selector bool
+}
+
+// partialRef is an aggregate computed from partials.
+type partialRef struct {
+	Call  *Call
+	Parts []int
+}
+
+func (*partialRef) expr() {}
+
+func (r *partialRef) String() string {
+	return r.Call.String()
+}
+
+// NewAggregate rewrites fields of s into partials, named __p0, __p1 ...
+func NewAggregate(s *SelectStatement) (a *Aggregate, err error) {
+	a = &Aggregate{Fill: s.Fill}
+
+	var partials []*Field
+	index := make(map[string]int)
+	partial := func(name string, arg Expr) int {
+		c := &Call{Name: name, Args: []Expr{arg}}
+		if i, ok := index[c.String()]; ok {
+			return i
+		}
+		i := len(partials)
+		index[c.String()] = i
+		partials = append(partials, &Field{Expr: c, Alias: "__p" + strconv.Itoa(i)})
+		a.Ops = append(a.Ops, reduceOps[name])
+		return i
+	}
+
+	var rewrite func(e Expr) (Expr, error)
+	rewrite = func(e Expr) (Expr, error) {
+		switch n := e.(type) {
+		case *NumberLiteral:
+			return n, nil
+		case *ParenExpr:
+			inner, err := rewrite(n.Expr)
+			if err != nil {
+				return nil, err
+			}
+			return &ParenExpr{Expr: inner}, nil
+		case *UnaryExpr:
+			inner, err := rewrite(n.Expr)
+			if err != nil {
+				return nil, err
+			}
+			return &UnaryExpr{Op: n.Op, Expr: inner}, nil
+		case *BinaryExpr:
+			switch n.Op {
+			case ADD, SUB, MUL, DIV:
+			default:
+				return nil, &AggregateError{Expr: n.String()}
+			}
+			lhs, err := rewrite(n.LHS)
+			if err != nil {
+				return nil, err
+			}
+			rhs, err := rewrite(n.RHS)
+			if err != nil {
+				return nil, err
+			}
+			return &BinaryExpr{Op: n.Op, LHS: lhs, RHS: rhs}, nil
+		case *Call:
+			if !mergeable[n.Name] || len(n.Args) != 1 {
+				return nil, &AggregateError{Expr: n.String()}
+			}
+			arg, ok := n.Args[0].(*VarRef)
+			if !ok {
+				return nil, &AggregateError{Expr: n.String()}
+			}
+
+			r := &partialRef{Call: n}
+			switch n.Name {
+			case "mean":
+				r.Parts = []int{partial("sum", arg), partial("count", arg)}
+			case "spread":
+				r.Parts = []int{partial("max", arg), partial("min", arg)}
+			default:
+				r.Parts = []int{partial(n.Name, arg)}
+			}
+			return r, nil
+		}
+		return nil, &AggregateError{Expr: e.String()}
+	}
+
+	for _, f := range s.Fields {
+		var e Expr
+		e, err = rewrite(f.Expr)
+		if err != nil {
+			return nil, err
+		}
+		a.Fields = append(a.Fields, e)
+	}
+	a.Columns = columnNames(s.Fields)
+
+	for _, d := range s.Dimensions {
+		if c, ok := d.(*Call); ok && c.Name == "time" {
+			a.Interval = true
+		}
+	}
+	if r, ok := a.Fields[0].(*partialRef); ok && len(a.Fields) == 1 && !a.Interval {
+		a.selector = r.Call.Name == "min" || r.Call.Name == "max"
+	}
+
+	s.Fields = partials
+	// shards fill null, so every partial is reduced right, then fill in proxy.
+	if s.Fill != nil && !isFill(s.Fill, "none") {
+		s.Fill = nil
+	}
+	return
+}
+
+func isFill(fill *Call, kind string) bool {
+	if len(fill.Args) != 1 {
+		return false
+	}
+	ref, ok := fill.Args[0].(*VarRef)
+	return ok && strings.ToLower(ref.Val) == kind
+}
+
+// columnNames names columns of fields like influxdb, mean, mean_1 ...
+func columnNames(fields []*Field) (columns []string) {
+	columns = make([]string, len(fields))
+	used := map[string]int{"time": 1}
+	for i, f := range fields {
+		if f.Alias != "" {
+			columns[i] = f.Alias
+			used[f.Alias] = 1
+		}
+	}
+
+	for i, f := range fields {
+		if columns[i] != "" {
+			continue
+		}
+		name := f.Name()
+		if count, ok := used[name]; ok {
+			for {
+				resolved := name + "_" + strconv.Itoa(count)
+				if _, ok = used[resolved]; !ok {
+					used[name] = count + 1
+					name = resolved
+					break
+				}
+				count++
+			}
+		}
+		used[name]++
+		columns[i] = name
+	}
+	return
+}
+
+type bucket struct {
+	time  interface{}
+	t     int64
+	parts []value
+}
+
+// Reduce combines partial rows of a series from all shards by time bucket,
+// and computes the fields.
+func (a *Aggregate) Reduce(s *Series, desc bool) {
+	// position of every partial in the rows.
+	cols := make([]int, len(a.Ops))
+	for i := range cols {
+		cols[i] = -1
+		name := "__p" + strconv.Itoa(i)
+		for j, c := range s.Columns {
+			if c == name {
+				cols[i] = j
+			}
+		}
+	}
+
+	var buckets []*bucket
+	index := make(map[int64]*bucket)
+	for _, row := range s.Values {
+		if len(row) == 0 {
+			continue
+		}
+		t, _ := timeValue(row[0])
+		key := t
+		if !a.Interval {
+			key = 0
+		}
+
+		b, ok := index[key]
+		if !ok {
+			b = &bucket{time: row[0], t: t, parts: make([]value, len(a.Ops))}
+			index[key] = b
+			buckets = append(buckets, b)
+		}
+
+		for i, op := range a.Ops {
+			if cols[i] < 0 || cols[i] >= len(row) {
+				continue
+			}
+			v := newValue(row[cols[i]])
+			if a.selector && v.valid && selects(op, v, b.parts[i], t, b.t) {
+				b.time, b.t = row[0], t
+			}
+			b.parts[i] = reduceValue(op, b.parts[i], v)
+		}
+	}
+
+	sort.SliceStable(buckets, func(i, j int) bool {
+		if desc {
+			return buckets[i].t > buckets[j].t
+		}
+		return buckets[i].t < buckets[j].t
+	})
+
+	values := make([][]interface{}, len(buckets))
+	for i, b := range buckets {
+		row := make([]interface{}, len(a.Fields)+1)
+		row[0] = b.time
+		for j, f := range a.Fields {
+			row[j+1] = evalExpr(f, b.parts).Interface()
+		}
+		values[i] = row
+	}
+	if a.Interval {
+		fillValues(values, a.Fill)
+	}
+
+	s.Columns = append([]string{"time"}, a.Columns...)
+	s.Values = values
+}
+
+// value is a number in results, null if not valid.
+type value struct {
+	f     float64
+	i     int64
+	isInt bool
+	valid bool
+}
+
+func intValue(i int64) value {
+	return value{f: float64(i), i: i, isInt: true, valid: true}
+}
+
+func floatValue(f float64) value {
+	return value{f: f, valid: true}
+}
+
+func newValue(v interface{}) value {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return intValue(i)
+		}
+		if f, err := x.Float64(); err == nil {
+			return floatValue(f)
+		}
+	case int64:
+		return intValue(x)
+	case float64:
+		return floatValue(x)
+	}
+	return value{}
+}
+
+func (v value) Interface() interface{} {
+	switch {
+	case !v.valid:
+		return nil
+	case v.isInt:
+		return v.i
+	}
+	return v.f
+}
+
+func reduceValue(op string, a, b value) value {
+	if !a.valid {
+		return b
+	}
+	if !b.valid {
+		return a
+	}
+	switch op {
+	case "sum":
+		if a.isInt && b.isInt {
+			return intValue(a.i + b.i)
+		}
+		return floatValue(a.f + b.f)
+	case "min":
+		if b.f < a.f {
+			return b
+		}
+	case "max":
+		if b.f > a.f {
+			return b
+		}
+	}
+	return a
+}
+
+// selects tells if v at t wins cur at ct, the earlier one wins a tie.
+func selects(op string, v, cur value, t, ct int64) bool {
+	switch {
+	case !cur.valid:
+		return true
+	case v.f == cur.f:
+		return t < ct
+	case op == "min":
+		return v.f < cur.f
+	}
+	return v.f > cur.f
+}
+
+func evalExpr(e Expr, parts []value) value {
+	switch n := e.(type) {
+	case *NumberLiteral:
+		if n.IsInt {
+			return intValue(int64(n.Val))
+		}
+		return floatValue(n.Val)
+	case *ParenExpr:
+		return evalExpr(n.Expr, parts)
+	case *UnaryExpr:
+		v := evalExpr(n.Expr, parts)
+		if n.Op == SUB {
+			v.f, v.i = -v.f, -v.i
+		}
+		return v
+	case *BinaryExpr:
+		return arith(n.Op, evalExpr(n.LHS, parts), evalExpr(n.RHS, parts))
+	case *partialRef:
+		switch n.Call.Name {
+		case "mean":
+			sum, count := parts[n.Parts[0]], parts[n.Parts[1]]
+			if !sum.valid || !count.valid || count.f == 0 {
+				return value{}
+			}
+			return floatValue(sum.f / count.f)
+		case "spread":
+			return arith(SUB, parts[n.Parts[0]], parts[n.Parts[1]])
+		}
+		return parts[n.Parts[0]]
+	}
+	return value{}
+}
+
+func arith(op Token, a, b value) value {
+	if !a.valid || !b.valid {
+		return value{}
+	}
+	if a.isInt && b.isInt {
+		switch op {
+		case ADD:
+			return intValue(a.i + b.i)
+		case SUB:
+			return intValue(a.i - b.i)
+		case MUL:
+			return intValue(a.i * b.i)
+		}
+	}
+	switch op {
+	case ADD:
+		return floatValue(a.f + b.f)
+	case SUB:
+		return floatValue(a.f - b.f)
+	case MUL:
+		return floatValue(a.f * b.f)
+	case DIV:
+		// influxdb gives 0 for divided by zero.
+		if b.f == 0 {
+			return floatValue(0)
+		}
+		return floatValue(a.f / b.f)
+	}
+	return value{}
+}
+
+// fillValues fills nulls in rows sorted by time, like fill() of influxdb.
+func fillValues(values [][]interface{}, fill *Call) {
+	if fill == nil || len(fill.Args) != 1 {
+		return
+	}
+
+	switch {
+	case isFill(fill, "previous"):
+		for j := 1; len(values) != 0 && j < len(values[0]); j++ {
+			var prev interface{}
+			for _, row := range values {
+				if row[j] == nil {
+					row[j] = prev
+				} else {
+					prev = row[j]
+				}
+			}
+		}
+	case isFill(fill, "linear"):
+		for j := 1; len(values) != 0 && j < len(values[0]); j++ {
+			last := -1
+			for i, row := range values {
+				if row[j] == nil {
+					continue
+				}
+				if last >= 0 && i-last > 1 {
+					interpolate(values[last:i+1], j)
+				}
+				last = i
+			}
+		}
+	default:
+		v := evalExpr(fill.Args[0], nil)
+		if !v.valid {
+			return
+		}
+		for _, row := range values {
+			for j := 1; j < len(row); j++ {
+				if row[j] == nil {
+					row[j] = v.Interface()
+				}
+			}
+		}
+	}
+}
+
+// interpolate fills column j of rows between the first and the last.
+func interpolate(rows [][]interface{}, j int) {
+	first, last := rows[0], rows[len(rows)-1]
+	t0, _ := timeValue(first[0])
+	t1, _ := timeValue(last[0])
+	v0, v1 := newValue(first[j]), newValue(last[j])
+	if t0 == t1 {
+		return
+	}
+	for _, row := range rows[1 : len(rows)-1] {
+		t, _ := timeValue(row[0])
+		f := v0.f + (v1.f-v0.f)*float64(t-t0)/float64(t1-t0)
+		if v0.isInt && v1.isInt {
+			row[j] = int64(f)
+		} else {
+			row[j] = f
+		}
+	}
+}
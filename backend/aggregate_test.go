@@ -0,0 +1,172 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPlanQuery(t *testing.T) {
+	tests := []struct {
+		q    string
+		want string
+	}{
+		{
+			q:    "SELECT v FROM cpu LIMIT 10 OFFSET 5 SLIMIT 2 SOFFSET 1",
+			want: "SELECT v FROM cpu LIMIT 15 SLIMIT 3",
+		},
+		{
+			q:    "SELECT mean(v), count(v), max(v) AS top FROM cpu WHERE time > now() - 1h GROUP BY time(10m), host fill(0)",
+			want: "SELECT sum(v) AS __p0, count(v) AS __p1, max(v) AS __p2 FROM cpu WHERE time > now() - 1h GROUP BY time(10m), host",
+		},
+		{
+			q:    "SELECT spread(v) / 2, min(v) FROM cpu fill(none)",
+			want: "SELECT max(v) AS __p0, min(v) AS __p1 FROM cpu fill(none)",
+		},
+		{
+			q:    "SELECT percentile(v, 95) FROM cpu GROUP BY *",
+			want: "SELECT percentile(v, 95) FROM cpu GROUP BY *",
+		},
+		{
+			q:    "SELECT max(v) FROM (SELECT v FROM cpu WHERE host = 'a')",
+			want: "SELECT max(v) AS __p0 FROM (SELECT v FROM cpu WHERE host = 'a')",
+		},
+		{
+			q:    "SHOW TAG KEYS FROM cpu",
+			want: "SHOW TAG KEYS FROM cpu",
+		},
+	}
+
+	for _, tt := range tests {
+		plan, err := PlanQuery(tt.q)
+		if err != nil {
+			t.Errorf("%s: %s", tt.q, err)
+			continue
+		}
+		if plan.Query != tt.want {
+			t.Errorf("%s:\n%s\n%s", tt.q, plan.Query, tt.want)
+		}
+	}
+}
+
+func TestPlanQueryUnsupported(t *testing.T) {
+	tests := []string{
+		"SELECT percentile(v, 95) FROM cpu GROUP BY time(1m)",
+		"SELECT top(v, 3) FROM cpu",
+		"SELECT count(distinct(v)) FROM cpu",
+		"SELECT mean(v), host FROM cpu",
+		"SELECT v FROM (SELECT mean(v) AS v FROM cpu GROUP BY time(1m))",
+		"SELECT mean(v) INTO cpu_1m FROM cpu GROUP BY time(1m), *",
+		"SELECT * INTO \"rp\".cpu FROM cpu",
+	}
+
+	for _, q := range tests {
+		_, err := PlanQuery(q)
+		if _, ok := err.(*AggregateError); !ok {
+			t.Errorf("%s: should not be supported, %v", q, err)
+		}
+	}
+}
+
+func TestPlanQueryParseError(t *testing.T) {
+	for _, q := range []string{"SELECT FROM cpu", "DROP MEASUREMENT cpu"} {
+		plan, err := PlanQuery(q)
+		if err == nil {
+			t.Errorf("%s: should fail, got %v", q, plan)
+		}
+	}
+}
+
+func TestColumnNames(t *testing.T) {
+	stmts, err := ParseQuery("SELECT mean(v), mean(u), mean_1, max(v) * 2 AS mean_2, mean(v) + max(v) FROM cpu")
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	columns := columnNames(stmts[0].(*SelectStatement).Fields)
+	want := []string{"mean", "mean_1", "mean_1_1", "mean_2", "mean_max"}
+	for i := range want {
+		if columns[i] != want[i] {
+			t.Errorf("columns wrong: %v", columns)
+			return
+		}
+	}
+}
+
+func reduceShards(t *testing.T, q string, bodies ...string) string {
+	plan, err := PlanQuery(q)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	var resps []*Response
+	for _, body := range bodies {
+		resps = append(resps, mustParseResponse(t, body))
+	}
+	p, err := json.Marshal(MergeResponses(resps, plan.Merges))
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	return string(p)
+}
+
+func TestAggregateReduce(t *testing.T) {
+	got := reduceShards(t,
+		"SELECT mean(v), count(v), spread(v), max(v) / 2 FROM cpu WHERE time > 0 GROUP BY time(10s) fill(0)",
+		`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","__p0","__p1","__p2","__p3"],
+			"values":[[0,6,2,4,2],[10,null,null,null,null],[20,1.5,1,1.5,1.5]]}]}]}`,
+		`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","__p0","__p1","__p2","__p3"],
+			"values":[[0,3,1,3,3],[10,null,null,null,null],[20,null,null,null,null]]}]}]}`,
+	)
+	want := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","mean","count","spread","max"],` +
+		`"values":[[0,3,3,2,2],[10,0,0,0,0],[20,1.5,1,0,0.75]]}]}]}`
+	if got != want {
+		t.Errorf("reduce wrong:\n%s\n%s", got, want)
+	}
+}
+
+func TestAggregateReduceGroups(t *testing.T) {
+	got := reduceShards(t,
+		"SELECT sum(v) FROM cpu GROUP BY host, time(10s) fill(previous) LIMIT 2 OFFSET 1",
+		`{"results":[{"statement_id":0,"series":[
+			{"name":"cpu","tags":{"host":"a"},"columns":["time","__p0"],"values":[[0,1],[10,null],[20,null]]},
+			{"name":"cpu","tags":{"host":"b"},"columns":["time","__p0"],"values":[[0,5],[10,null],[20,2]]}]}]}`,
+		`{"results":[{"statement_id":0,"series":[
+			{"name":"cpu","tags":{"host":"a"},"columns":["time","__p0"],"values":[[0,2],[10,3],[20,null]]}]}]}`,
+	)
+	want := `{"results":[{"statement_id":0,"series":[` +
+		`{"name":"cpu","tags":{"host":"a"},"columns":["time","sum"],"values":[[10,3],[20,3]]},` +
+		`{"name":"cpu","tags":{"host":"b"},"columns":["time","sum"],"values":[[10,5],[20,2]]}]}]}`
+	if got != want {
+		t.Errorf("reduce wrong:\n%s\n%s", got, want)
+	}
+}
+
+func TestAggregateReduceSelector(t *testing.T) {
+	got := reduceShards(t,
+		"SELECT min(v) FROM cpu",
+		`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","__p0"],"values":[[30,4]]}]}]}`,
+		`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","__p0"],"values":[[20,2]]}]}]}`,
+		`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","__p0"],"values":[[10,2]]}]}]}`,
+	)
+	want := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","min"],"values":[[10,2]]}]}]}`
+	if got != want {
+		t.Errorf("reduce wrong:\n%s\n%s", got, want)
+	}
+}
+
+func TestFillLinear(t *testing.T) {
+	values := [][]interface{}{
+		{int64(0), int64(0)},
+		{int64(10), nil},
+		{int64(20), nil},
+		{int64(30), 3.0},
+		{int64(40), nil},
+	}
+	fillValues(values, &Call{Name: "fill", Args: []Expr{&VarRef{Val: "linear"}}})
+	if values[1][1] != 1.0 || values[2][1] != 2.0 || values[4][1] != nil {
+		t.Errorf("fill wrong: %v", values)
+	}
+}
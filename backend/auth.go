@@ -0,0 +1,201 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	PASSWORD_SCHEME     = "pbkdf2_sha256"
+	PASSWORD_ITERATIONS = 10000
+	PASSWORD_SALT_SIZE  = 16
+)
+
+var (
+	ErrAuthFailed      = errors.New("authorization failed")
+	ErrIllegalPassword = errors.New("illegal hashed password")
+)
+
+// UserConfig is a user of proxy. Password is hashed by HashPassword,
+// tokens are sha256 of bearer tokens in hex.
+// Read and Write are patterns like db:measurement, see acl.
+// Statements are the types of statements allowed, select, show or admin.
+// Admin users can call /reload and /debug.
+type UserConfig struct {
+	Password   string
+	Tokens     []string
+	Read       []string
+	Write      []string
+	Statements []string `default:"select,show"`
+	Admin      bool
+}
+
+// HashPassword returns password hashed like pbkdf2_sha256$iterations$salt$hash,
+// salt and hash are in hex.
+func HashPassword(password string) (hashed string, err error) {
+	salt := make([]byte, PASSWORD_SALT_SIZE)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return
+	}
+	key := pbkdf2.Key([]byte(password), salt, PASSWORD_ITERATIONS, sha256.Size, sha256.New)
+	hashed = strings.Join([]string{
+		PASSWORD_SCHEME,
+		strconv.Itoa(PASSWORD_ITERATIONS),
+		hex.EncodeToString(salt),
+		hex.EncodeToString(key),
+	}, "$")
+	return
+}
+
+// CheckPassword tells if password is the one hashed.
+func CheckPassword(hashed string, password string) (err error) {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 4 || parts[0] != PASSWORD_SCHEME {
+		return ErrIllegalPassword
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return ErrIllegalPassword
+	}
+	salt, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return ErrIllegalPassword
+	}
+	want, err := hex.DecodeString(parts[3])
+	if err != nil || len(want) == 0 {
+		return ErrIllegalPassword
+	}
+
+	key := pbkdf2.Key([]byte(password), salt, iter, len(want), sha256.New)
+	if subtle.ConstantTimeCompare(key, want) != 1 {
+		return ErrAuthFailed
+	}
+	return
+}
+
+// HashToken is how a bearer token is kept in config.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Credentials finds user and password, or token, of a request.
+// Bearer token first, then basic auth, then u and p like influxdb.
+func Credentials(req *http.Request) (user, password, token string) {
+	auth := req.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return "", "", strings.TrimSpace(auth[len("Bearer "):])
+	}
+
+	user, password, ok := req.BasicAuth()
+	if ok {
+		return
+	}
+
+	q := req.URL.Query()
+	user, password = q.Get("u"), q.Get("p")
+	if user == "" && req.Form != nil {
+		user, password = req.Form.Get("u"), req.Form.Get("p")
+	}
+	return
+}
+
+// Authenticator checks users of proxy. Passwords verified are remembered
+// in digests, hashing them again on every request is too slow.
+type Authenticator struct {
+	lock     sync.Mutex
+	users    map[string]*UserConfig
+	policies map[string]*Policy
+	tokens   map[string]string // hashed token to user
+	verified map[string]bool   // digests of hashed and plain passwords
+	secret   []byte            // random key of digests, never out of the process
+}
+
+func NewAuthenticator(users map[string]*UserConfig) (a *Authenticator, err error) {
+	a = &Authenticator{
+		users:    users,
+		policies: make(map[string]*Policy, len(users)),
+		tokens:   make(map[string]string),
+		verified: make(map[string]bool),
+		secret:   make([]byte, sha256.Size),
+	}
+	_, err = rand.Read(a.secret)
+	if err != nil {
+		return
+	}
+	for name, cfg := range users {
+		a.policies[name], err = NewPolicy(name, cfg)
+		if err != nil {
+			log.Printf("user %s: %s", name, err)
+			return
+		}
+		for _, token := range cfg.Tokens {
+			a.tokens[strings.ToLower(token)] = name
+		}
+	}
+	return
+}
+
+// Authenticate returns the policy of the user of request.
+func (a *Authenticator) Authenticate(req *http.Request) (policy *Policy, err error) {
+	user, password, token := Credentials(req)
+	if token != "" {
+		name, ok := a.tokens[HashToken(token)]
+		if !ok {
+			return nil, ErrAuthFailed
+		}
+		return a.policies[name], nil
+	}
+
+	if user == "" {
+		return nil, ErrAuthFailed
+	}
+	cfg, ok := a.users[user]
+	if !ok || cfg.Password == "" {
+		return nil, ErrAuthFailed
+	}
+
+	digest := a.digest(cfg.Password, password)
+	a.lock.Lock()
+	ok = a.verified[digest]
+	a.lock.Unlock()
+	if ok {
+		return a.policies[user], nil
+	}
+
+	err = CheckPassword(cfg.Password, password)
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+
+	a.lock.Lock()
+	a.verified[digest] = true
+	a.lock.Unlock()
+	return a.policies[user], nil
+}
+
+// digest of hashed and plain password, in HMAC by the secret, so passwords
+// can't be guessed from it without the process.
+func (a *Authenticator) digest(hashed string, password string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(hashed))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(password))
+	return string(mac.Sum(nil))
+}
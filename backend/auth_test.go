@@ -0,0 +1,90 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+func TestPbkdf2(t *testing.T) {
+	// RFC 7914, section 11, passwords hashed before are still good.
+	hashed := "pbkdf2_sha256$1$" + hex.EncodeToString([]byte("salt")) + "$" +
+		"55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	err := CheckPassword(hashed, "passwd")
+	if err != nil {
+		t.Errorf("pbkdf2 wrong: %s", err)
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	hashed, err := HashPassword("secret")
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+
+	err = CheckPassword(hashed, "secret")
+	if err != nil {
+		t.Errorf("error: %s", err)
+	}
+	err = CheckPassword(hashed, "secrets")
+	if err != ErrAuthFailed {
+		t.Errorf("wrong password passed: %v", err)
+	}
+	err = CheckPassword("secret", "secret")
+	if err != ErrIllegalPassword {
+		t.Errorf("plain password passed: %v", err)
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	hashed, err := HashPassword("secret")
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	auth, err := NewAuthenticator(map[string]*UserConfig{
+		"grafana": {Password: hashed},
+		"bot":     {Tokens: []string{HashToken("t0ken")}},
+	})
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+
+	tests := []struct {
+		url    string
+		header string
+		user   string
+		ok     bool
+	}{
+		{"/query?u=grafana&p=secret", "", "grafana", true},
+		{"/query?u=grafana&p=secret", "", "grafana", true},
+		{"/query?u=grafana&p=wrong", "", "", false},
+		{"/query", "Basic Z3JhZmFuYTpzZWNyZXQ=", "grafana", true},
+		{"/query?u=bot&p=t0ken", "", "", false},
+		{"/write", "Bearer t0ken", "bot", true},
+		{"/write", "Bearer wrong", "", false},
+		{"/write", "", "", false},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.url, nil)
+		if err != nil {
+			t.Errorf("error: %s", err)
+			return
+		}
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+
+		policy, err := auth.Authenticate(req)
+		if (err == nil) != tt.ok || (err == nil && policy.User != tt.user) {
+			t.Errorf("%s %s: %v, %v", tt.url, tt.header, policy, err)
+		}
+	}
+}
@@ -6,9 +6,12 @@ package backend
 
 import (
 	"bytes"
+	"compress/gzip"
+	"errors"
 	"io"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,39 +19,103 @@ const (
 	WRITE_QUEUE = 16
 )
 
+// what to do with a point if the write queue is full.
+const (
+	QUEUE_SPILL       = "spill"       // write it to file, rewritten later
+	QUEUE_DROP_OLDEST = "drop-oldest" // drop the oldest point queued
+	QUEUE_REJECT      = "reject"      // tell client to retry
+)
+
+var (
+	ErrIllegalRecord = errors.New("illegal record")
+	ErrQueueFull     = errors.New("write queue of backend is full")
+)
+
+type writeItem struct {
+	p      []byte
+	params *WriteParams
+	ack    chan error // gets the result of writing it, if not nil
+}
+
+func (item *writeItem) done(err error) {
+	if item.ack != nil {
+		item.ack <- err
+	}
+}
+
+// batch buffers points with the same write parameters.
+type batch struct {
+	params        *WriteParams
+	buffer        bytes.Buffer
+	write_counter int32
+	created       time.Time
+	zbuf          bytes.Buffer // gzipped buffer, if compressed size is limited
+	zip           *gzip.Writer
+	acks          []chan error
+}
+
 type Backends struct {
 	*HttpBackend
 	fb              *FileBackend
-	Interval        int
-	RewriteInterval int
+	Interval        time.Duration
+	RewriteInterval time.Duration
 	MaxRowLimit     int32
-
-	running          bool
+	QueueFull       string
+
+	MaxBatchBytes      int
+	MaxBatchCompressed int
+	MaxBatchAge        time.Duration
+	AdaptiveBatch      bool
+	MinRowLimit        int32
+	SlowWrite          time.Duration
+	rowLimit           int32 // row limit by now, if AdaptiveBatch
+
+	// points not queued, since the last statistics.
+	Spilled  int64
+	Dropped  int64
+	Rejected int64
+
+	running          atomicBool
+	lock             sync.RWMutex // writers hold it to send, Close to close ch_write
 	ticker           *time.Ticker
-	ch_write         chan []byte
-	buffer           *bytes.Buffer
+	ch_write         chan *writeItem
+	batches          map[string]*batch
 	ch_timer         <-chan time.Time
-	write_counter    int32
-	rewriter_running bool
+	timer_at         time.Time // when ch_timer fires
+	rewriter_running atomicBool
 	wg               sync.WaitGroup
 }
 
 // maybe ch_timer is not the best way.
 func NewBackends(cfg *BackendConfig, name string) (bs *Backends, err error) {
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = WRITE_QUEUE
+	}
 	bs = &Backends{
 		HttpBackend: NewHttpBackend(cfg),
 		// FIXME: path...
 		Interval:        cfg.Interval,
 		RewriteInterval: cfg.RewriteInterval,
-		running:         true,
-		ticker:          time.NewTicker(time.Millisecond * time.Duration(cfg.RewriteInterval)),
-		ch_write:        make(chan []byte, 16),
-
-		rewriter_running: false,
-		MaxRowLimit:      int32(cfg.MaxRowLimit),
+		ticker:          time.NewTicker(cfg.RewriteInterval),
+		ch_write:        make(chan *writeItem, queueSize),
+		QueueFull:       cfg.QueueFull,
+		batches:         make(map[string]*batch),
+
+		MaxRowLimit: int32(cfg.MaxRowLimit),
+
+		MaxBatchBytes:      cfg.MaxBatchBytes,
+		MaxBatchCompressed: cfg.MaxBatchCompressed,
+		MaxBatchAge:        cfg.MaxBatchAge,
+		AdaptiveBatch:      cfg.AdaptiveBatch,
+		MinRowLimit:        int32(cfg.MinRowLimit),
+		SlowWrite:          cfg.SlowWrite,
+		rowLimit:           int32(cfg.MaxRowLimit),
 	}
+	bs.running.Set(true)
 	bs.fb, err = NewFileBackend(name)
 	if err != nil {
+		bs.HttpBackend.Close()
 		return
 	}
 
@@ -57,9 +124,9 @@ func NewBackends(cfg *BackendConfig, name string) (bs *Backends, err error) {
 }
 
 func (bs *Backends) worker() {
-	for bs.running {
+	for bs.running.Get() {
 		select {
-		case p, ok := <-bs.ch_write:
+		case item, ok := <-bs.ch_write:
 			if !ok {
 				// closed
 				bs.Flush()
@@ -68,11 +135,11 @@ func (bs *Backends) worker() {
 				bs.fb.Close()
 				return
 			}
-			bs.WriteBuffer(p)
+			bs.bufferItem(item)
 
 		case <-bs.ch_timer:
 			bs.Flush()
-			if !bs.running {
+			if !bs.running.Get() {
 				bs.wg.Wait()
 				bs.HttpBackend.Close()
 				bs.fb.Close()
@@ -85,68 +152,268 @@ func (bs *Backends) worker() {
 	}
 }
 
-func (bs *Backends) Write(p []byte) (err error) {
-	if !bs.running {
+func (bs *Backends) Write(p []byte, params *WriteParams) (err error) {
+	if !bs.running.Get() {
+		return io.ErrClosedPipe
+	}
+	if params == nil {
+		params = &WriteParams{}
+	}
+
+	return bs.enqueue(&writeItem{p: p, params: params})
+}
+
+// WriteConfirmed queues p like Write, ack gets nil when the backend
+// has taken it, or why not. ack is nil if err isn't.
+func (bs *Backends) WriteConfirmed(p []byte, params *WriteParams) (ack <-chan error, err error) {
+	if !bs.running.Get() {
+		return nil, io.ErrClosedPipe
+	}
+	if params == nil {
+		params = &WriteParams{}
+	}
+	item := &writeItem{p: p, params: params, ack: make(chan error, 1)}
+	err = bs.enqueue(item)
+	if err != nil {
+		return
+	}
+	return item.ack, nil
+}
+
+// WriteDurable appends p to file, and synced, so it's durable on local disk.
+// The rewriter is started at once to send it, not waiting for the ticker.
+func (bs *Backends) WriteDurable(p []byte, params *WriteParams) (err error) {
+	if !bs.running.Get() {
+		return io.ErrClosedPipe
+	}
+	if params == nil {
+		params = &WriteParams{}
+	}
+	bs.lock.RLock()
+	if !bs.running.Get() {
+		bs.lock.RUnlock()
+		return io.ErrClosedPipe
+	}
+	err = bs.spill(p, params)
+	bs.lock.RUnlock()
+	if err != nil {
+		return
+	}
+	bs.Idle()
+	return
+}
+
+func (bs *Backends) enqueue(item *writeItem) (err error) {
+	p, params := item.p, item.params
+	// ch_write is closed by Close, don't send on it then.
+	bs.lock.RLock()
+	defer bs.lock.RUnlock()
+	if !bs.running.Get() {
 		return io.ErrClosedPipe
 	}
 
-	bs.ch_write <- p
+	// never block the writer, a slow backend shouldn't stall clients.
+	select {
+	case bs.ch_write <- item:
+		return
+	default:
+	}
+
+	switch bs.QueueFull {
+	case QUEUE_REJECT:
+		atomic.AddInt64(&bs.Rejected, CountLines(p))
+		return ErrQueueFull
+	case QUEUE_DROP_OLDEST:
+		select {
+		case old := <-bs.ch_write:
+			atomic.AddInt64(&bs.Dropped, CountLines(old.p))
+			old.done(ErrQueueFull)
+		default:
+		}
+		select {
+		case bs.ch_write <- item:
+		default:
+			// taken by other writers.
+			atomic.AddInt64(&bs.Dropped, CountLines(p))
+			item.done(ErrQueueFull)
+		}
+		return
+	default:
+		atomic.AddInt64(&bs.Spilled, CountLines(p))
+		err = bs.spill(p, params)
+		if err == nil {
+			// safe in file, but not taken by the backend yet.
+			item.done(ErrNotConfirmed)
+		}
+		return
+	}
+}
+
+// spill writes p to file directly, rewriter sends it later.
+func (bs *Backends) spill(p []byte, params *WriteParams) (err error) {
+	var buf bytes.Buffer
+	err = Compress(&buf, p)
+	if err != nil {
+		log.Printf("compress error: %s\n", err)
+		return
+	}
+	err = bs.fb.Write(EncodeRecord(params, buf.Bytes()))
+	if err != nil {
+		log.Printf("write file error: %s\n", err)
+	}
 	return
 }
 
 func (bs *Backends) Close() (err error) {
-	bs.running = false
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	if !bs.running.Get() {
+		return
+	}
+	bs.running.Set(false)
 	close(bs.ch_write)
 	return
 }
 
-func (bs *Backends) WriteBuffer(p []byte) {
-	bs.write_counter++
+// WriteBuffer puts p into the batch of its parameters, p may be many lines.
+func (bs *Backends) WriteBuffer(p []byte, params *WriteParams) {
+	bs.bufferItem(&writeItem{p: p, params: params})
+}
 
-	if bs.buffer == nil {
-		bs.buffer = &bytes.Buffer{}
+func (bs *Backends) bufferItem(item *writeItem) {
+	p, params := item.p, item.params
+	if len(p) == 0 {
+		item.done(nil)
+		return
+	}
+	key := params.Key()
+	b, ok := bs.batches[key]
+	if !ok {
+		b = &batch{params: params, created: time.Now()}
+		bs.batches[key] = b
+	}
+	start, counter := b.buffer.Len(), b.write_counter
+	b.write_counter += int32(bytes.Count(p, []byte{'\n'}))
+	if p[len(p)-1] != '\n' {
+		b.write_counter++
 	}
 
-	n, err := bs.buffer.Write(p)
+	n, err := b.buffer.Write(p)
+	if err == nil && n != len(p) {
+		err = io.ErrShortWrite
+	}
+	if err == nil && p[len(p)-1] != '\n' {
+		_, err = b.buffer.Write([]byte{'\n'})
+	}
 	if err != nil {
 		log.Printf("error: %s\n", err)
+		// take the part written back, lines of others in batch are fine.
+		b.buffer.Truncate(start)
+		b.write_counter = counter
+		if b.buffer.Len() == 0 {
+			delete(bs.batches, key)
+		}
+		item.done(err)
 		return
 	}
-	if n != len(p) {
-		err = io.ErrShortWrite
-		log.Printf("error: %s\n", err)
+
+	if bs.MaxBatchCompressed > 0 {
+		if b.zip == nil {
+			b.zip = gzip.NewWriter(&b.zbuf)
+		}
+		_, err = b.zip.Write(b.buffer.Bytes()[start:])
+		if err != nil {
+			log.Printf("compress error: %s\n", err)
+			b.zip = nil
+		}
+	}
+
+	if item.ack != nil {
+		b.acks = append(b.acks, item.ack)
+	}
+
+	if bs.full(b) {
+		delete(bs.batches, key)
+		bs.flushBatch(b)
 		return
 	}
+	bs.arm(b)
+	return
+}
 
-	if p[len(p)-1] != '\n' {
-		_, err = bs.buffer.Write([]byte{'\n'})
-		if err != nil {
-			log.Printf("error: %s\n", err)
-			return
+// arm the timer to flush in Interval, or sooner if b gets too old by then.
+func (bs *Backends) arm(b *batch) {
+	d := bs.Interval
+	if bs.MaxBatchAge > 0 {
+		if left := bs.MaxBatchAge - time.Since(b.created); left < d {
+			d = left
 		}
 	}
+	at := time.Now().Add(d)
+	if bs.ch_timer == nil || at.Before(bs.timer_at) {
+		bs.ch_timer = time.After(d)
+		bs.timer_at = at
+	}
+}
 
+// full tells if b hits any limit of batch.
+func (bs *Backends) full(b *batch) bool {
 	switch {
-	case bs.write_counter >= bs.MaxRowLimit:
-		bs.Flush()
-	case bs.ch_timer == nil:
-		bs.ch_timer = time.After(
-			time.Millisecond * time.Duration(bs.Interval))
+	case b.write_counter >= bs.RowLimit():
+	case bs.MaxBatchBytes > 0 && b.buffer.Len() >= bs.MaxBatchBytes:
+	case bs.MaxBatchCompressed > 0 && b.zip != nil && b.zbuf.Len() >= bs.MaxBatchCompressed:
+	case bs.MaxBatchAge > 0 && time.Since(b.created) >= bs.MaxBatchAge:
+	default:
+		return false
 	}
+	return true
+}
 
-	return
+// RowLimit is the rows of a batch to flush it.
+func (bs *Backends) RowLimit() int32 {
+	if !bs.AdaptiveBatch {
+		return bs.MaxRowLimit
+	}
+	return atomic.LoadInt32(&bs.rowLimit)
 }
 
-func (bs *Backends) Flush() {
-	if bs.buffer == nil {
+// adapt the row limit to d, the time a batch was written in.
+func (bs *Backends) adapt(d time.Duration) {
+	if !bs.AdaptiveBatch {
 		return
 	}
+	limit := atomic.LoadInt32(&bs.rowLimit)
+	switch {
+	case d > bs.SlowWrite:
+		limit /= 2
+		if limit < bs.MinRowLimit {
+			limit = bs.MinRowLimit
+		}
+	case d < bs.SlowWrite/2:
+		step := bs.MaxRowLimit / 10
+		if step < 1 {
+			step = 1
+		}
+		limit += step
+		if limit > bs.MaxRowLimit {
+			limit = bs.MaxRowLimit
+		}
+	}
+	atomic.StoreInt32(&bs.rowLimit, limit)
+}
 
-	p := bs.buffer.Bytes()
-	bs.buffer = nil
+func (bs *Backends) Flush() {
+	batches := bs.batches
+	bs.batches = make(map[string]*batch)
 	bs.ch_timer = nil
-	bs.write_counter = 0
 
+	for _, b := range batches {
+		bs.flushBatch(b)
+	}
+}
+
+func (bs *Backends) flushBatch(b *batch) {
+	p := b.buffer.Bytes()
 	if len(p) == 0 {
 		return
 	}
@@ -155,26 +422,50 @@ func (bs *Backends) Flush() {
 	bs.wg.Add(1)
 	go func() {
 		defer bs.wg.Done()
-		var buf bytes.Buffer
-		err := Compress(&buf, p)
+		// writes waiting for it are confirmed only if the backend takes it,
+		// and lost if not in file either.
+		acked := ErrNotCached
+		defer func() {
+			for _, ack := range b.acks {
+				ack <- acked
+			}
+		}()
+
+		var err error
+		if b.zip != nil {
+			// compressed already when buffered.
+			err = b.zip.Close()
+			p = b.zbuf.Bytes()
+		} else {
+			var buf bytes.Buffer
+			err = Compress(&buf, p)
+			p = buf.Bytes()
+		}
 		if err != nil {
 			log.Printf("write file error: %s\n", err)
 			return
 		}
 
-		p = buf.Bytes()
-
 		// maybe blocked here, run in another goroutine
 		if bs.HttpBackend.IsActive() {
-			err = bs.HttpBackend.WriteCompressed(p)
+			start := time.Now()
+			err = bs.HttpBackend.WriteCompressed(p, b.params)
+			bs.adapt(time.Since(start))
 			switch err {
 			case nil:
+				acked = nil
 				return
 			case ErrBadRequest:
 				log.Printf("bad request, drop all data.")
+				acked = err
 				return
 			case ErrNotFound:
 				log.Printf("bad backend, drop all data.")
+				acked = err
+				return
+			case ErrUnauthorized:
+				log.Printf("unauthorized, drop all data.")
+				acked = err
 				return
 			default:
 				log.Printf("unknown error %s, maybe overloaded.", err)
@@ -182,10 +473,12 @@ func (bs *Backends) Flush() {
 			log.Printf("write http error: %s\n", err)
 		}
 
-		err = bs.fb.Write(p)
+		err = bs.fb.Write(EncodeRecord(b.params, p))
 		if err != nil {
 			log.Printf("write file error: %s\n", err)
+			return
 		}
+		acked = ErrNotConfirmed
 		// don't try to run rewrite loop directly.
 		// that need a lock.
 	}()
@@ -193,9 +486,41 @@ func (bs *Backends) Flush() {
 	return
 }
 
+// Records in file are gzipped points. If they have write parameters,
+// a zero byte and the parameters in a line go before the points.
+// So records written before parameters are kept still work.
+// Credentials of clients are never kept, records are rewritten with the
+// ones of the backend.
+func EncodeRecord(params *WriteParams, p []byte) []byte {
+	values := params.Values().Encode()
+	if values == "" {
+		return p
+	}
+	record := make([]byte, 0, len(values)+len(p)+2)
+	record = append(record, 0)
+	record = append(record, values...)
+	record = append(record, '\n')
+	return append(record, p...)
+}
+
+func DecodeRecord(record []byte) (params *WriteParams, p []byte, err error) {
+	if len(record) == 0 || record[0] != 0 {
+		return &WriteParams{}, record, nil
+	}
+
+	i := bytes.IndexByte(record, '\n')
+	if i == -1 {
+		return nil, nil, ErrIllegalRecord
+	}
+	params, err = ParseWriteParams(string(record[1:i]))
+	if err != nil {
+		return
+	}
+	return params, record[i+1:], nil
+}
+
 func (bs *Backends) Idle() {
-	if !bs.rewriter_running && bs.fb.IsData() {
-		bs.rewriter_running = true
+	if bs.fb.IsData() && bs.rewriter_running.CompareAndSwap(false, true) {
 		go bs.RewriteLoop()
 	}
 
@@ -204,20 +529,20 @@ func (bs *Backends) Idle() {
 
 func (bs *Backends) RewriteLoop() {
 	for bs.fb.IsData() {
-		if !bs.running {
+		if !bs.running.Get() {
 			return
 		}
 		if !bs.HttpBackend.IsActive() {
-			time.Sleep(time.Millisecond * time.Duration(bs.RewriteInterval))
+			time.Sleep(bs.RewriteInterval)
 			continue
 		}
 		err := bs.Rewrite()
 		if err != nil {
-			time.Sleep(time.Millisecond * time.Duration(bs.RewriteInterval))
+			time.Sleep(bs.RewriteInterval)
 			continue
 		}
 	}
-	bs.rewriter_running = false
+	bs.rewriter_running.Set(false)
 }
 
 func (bs *Backends) Rewrite() (err error) {
@@ -229,7 +554,14 @@ func (bs *Backends) Rewrite() (err error) {
 		return
 	}
 
-	err = bs.HttpBackend.WriteCompressed(p)
+	params, p, err := DecodeRecord(p)
+	if err != nil {
+		// can't be fixed by retry, skip it.
+		log.Printf("decode record error: %s\n", err)
+		return bs.fb.UpdateMeta()
+	}
+
+	err = bs.HttpBackend.WriteCompressed(p, params)
 
 	switch err {
 	case nil:
@@ -239,6 +571,10 @@ func (bs *Backends) Rewrite() (err error) {
 	case ErrNotFound:
 		log.Printf("bad backend, drop all data.")
 		err = nil
+	case ErrUnauthorized:
+		// retrying won't help, and it would block records after it.
+		log.Printf("unauthorized, drop all data.")
+		err = nil
 	default:
 		log.Printf("unknown error %s, maybe overloaded.", err)
 
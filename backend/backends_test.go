@@ -5,6 +5,17 @@
 package backend
 
 import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -19,13 +30,13 @@ func TestCache(t *testing.T) {
 	}
 	defer bs.Close()
 
-	err = bs.Write([]byte("cpu,host=server01,region=uswest value=1 1434055562000000000"))
+	err = bs.Write([]byte("cpu,host=server01,region=uswest value=1 1434055562000000000"), &WriteParams{})
 	if err != nil {
 		t.Errorf("error: %s", err)
 		return
 	}
 
-	err = bs.Write([]byte("cpu value=3,value2=4 1434055562000010000"))
+	err = bs.Write([]byte("cpu value=3,value2=4 1434055562000010000"), &WriteParams{})
 	if err != nil {
 		t.Errorf("error: %s", err)
 		return
@@ -53,3 +64,335 @@ func TestRewrite(t *testing.T) {
 	}
 	time.Sleep(2 * time.Second)
 }
+
+func TestBackendsParams(t *testing.T) {
+	var lock sync.Mutex
+	var writes []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer req.Body.Close()
+		if req.URL.Path != "/write" {
+			w.WriteHeader(204)
+			return
+		}
+		zr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		p, _ := ioutil.ReadAll(zr)
+		user, _, _ := req.BasicAuth()
+
+		lock.Lock()
+		writes = append(writes, req.URL.Query().Encode()+" "+user+" "+strings.TrimSpace(string(p)))
+		lock.Unlock()
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	bs, err := NewBackends(cfg, "test")
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	defer bs.Close()
+
+	seconds := &WriteParams{RP: "one_year", Precision: "s"}
+	bs.Write([]byte("cpu value=1 1"), seconds)
+	bs.Write([]byte("cpu value=2 2"), &WriteParams{Precision: "ms", Consistency: "all", User: "u", Password: "p"})
+	bs.Write([]byte("cpu value=3 3"), seconds)
+	time.Sleep(time.Second)
+
+	lock.Lock()
+	defer lock.Unlock()
+	sort.Strings(writes)
+	want := []string{
+		"consistency=all&db=test&precision=ms u cpu value=2 2",
+		"db=test&precision=s&rp=one_year  cpu value=1 1\ncpu value=3 3",
+	}
+	if strings.Join(writes, "|") != strings.Join(want, "|") {
+		t.Errorf("writes wrong: %q", writes)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	params := &WriteParams{RP: "rp", Precision: "s", User: "writer", Password: "secret"}
+	record := EncodeRecord(params, []byte("\x1f\x8bdata"))
+	params2, p, err := DecodeRecord(record)
+	if err != nil || params2.RP != "rp" || params2.Precision != "s" || params2.User != "" ||
+		params2.Password != "" || string(p) != "\x1f\x8bdata" {
+		t.Errorf("record wrong: %v %q %v", params2, p, err)
+	}
+	if bytes.Contains(record, []byte("secret")) {
+		t.Errorf("password kept in record: %q", record)
+	}
+
+	// without parameters, or written before parameters
+	record = EncodeRecord(&WriteParams{}, []byte("\x1f\x8bdata"))
+	params2, p, err = DecodeRecord(record)
+	if err != nil || params2.Key() != (&WriteParams{}).Key() || string(p) != "\x1f\x8bdata" {
+		t.Errorf("record wrong: %v %q %v", params2, p, err)
+	}
+
+	_, _, err = DecodeRecord([]byte("\x00rp=a"))
+	if err != ErrIllegalRecord {
+		t.Errorf("illegal record passed: %v", err)
+	}
+}
+
+func TestBackendsRewriteAuth(t *testing.T) {
+	var lock sync.Mutex
+	var writes []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user, password, _ := req.BasicAuth()
+		if user != "writer" || password != "secret" {
+			w.WriteHeader(401)
+			return
+		}
+		if req.URL.Path == "/write" {
+			lock.Lock()
+			writes = append(writes, req.URL.Query().Get("rp"))
+			lock.Unlock()
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	bs, err := createStuckBackends("rewrite_auth")
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	defer os.Remove("queue_rewrite_auth.dat")
+	defer os.Remove("queue_rewrite_auth.rec")
+	defer bs.fb.Close()
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	bs.HttpBackend.Close()
+	bs.HttpBackend = NewHttpBackend(cfg)
+	defer func() { bs.HttpBackend.Close() }()
+
+	// credentials of clients aren't kept, the unauthorized is skipped, not retried.
+	bs.spill([]byte("cpu value=1"), &WriteParams{DB: "test", User: "writer", Password: "secret"})
+	if err = bs.Rewrite(); err != nil {
+		t.Errorf("error: %s", err)
+	}
+
+	// the ones of backend are used.
+	cfg.Username = "writer"
+	cfg.Password = "secret"
+	bs.HttpBackend.Close()
+	bs.HttpBackend = NewHttpBackend(cfg)
+	bs.spill([]byte("cpu value=2"), &WriteParams{DB: "test", User: "reader", Password: "wrong"})
+	bs.spill([]byte("cpu value=3"), &WriteParams{DB: "test", RP: "one_week"})
+	for i := 0; i < 2; i++ {
+		if err = bs.Rewrite(); err != nil {
+			t.Errorf("error: %s", err)
+		}
+	}
+	if bs.fb.IsData() {
+		t.Errorf("records left in file")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if strings.Join(writes, ",") != ",one_week" {
+		t.Errorf("rewrites wrong: %v", writes)
+	}
+
+	data, _ := ioutil.ReadFile("queue_rewrite_auth.dat")
+	if bytes.Contains(data, []byte("secret")) || bytes.Contains(data, []byte("wrong")) {
+		t.Errorf("password kept in file")
+	}
+	fi, err := os.Stat("queue_rewrite_auth.dat")
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("file mode wrong: %v %v", fi, err)
+	}
+}
+
+// createStuckBackends has no worker, so its queue is never drained.
+func createStuckBackends(policy string) (bs *Backends, err error) {
+	cfg, _ := CreateTestBackendConfig("test")
+	bs = &Backends{
+		HttpBackend: NewHttpBackend(cfg),
+		QueueFull:   policy,
+		ch_write:    make(chan *writeItem, 2),
+		batches:     make(map[string]*batch),
+	}
+	bs.running.Set(true)
+	bs.fb, err = NewFileBackend("queue_" + policy)
+	return
+}
+
+func TestBackendsQueueFull(t *testing.T) {
+	for _, policy := range []string{QUEUE_SPILL, QUEUE_DROP_OLDEST, QUEUE_REJECT} {
+		bs, err := createStuckBackends(policy)
+		if err != nil {
+			t.Errorf("error: %s", err)
+			return
+		}
+
+		var errs []error
+		for _, line := range []string{"cpu value=1", "cpu value=2", "cpu value=3"} {
+			done := make(chan error, 1)
+			go func(line string) {
+				done <- bs.Write([]byte(line), &WriteParams{DB: "test"})
+			}(line)
+			select {
+			case err = <-done:
+				errs = append(errs, err)
+			case <-time.After(time.Second):
+				t.Errorf("%s: write blocked", policy)
+				return
+			}
+		}
+
+		switch policy {
+		case QUEUE_SPILL:
+			record, _ := bs.fb.Read()
+			params, p, _ := DecodeRecord(record)
+			zr, err := gzip.NewReader(bytes.NewReader(p))
+			if err != nil {
+				t.Errorf("error: %s", err)
+				break
+			}
+			p, _ = ioutil.ReadAll(zr)
+			if errs[2] != nil || bs.Spilled != 1 || params.DB != "test" || string(p) != "cpu value=3" {
+				t.Errorf("not spilled: %v, %d, %q", errs, bs.Spilled, p)
+			}
+		case QUEUE_DROP_OLDEST:
+			item := <-bs.ch_write
+			if errs[2] != nil || bs.Dropped != 1 || string(item.p) != "cpu value=2" {
+				t.Errorf("oldest not dropped: %v, %d, %s", errs, bs.Dropped, item.p)
+			}
+		case QUEUE_REJECT:
+			if errs[2] != ErrQueueFull || bs.Rejected != 1 || len(bs.ch_write) != 2 {
+				t.Errorf("not rejected: %v, %d", errs, bs.Rejected)
+			}
+		}
+		bs.fb.Close()
+		os.Remove("queue_" + policy + ".dat")
+		os.Remove("queue_" + policy + ".rec")
+	}
+}
+
+func TestInfluxdbClusterWriteQueueFull(t *testing.T) {
+	bs, err := createStuckBackends(QUEUE_REJECT)
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	defer os.Remove("queue_reject.rec")
+	defer os.Remove("queue_reject.dat")
+	defer bs.fb.Close()
+
+	ic := NewInfluxCluster(&RedisConfigSource{}, &NodeConfig{})
+	ic.router = NewRouter(map[string][]BackendAPI{"cpu": {bs}}, nil)
+	for i := 0; i < 2; i++ {
+		err = ic.Write([]byte("cpu value=1\n"), &WriteParams{DB: "test"})
+		if err != nil {
+			t.Errorf("error: %s", err)
+		}
+	}
+	err = ic.Write([]byte("cpu value=1\ncpu value=2\ncpu value=3\n"), &WriteParams{DB: "test"})
+	if err != ErrQueueFull {
+		t.Errorf("queue full not told: %v", err)
+	}
+	if len(bs.ch_write) != 2 || bs.Rejected != 3 {
+		t.Errorf("%d writes queued, %d points rejected", len(bs.ch_write), bs.Rejected)
+	}
+}
+
+func TestBackendsFlushTriggers(t *testing.T) {
+	bs, err := createStuckBackends("batch")
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	defer os.Remove("queue_batch.dat")
+	defer os.Remove("queue_batch.rec")
+	defer bs.fb.Close()
+	defer bs.wg.Wait()
+	bs.MaxRowLimit = 10000
+	bs.Interval = time.Hour
+	params := &WriteParams{DB: "test"}
+
+	bs.MaxBatchBytes = 100
+	bs.WriteBuffer([]byte("cpu value=1"), params)
+	if len(bs.batches) != 1 {
+		t.Errorf("small batch flushed")
+	}
+	bs.WriteBuffer(bytes.Repeat([]byte("cpu value=1\n"), 10), params)
+	if len(bs.batches) != 0 {
+		t.Errorf("batch of %d bytes not flushed", 12*11)
+	}
+	bs.MaxBatchBytes = 0
+
+	bs.MaxBatchCompressed = 1000
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		bs.WriteBuffer([]byte(fmt.Sprintf("cpu value=%d", r.Int63())), params)
+		if len(bs.batches) == 0 {
+			break
+		}
+	}
+	if len(bs.batches) != 0 {
+		t.Errorf("compressed batch not flushed")
+	}
+	bs.MaxBatchCompressed = 0
+
+	bs.MaxBatchAge = time.Millisecond
+	bs.WriteBuffer([]byte("cpu value=1"), params)
+	time.Sleep(5 * time.Millisecond)
+	bs.WriteBuffer([]byte("cpu value=2"), params)
+	if len(bs.batches) != 0 {
+		t.Errorf("old batch not flushed")
+	}
+
+	// no more writes, the timer flushes it by age, not by interval.
+	bs.MaxBatchAge = 20 * time.Millisecond
+	bs.WriteBuffer([]byte("cpu value=1"), params)
+	select {
+	case <-bs.ch_timer:
+		bs.Flush()
+	case <-time.After(time.Second):
+		t.Errorf("timer not armed by age")
+	}
+	if len(bs.batches) != 0 {
+		t.Errorf("old batch not flushed by timer")
+	}
+}
+
+func TestBackendsAdaptiveBatch(t *testing.T) {
+	bs := &Backends{
+		MaxRowLimit:   1000,
+		AdaptiveBatch: true,
+		MinRowLimit:   100,
+		SlowWrite:     time.Second,
+		rowLimit:      1000,
+	}
+	bs.adapt(2 * time.Second)
+	if l := bs.RowLimit(); l != 500 {
+		t.Errorf("row limit after slow write: %d", l)
+	}
+	for i := 0; i < 5; i++ {
+		bs.adapt(2 * time.Second)
+	}
+	if l := bs.RowLimit(); l != 100 {
+		t.Errorf("row limit below min: %d", l)
+	}
+	bs.adapt(700 * time.Millisecond)
+	if l := bs.RowLimit(); l != 100 {
+		t.Errorf("row limit changed by normal write: %d", l)
+	}
+	bs.adapt(10 * time.Millisecond)
+	if l := bs.RowLimit(); l != 200 {
+		t.Errorf("row limit after fast write: %d", l)
+	}
+	for i := 0; i < 20; i++ {
+		bs.adapt(10 * time.Millisecond)
+	}
+	if l := bs.RowLimit(); l != 1000 {
+		t.Errorf("row limit above max: %d", l)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	BALANCE_ORDER             = "order"
+	BALANCE_ROUND_ROBIN       = "round-robin"
+	BALANCE_LEAST_OUTSTANDING = "least-outstanding"
+	BALANCE_EWMA              = "ewma"
+	BALANCE_P2C               = "p2c"
+)
+
+const (
+	ewmaAlpha  = 0.3 // weight of the latest latency in ewma
+	maxSamples = 100 // latencies kept for percentiles
+	minSamples = 10  // fewer are not trusted
+)
+
+// ReadStats is the read load of a backend.
+type ReadStats struct {
+	Name        string
+	Reads       int64 // since the last statistics
+	ReadsFail   int64
+	Outstanding int64
+	lock        sync.Mutex
+	latency     float64 // ewma in ns, 0 if never read
+	samples     []time.Duration
+	nsample     int
+}
+
+func (rs *ReadStats) Latency() time.Duration {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	return time.Duration(rs.latency)
+}
+
+// Percentile of the latest latencies, p in (0, 100].
+// ok is false if there are too few of them.
+func (rs *ReadStats) Percentile(p float64) (d time.Duration, ok bool) {
+	rs.lock.Lock()
+	l := append([]time.Duration(nil), rs.samples...)
+	rs.lock.Unlock()
+	if len(l) < minSamples {
+		return 0, false
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	i := int(float64(len(l))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(l) {
+		i = len(l) - 1
+	}
+	return l[i], true
+}
+
+func (rs *ReadStats) observe(d time.Duration) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if len(rs.samples) < maxSamples {
+		rs.samples = append(rs.samples, d)
+	} else {
+		rs.samples[rs.nsample%maxSamples] = d
+	}
+	rs.nsample++
+
+	if rs.latency == 0 {
+		rs.latency = float64(d)
+		return
+	}
+	rs.latency = ewmaAlpha*float64(d) + (1-ewmaAlpha)*rs.latency
+}
+
+// cost of ewma, latency grows with the requests waiting.
+func (rs *ReadStats) cost() float64 {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	return rs.latency * float64(atomic.LoadInt64(&rs.Outstanding)+1)
+}
+
+// Balancer orders replicas in a zone to spread reads on them.
+type Balancer struct {
+	Strategy string
+	lock     sync.Mutex
+	next     uint64
+	stats    map[BackendAPI]*ReadStats
+}
+
+func NewBalancer(strategy string) (b *Balancer) {
+	return &Balancer{
+		Strategy: strategy,
+		stats:    make(map[BackendAPI]*ReadStats),
+	}
+}
+
+// SetBackends names stats of backends, drops the ones of backends gone.
+func (b *Balancer) SetBackends(backends map[string]BackendAPI) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	stats := make(map[BackendAPI]*ReadStats, len(backends))
+	for name, api := range backends {
+		rs, ok := b.stats[api]
+		if !ok {
+			rs = &ReadStats{}
+		}
+		rs.Name = name
+		stats[api] = rs
+	}
+	b.stats = stats
+}
+
+// Stats of api, created if not seen.
+func (b *Balancer) Stats(api BackendAPI) (rs *ReadStats) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	rs, ok := b.stats[api]
+	if !ok {
+		rs = &ReadStats{}
+		b.stats[api] = rs
+	}
+	return
+}
+
+// AllStats returns stats of the named backends.
+func (b *Balancer) AllStats() (l []*ReadStats) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, rs := range b.stats {
+		if rs.Name != "" {
+			l = append(l, rs)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+	return
+}
+
+// Order sorts apis in place, the first is tried first.
+func (b *Balancer) Order(apis []BackendAPI) {
+	if len(apis) < 2 {
+		return
+	}
+	switch b.Strategy {
+	case BALANCE_ROUND_ROBIN:
+		n := int(atomic.AddUint64(&b.next, 1) % uint64(len(apis)))
+		rotated := append(append([]BackendAPI(nil), apis[n:]...), apis[:n]...)
+		copy(apis, rotated)
+	case BALANCE_LEAST_OUTSTANDING:
+		outstanding := make(map[BackendAPI]int64, len(apis))
+		for _, api := range apis {
+			outstanding[api] = atomic.LoadInt64(&b.Stats(api).Outstanding)
+		}
+		sort.SliceStable(apis, func(i, j int) bool { return outstanding[apis[i]] < outstanding[apis[j]] })
+	case BALANCE_EWMA:
+		costs := make(map[BackendAPI]float64, len(apis))
+		for _, api := range apis {
+			costs[api] = b.Stats(api).cost()
+		}
+		sort.SliceStable(apis, func(i, j int) bool { return costs[apis[i]] < costs[apis[j]] })
+	case BALANCE_P2C:
+		// the less loaded of two random ones goes first.
+		i := rand.Intn(len(apis))
+		j := rand.Intn(len(apis) - 1)
+		if j >= i {
+			j++
+		}
+		if atomic.LoadInt64(&b.Stats(apis[j]).Outstanding) < atomic.LoadInt64(&b.Stats(apis[i]).Outstanding) {
+			i = j
+		}
+		apis[0], apis[i] = apis[i], apis[0]
+	}
+}
+
+// Begin counts a read of api, done must be called when it ends.
+// A read canceled with ErrQueryCanceled is neither a fail nor a latency.
+func (b *Balancer) Begin(api BackendAPI) (done func(err error)) {
+	rs := b.Stats(api)
+	atomic.AddInt64(&rs.Reads, 1)
+	atomic.AddInt64(&rs.Outstanding, 1)
+	start := time.Now()
+	return func(err error) {
+		atomic.AddInt64(&rs.Outstanding, -1)
+		if err == ErrQueryCanceled {
+			return
+		}
+		if err != nil {
+			atomic.AddInt64(&rs.ReadsFail, 1)
+			return
+		}
+		rs.observe(time.Since(start))
+	}
+}
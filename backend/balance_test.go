@@ -0,0 +1,128 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+type dummyBackend struct {
+	name string
+}
+
+func (db *dummyBackend) Query(w http.ResponseWriter, req *http.Request) (err error) { return }
+func (db *dummyBackend) IsActive() bool                                             { return true }
+func (db *dummyBackend) IsWriteOnly() bool                                          { return false }
+func (db *dummyBackend) Ping() (version string, err error)                          { return }
+func (db *dummyBackend) GetZone() string                                            { return "" }
+func (db *dummyBackend) Write(p []byte, params *WriteParams) (err error)            { return }
+func (db *dummyBackend) Close() (err error)                                         { return }
+
+func createTestBalancer(strategy string) (b *Balancer, apis []BackendAPI) {
+	b = NewBalancer(strategy)
+	backends := make(map[string]BackendAPI)
+	for _, name := range []string{"a", "b", "c"} {
+		api := &dummyBackend{name: name}
+		backends[name] = api
+		apis = append(apis, api)
+	}
+	b.SetBackends(backends)
+	return
+}
+
+func firstOf(b *Balancer, apis []BackendAPI) string {
+	l := append([]BackendAPI(nil), apis...)
+	b.Order(l)
+	return l[0].(*dummyBackend).name
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b, apis := createTestBalancer(BALANCE_ROUND_ROBIN)
+	counts := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		counts[firstOf(b, apis)]++
+	}
+	if counts["a"] != 100 || counts["b"] != 100 || counts["c"] != 100 {
+		t.Errorf("reads not even: %v", counts)
+	}
+}
+
+func TestBalancerLeastOutstanding(t *testing.T) {
+	b, apis := createTestBalancer(BALANCE_LEAST_OUTSTANDING)
+	b.Begin(apis[0])
+	b.Begin(apis[0])
+	done := b.Begin(apis[2])
+
+	l := append([]BackendAPI(nil), apis...)
+	b.Order(l)
+	if l[0] != apis[1] || l[1] != apis[2] || l[2] != apis[0] {
+		t.Errorf("wrong order: %v", l)
+	}
+	done(nil)
+	if first := firstOf(b, apis); first != "b" {
+		t.Errorf("%s first", first)
+	}
+}
+
+func TestBalancerEWMA(t *testing.T) {
+	b, apis := createTestBalancer(BALANCE_EWMA)
+	b.Stats(apis[0]).observe(100 * time.Millisecond)
+	b.Stats(apis[1]).observe(10 * time.Millisecond)
+	b.Stats(apis[2]).observe(50 * time.Millisecond)
+	if first := firstOf(b, apis); first != "b" {
+		t.Errorf("%s first", first)
+	}
+
+	// b is fast, but busy.
+	for i := 0; i < 10; i++ {
+		b.Begin(apis[1])
+	}
+	if first := firstOf(b, apis); first != "c" {
+		t.Errorf("%s first", first)
+	}
+
+	rs := b.Stats(apis[0])
+	rs.observe(200 * time.Millisecond)
+	if rs.Latency() != 130*time.Millisecond {
+		t.Errorf("ewma wrong: %s", rs.Latency())
+	}
+}
+
+func TestBalancerP2C(t *testing.T) {
+	b, apis := createTestBalancer(BALANCE_P2C)
+	for i := 0; i < 10; i++ {
+		b.Begin(apis[0])
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		counts[firstOf(b, apis)]++
+	}
+	if counts["a"] != 0 || counts["b"] == 0 || counts["c"] == 0 {
+		t.Errorf("busy backend chosen: %v", counts)
+	}
+}
+
+func TestBalancerStats(t *testing.T) {
+	b, apis := createTestBalancer(BALANCE_ORDER)
+	b.Begin(apis[1])(nil)
+	b.Begin(apis[1])(ErrUnknown)
+	b.Begin(&dummyBackend{name: "d"})(nil)
+
+	if first := firstOf(b, apis); first != "a" {
+		t.Errorf("order changed: %s first", first)
+	}
+	all := b.AllStats()
+	if len(all) != 3 || all[1].Name != "b" || all[1].Reads != 2 || all[1].ReadsFail != 1 || all[1].Outstanding != 0 {
+		t.Errorf("wrong stats: %v", all)
+	}
+
+	b.SetBackends(map[string]BackendAPI{"b": apis[1]})
+	all = b.AllStats()
+	if len(all) != 1 || all[0].Reads != 2 {
+		t.Errorf("wrong stats: %v", all)
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CACHE_HIT    = "HIT"
+	CACHE_MISS   = "MISS"
+	CACHE_BYPASS = "BYPASS"
+)
+
+// headers of backend not replayed from cache.
+var uncachedHeaders = []string{"Date", "Request-Id", "X-Request-Id"}
+
+type cacheEntry struct {
+	key    string
+	rb     *ResponseBuffer
+	size   int64
+	expire time.Time
+}
+
+// QueryCache keeps responses of queries in memory, evicts the least
+// recently used ones if they take more than Size bytes.
+// Results of time ranges touch now live for RecentTTL, others for TTL.
+type QueryCache struct {
+	lock      sync.Mutex
+	Size      int64
+	TTL       time.Duration
+	RecentTTL time.Duration
+	used      int64
+	ll        *list.List // front is the most recently used
+	entries   map[string]*list.Element
+}
+
+func NewQueryCache(nodecfg *NodeConfig) (qc *QueryCache) {
+	return &QueryCache{
+		Size:      nodecfg.CacheSize,
+		TTL:       nodecfg.CacheTTL,
+		RecentTTL: nodecfg.CacheRecentTTL,
+		ll:        list.New(),
+		entries:   make(map[string]*list.Element),
+	}
+}
+
+func (qc *QueryCache) Enabled() bool {
+	return qc.Size > 0 && (qc.TTL > 0 || qc.RecentTTL > 0)
+}
+
+// Bypass tells how request wants the cache. With no-cache, the response
+// is fetched from backend and then cached, with no-store it isn't cached.
+func Bypass(req *http.Request) (nocache bool, nostore bool) {
+	for _, v := range req.Header["Cache-Control"] {
+		for _, d := range strings.Split(v, ",") {
+			switch strings.ToLower(strings.TrimSpace(d)) {
+			case "no-cache":
+				nocache = true
+			case "no-store":
+				nocache, nostore = true, true
+			}
+		}
+	}
+	return
+}
+
+// CacheKey is the normalized q, with the parameters and headers changing
+// the response. ok is false if the response can't be cached or shared.
+func CacheKey(req *http.Request, q string) (key string, ok bool) {
+	if req.FormValue("chunked") != "" {
+		return "", false
+	}
+	stmts, err := ParseQuery(q)
+	if err != nil {
+		return "", false
+	}
+	l := make([]string, len(stmts))
+	for i, stmt := range stmts {
+		l[i] = stmt.String()
+	}
+
+	gzip := ""
+	if strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+		gzip = "gzip"
+	}
+	// backends may check credentials of client, don't share results of them.
+	cred := ""
+	if user, password, token := Credentials(req); user != "" || password != "" || token != "" {
+		cred = HashToken(user + "\x00" + password + "\x00" + token)
+	}
+	key = strings.Join([]string{
+		cred,
+		req.FormValue("db"),
+		req.FormValue("rp"),
+		req.FormValue("epoch"),
+		req.FormValue("pretty"),
+		req.Header.Get("Accept"),
+		gzip,
+		strings.Join(l, "; "),
+	}, "\n")
+	return key, true
+}
+
+// TTLOf is how long result of q lives. It's RecentTTL if any statement
+// reads a range ends later than TTL ago, since points still come in then.
+// ok is false if q isn't understood.
+func (qc *QueryCache) TTLOf(q string, now time.Time) (ttl time.Duration, ok bool) {
+	stmts, err := ParseQuery(q)
+	if err != nil {
+		return 0, false
+	}
+	for _, stmt := range stmts {
+		s, isSelect := stmt.(*SelectStatement)
+		if !isSelect {
+			// metas change any time.
+			return qc.RecentTTL, true
+		}
+		_, max, err := statementTimeRange(s, now)
+		if err != nil {
+			return 0, false
+		}
+		if max.IsZero() || max.After(now.Add(-qc.TTL)) {
+			return qc.RecentTTL, true
+		}
+	}
+	return qc.TTL, true
+}
+
+// Get returns the response of key if it isn't expired.
+func (qc *QueryCache) Get(key string, now time.Time) (rb *ResponseBuffer, ok bool) {
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+
+	elem, ok := qc.entries[key]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !now.Before(entry.expire) {
+		qc.remove(elem)
+		return nil, false
+	}
+	qc.ll.MoveToFront(elem)
+	return entry.rb, true
+}
+
+// Set keeps a copy of rb for ttl, returns the number of entries evicted for it.
+func (qc *QueryCache) Set(key string, rb *ResponseBuffer, ttl time.Duration, now time.Time) (evicted int) {
+	if ttl <= 0 {
+		return
+	}
+	// rb may be shared by coalesced queries, keep a copy.
+	c := NewResponseBuffer()
+	copyHeader(c.Header(), rb.Header())
+	for _, h := range uncachedHeaders {
+		c.Header().Del(h)
+	}
+	c.Status = rb.Status
+	c.Body.Write(rb.Body.Bytes())
+	rb = c
+
+	size := int64(len(key) + rb.Body.Len())
+	for k, vv := range rb.Header() {
+		size += int64(len(k))
+		for _, v := range vv {
+			size += int64(len(v))
+		}
+	}
+	if size > qc.Size {
+		return
+	}
+
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+
+	if elem, ok := qc.entries[key]; ok {
+		qc.remove(elem)
+	}
+	for qc.used+size > qc.Size {
+		qc.remove(qc.ll.Back())
+		evicted++
+	}
+	qc.entries[key] = qc.ll.PushFront(&cacheEntry{
+		key:    key,
+		rb:     rb,
+		size:   size,
+		expire: now.Add(ttl),
+	})
+	qc.used += size
+	return
+}
+
+func (qc *QueryCache) remove(elem *list.Element) {
+	entry := qc.ll.Remove(elem).(*cacheEntry)
+	delete(qc.entries, entry.key)
+	qc.used -= entry.size
+}
+
+func (qc *QueryCache) Purge() {
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+	qc.ll.Init()
+	qc.entries = make(map[string]*list.Element)
+	qc.used = 0
+}
+
+// Len is the number of entries, expired ones included.
+func (qc *QueryCache) Len() int {
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+	return qc.ll.Len()
+}
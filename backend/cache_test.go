@@ -0,0 +1,145 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueryCacheTTL(t *testing.T) {
+	now := time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC)
+	qc := &QueryCache{Size: 1024, TTL: 10 * time.Minute, RecentTTL: 10 * time.Second}
+
+	tests := []struct {
+		q   string
+		ttl time.Duration
+	}{
+		{"SELECT v FROM cpu WHERE time > now() - 1h", 10 * time.Second},
+		{"SELECT v FROM cpu WHERE time > now() - 2h AND time < now() - 1h", 10 * time.Minute},
+		{"SELECT v FROM cpu WHERE time > now() - 2h AND time < now() - 1m", 10 * time.Second},
+		{"SELECT v FROM cpu WHERE time >= '2016-01-01' AND time < '2016-01-02'", 10 * time.Minute},
+		{"SELECT v FROM cpu WHERE time < '2016-01-02'; SELECT v FROM mem", 10 * time.Second},
+		{"SHOW TAG KEYS FROM cpu", 10 * time.Second},
+	}
+	for _, tt := range tests {
+		ttl, ok := qc.TTLOf(tt.q, now)
+		if !ok || ttl != tt.ttl {
+			t.Errorf("%s: %s, %v", tt.q, ttl, ok)
+		}
+	}
+}
+
+func TestQueryCache(t *testing.T) {
+	now := time.Now()
+	qc := NewQueryCache(&NodeConfig{CacheSize: 25, CacheTTL: time.Minute})
+
+	set := func(key string, body string, ttl time.Duration) int {
+		rb := NewResponseBuffer()
+		rb.Header().Set("Date", "today")
+		rb.Write([]byte(body))
+		return qc.Set(key, rb, ttl, now)
+	}
+	set("a", "123456789", time.Minute)
+	set("b", "123456789", time.Second)
+	if _, ok := qc.Get("a", now); !ok {
+		t.Errorf("a not cached")
+	}
+	if evicted := set("c", "123456789", time.Minute); evicted != 1 {
+		t.Errorf("%d evicted", evicted)
+	}
+	if _, ok := qc.Get("b", now); ok {
+		t.Errorf("least recently used not evicted")
+	}
+	rb, ok := qc.Get("a", now)
+	if !ok || rb.Body.String() != "123456789" || rb.Header().Get("Date") != "" {
+		t.Errorf("wrong response cached: %v", rb)
+	}
+	if _, ok := qc.Get("a", now.Add(time.Minute)); ok {
+		t.Errorf("expired response returned")
+	}
+	if set("d", "too large to cache, too large to cache", time.Minute); qc.Len() != 1 {
+		t.Errorf("%d entries", qc.Len())
+	}
+}
+
+func TestBypass(t *testing.T) {
+	tests := []struct {
+		header  string
+		nocache bool
+		nostore bool
+	}{
+		{"", false, false},
+		{"max-age=0, no-cache", true, false},
+		{"No-Store", true, true},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "/query", nil)
+		req.Header.Set("Cache-Control", tt.header)
+		nocache, nostore := Bypass(req)
+		if nocache != tt.nocache || nostore != tt.nostore {
+			t.Errorf("%s: %v, %v", tt.header, nocache, nostore)
+		}
+	}
+}
+
+func TestInfluxdbClusterQueryCache(t *testing.T) {
+	var queries int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/query" {
+			w.WriteHeader(204)
+			return
+		}
+		atomic.AddInt64(&queries, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"results":[{}]}`))
+	}))
+	defer ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	api, err := NewBackends(cfg, "cache")
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	defer os.Remove("cache.dat")
+	defer os.Remove("cache.rec")
+	ic := NewInfluxCluster(&RedisConfigSource{}, &NodeConfig{CacheSize: 1 << 20, CacheTTL: time.Minute, CacheRecentTTL: time.Minute})
+	ic.router = NewRouter(map[string][]BackendAPI{"cpu": {api}}, nil)
+
+	tests := []struct {
+		q       string
+		control string
+		cache   string
+		queries int64
+	}{
+		{"SELECT v FROM cpu WHERE time > now() - 1h", "", CACHE_MISS, 1},
+		{"select  v from cpu where time > now() - 1h", "", CACHE_HIT, 1},
+		{"SELECT v FROM cpu WHERE time > now() - 1h", "no-cache", CACHE_BYPASS, 2},
+		{"SELECT v FROM cpu WHERE time > now() - 2h", "no-store", CACHE_BYPASS, 3},
+		{"SELECT v FROM cpu WHERE time > now() - 2h", "", CACHE_MISS, 4},
+	}
+	for _, tt := range tests {
+		form := url.Values{"db": {"test"}, "q": {tt.q}}
+		req, _ := http.NewRequest("GET", "/query?"+form.Encode(), nil)
+		req.Header.Set("Cache-Control", tt.control)
+		w := NewDummyResponseWriter()
+		err = ic.Query(w, req)
+		if err != nil {
+			t.Errorf("error: %s", err)
+			continue
+		}
+		if w.status != 200 || w.header.Get("X-Cache") != tt.cache || atomic.LoadInt64(&queries) != tt.queries {
+			t.Errorf("%s: %d, %s, %d queries", tt.q, w.status, w.header.Get("X-Cache"), queries)
+		}
+	}
+}
@@ -6,12 +6,16 @@ package backend
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -25,8 +29,64 @@ var (
 	ErrClosed          = errors.New("write in a closed file")
 	ErrBackendNotExist = errors.New("use a backend not exists")
 	ErrQueryForbidden  = errors.New("query forbidden")
+	ErrIllegalPoint    = errors.New("illegal point")
 )
 
+// WriteParams are the parameters of a write request.
+// Points with different parameters never go in the same batch.
+type WriteParams struct {
+	DB          string
+	RP          string
+	Precision   string
+	Consistency string
+	User        string
+	Password    string
+	Policy      *Policy // of the user of proxy, nil if auth is not enabled
+	Ack         string  // ack mode of the request, of node if empty
+	Quorum      int     // backends of a line to confirm it, of node if 0
+	wal         *walEntry
+}
+
+// Key is the same for parameters which can share a batch.
+func (wp *WriteParams) Key() string {
+	return strings.Join([]string{wp.DB, wp.RP, wp.Precision, wp.Consistency, wp.User, wp.Password}, "\n")
+}
+
+// Values are the parameters of the request, except credentials.
+// db is the one of client, backends map it to their own.
+func (wp *WriteParams) Values() (q url.Values) {
+	q = url.Values{}
+	if wp.DB != "" {
+		q.Set("db", wp.DB)
+	}
+	if wp.RP != "" {
+		q.Set("rp", wp.RP)
+	}
+	if wp.Precision != "" {
+		q.Set("precision", wp.Precision)
+	}
+	if wp.Consistency != "" {
+		q.Set("consistency", wp.Consistency)
+	}
+	return
+}
+
+func ParseWriteParams(s string) (wp *WriteParams, err error) {
+	q, err := url.ParseQuery(s)
+	if err != nil {
+		return
+	}
+	wp = &WriteParams{
+		DB:          q.Get("db"),
+		RP:          q.Get("rp"),
+		Precision:   q.Get("precision"),
+		Consistency: q.Get("consistency"),
+		User:        q.Get("u"),
+		Password:    q.Get("p"),
+	}
+	return
+}
+
 func ScanKey(pointbuf []byte) (key string, err error) {
 	var keybuf [100]byte
 	keyslice := keybuf[0:0]
@@ -47,6 +107,44 @@ func ScanKey(pointbuf []byte) (key string, err error) {
 	return "", io.EOF
 }
 
+// ScanTags returns the measurement and the tags of a point, unescaped.
+func ScanTags(pointbuf []byte) (key string, tags map[string]string, err error) {
+	var buf []byte
+	var tagkey string
+	iskey := true
+	buflen := len(pointbuf)
+	for i := 0; i < buflen; i++ {
+		c := pointbuf[i]
+		switch {
+		case c == '\\' && i+1 < buflen:
+			i++
+			buf = append(buf, pointbuf[i])
+		case c == ' ' || c == ',':
+			switch {
+			case tags == nil:
+				key = string(buf)
+				tags = make(map[string]string)
+			case iskey:
+				return "", nil, ErrIllegalPoint
+			default:
+				tags[tagkey] = string(buf)
+			}
+			if c == ' ' {
+				return
+			}
+			buf = buf[:0]
+			iskey = true
+		case c == '=' && tags != nil && iskey:
+			tagkey = string(buf)
+			buf = buf[:0]
+			iskey = false
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return "", nil, io.EOF
+}
+
 // faster then bytes.TrimRight, not sure why.
 func TrimRight(p []byte, s []byte) (r []byte) {
 	r = p
@@ -65,20 +163,48 @@ func TrimRight(p []byte, s []byte) (r []byte) {
 type InfluxCluster struct {
 	lock           sync.RWMutex
 	Zone           string
-	nexts          string
+	nexts          []string
 	query_executor Querier
-	ForbiddenQuery []*regexp.Regexp
-	ObligatedQuery []*regexp.Regexp
+	ForbiddenQuery []*QueryFilter
+	ObligatedQuery []*QueryFilter
+	extraForbidden []*QueryFilter // by ForbidQuery, kept on reload
+	extraObligated []*QueryFilter // by EnsureQuery, kept on reload
+	guard          *Guard
+	cache          *QueryCache
+	coalesce       bool // identical queries at the same time share a response
+	flightTimeout  time.Duration
+	flights        *QueryGroup
+	balancer       *Balancer
+	hedger         *Hedger
 	cfgsrc         *RedisConfigSource
 	bas            []BackendAPI
 	backends       map[string]BackendAPI
-	m2bs           map[string][]BackendAPI // measurements to backends
+	router         *Router // measurements to backends
 	stats          *Statistics
 	counter        *Statistics
 	ticker         *time.Ticker
 	defaultTags    map[string]string
-	WriteTracing   int
-	QueryTracing   int
+	WriteTracing   bool
+	QueryTracing   bool
+	ValidateLines  bool
+	AuthEnabled    bool
+	auth           *Authenticator
+	limiter        *Limiter
+	writeAck       string
+	writeQuorum    int
+	ackTimeout     time.Duration
+	wal            *WAL
+	walDir         string
+	walSegmentSize int64
+
+	// points of measurements no route matches.
+	unknownPolicy  string
+	assigner       *Assigner
+	assignPersist  bool
+	assigned       map[string][]string // measurements assigned by this node
+	assignedRoutes map[string]*Route
+	loads          map[string]int // measurements mapped to every backend
+	holding        *HoldingCache
 }
 
 type Statistics struct {
@@ -92,6 +218,22 @@ type Statistics struct {
 	PointsWrittenFail    int64
 	WriteRequestDuration int64
 	QueryRequestDuration int64
+	PointsHeld           int64
+	PointsHeldDropped    int64
+	MeasurementsAssigned int64
+	PointsInvalid        int64
+	PointsDenied         int64
+	QueryCacheHits       int64
+	QueryCacheMisses     int64
+	QueryCacheEvicted    int64
+	QueryCoalesced       int64
+	QueryHedges          int64
+	QueryHedgeWins       int64
+	WritesLimited        int64
+	QueriesLimited       int64
+	WriteAcksFail        int64
+	WALAppendsFail       int64
+	PointsReplayed       int64
 }
 
 func NewInfluxCluster(cfgsrc *RedisConfigSource, nodecfg *NodeConfig) (ic *InfluxCluster) {
@@ -101,12 +243,34 @@ func NewInfluxCluster(cfgsrc *RedisConfigSource, nodecfg *NodeConfig) (ic *Influ
 		query_executor: &InfluxQLExecutor{},
 		cfgsrc:         cfgsrc,
 		bas:            make([]BackendAPI, 0),
+		router:         NewRouter(nil, nil),
 		stats:          &Statistics{},
 		counter:        &Statistics{},
 		ticker:         time.NewTicker(10 * time.Second),
 		defaultTags:    map[string]string{"addr": nodecfg.ListenAddr},
 		WriteTracing:   nodecfg.WriteTracing,
 		QueryTracing:   nodecfg.QueryTracing,
+		ValidateLines:  nodecfg.ValidateLines,
+		AuthEnabled:    nodecfg.AuthEnabled,
+		guard:          NewGuard(nodecfg),
+		cache:          NewQueryCache(nodecfg),
+		coalesce:       nodecfg.CoalesceQueries,
+		flightTimeout:  nodecfg.CoalesceTimeout,
+		flights:        NewQueryGroup(),
+		balancer:       NewBalancer(nodecfg.ReadBalance),
+		hedger:         NewHedger(nodecfg),
+		writeAck:       nodecfg.WriteAck,
+		walDir:         nodecfg.WALDir,
+		walSegmentSize: nodecfg.WALSegmentSize,
+		writeQuorum:    nodecfg.WriteQuorum,
+		ackTimeout:     nodecfg.WriteAckTimeout,
+		unknownPolicy:  nodecfg.UnknownPolicy,
+		assigner:       NewAssigner(nodecfg.AssignStrategy, nodecfg.AssignGroups),
+		assignPersist:  nodecfg.AssignPersist,
+		assigned:       make(map[string][]string),
+		assignedRoutes: make(map[string]*Route),
+		loads:          make(map[string]int),
+		holding:        NewHoldingCache(nodecfg.HoldLimit),
 	}
 	host, err := os.Hostname()
 	if err != nil {
@@ -114,19 +278,10 @@ func NewInfluxCluster(cfgsrc *RedisConfigSource, nodecfg *NodeConfig) (ic *Influ
 	}
 	ic.defaultTags["host"] = host
 	if nodecfg.Interval > 0 {
-		ic.ticker = time.NewTicker(time.Second * time.Duration(nodecfg.Interval))
+		ic.ticker = time.NewTicker(nodecfg.Interval)
 	}
 
-	err = ic.ForbidQuery(ForbidCmds)
-	if err != nil {
-		panic(err)
-		return
-	}
-	err = ic.EnsureQuery(SupportCmds)
-	if err != nil {
-		panic(err)
-		return
-	}
+	ic.ForbiddenQuery, ic.ObligatedQuery = DefaultQueryFilters()
 
 	// feature
 	go ic.statistics()
@@ -158,6 +313,22 @@ func (ic *InfluxCluster) Flush() {
 	ic.counter.PointsWrittenFail = 0
 	ic.counter.WriteRequestDuration = 0
 	ic.counter.QueryRequestDuration = 0
+	ic.counter.PointsHeld = 0
+	ic.counter.PointsHeldDropped = 0
+	ic.counter.MeasurementsAssigned = 0
+	ic.counter.PointsInvalid = 0
+	ic.counter.PointsDenied = 0
+	ic.counter.QueryCacheHits = 0
+	ic.counter.QueryCacheMisses = 0
+	ic.counter.QueryCacheEvicted = 0
+	ic.counter.QueryCoalesced = 0
+	ic.counter.QueryHedges = 0
+	ic.counter.QueryHedgeWins = 0
+	ic.counter.WritesLimited = 0
+	ic.counter.QueriesLimited = 0
+	ic.counter.WriteAcksFail = 0
+	ic.counter.WALAppendsFail = 0
+	ic.counter.PointsReplayed = 0
 }
 
 func (ic *InfluxCluster) WriteStatistics() (err error) {
@@ -175,6 +346,22 @@ func (ic *InfluxCluster) WriteStatistics() (err error) {
 			"statPointsWrittenFail":    ic.counter.PointsWrittenFail,
 			"statQueryRequestDuration": ic.counter.QueryRequestDuration,
 			"statWriteRequestDuration": ic.counter.WriteRequestDuration,
+			"statPointsHeld":           ic.counter.PointsHeld,
+			"statPointsHeldDropped":    ic.counter.PointsHeldDropped,
+			"statMeasurementsAssigned": ic.counter.MeasurementsAssigned,
+			"statPointsInvalid":        ic.counter.PointsInvalid,
+			"statPointsDenied":         ic.counter.PointsDenied,
+			"statQueryCacheHits":       ic.counter.QueryCacheHits,
+			"statQueryCacheMisses":     ic.counter.QueryCacheMisses,
+			"statQueryCacheEvicted":    ic.counter.QueryCacheEvicted,
+			"statQueryCoalesced":       ic.counter.QueryCoalesced,
+			"statQueryHedges":          ic.counter.QueryHedges,
+			"statQueryHedgeWins":       ic.counter.QueryHedgeWins,
+			"statWritesLimited":        ic.counter.WritesLimited,
+			"statQueriesLimited":       ic.counter.QueriesLimited,
+			"statWriteAcksFail":        ic.counter.WriteAcksFail,
+			"statWALAppendsFail":       ic.counter.WALAppendsFail,
+			"statPointsReplayed":       ic.counter.PointsReplayed,
 		},
 		Time: time.Now(),
 	}
@@ -182,30 +369,111 @@ func (ic *InfluxCluster) WriteStatistics() (err error) {
 	if err != nil {
 		return
 	}
-	return ic.Write([]byte(line + "\n"))
+	lines := line + "\n"
+
+	ic.lock.RLock()
+	backends := ic.backends
+	ic.lock.RUnlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		api := backends[name]
+		rs := ic.balancer.Stats(api)
+		tags := map[string]string{"backend": name}
+		for k, v := range ic.defaultTags {
+			tags[k] = v
+		}
+		fields := map[string]interface{}{
+			"statReads":       atomic.SwapInt64(&rs.Reads, 0),
+			"statReadsFail":   atomic.SwapInt64(&rs.ReadsFail, 0),
+			"statOutstanding": atomic.LoadInt64(&rs.Outstanding),
+			"statReadLatency": int64(rs.Latency()),
+		}
+		if bs, ok := api.(*Backends); ok {
+			fields["statPointsSpilled"] = atomic.SwapInt64(&bs.Spilled, 0)
+			fields["statPointsDropped"] = atomic.SwapInt64(&bs.Dropped, 0)
+			fields["statPointsRejected"] = atomic.SwapInt64(&bs.Rejected, 0)
+			fields["statQueueLength"] = int64(len(bs.ch_write))
+			fields["statBatchRowLimit"] = int64(bs.RowLimit())
+		}
+		metric = &monitor.Metric{
+			Name:   "influxdb.cluster.backend",
+			Tags:   tags,
+			Fields: fields,
+			Time:   metric.Time,
+		}
+		line, err = metric.ParseToLine()
+		if err != nil {
+			return
+		}
+		lines += line + "\n"
+	}
+	return ic.Write([]byte(lines), &WriteParams{})
 }
 
 func (ic *InfluxCluster) ForbidQuery(s string) (err error) {
-	r, err := regexp.Compile(s)
+	qf, err := NewQueryFilter(s, s, "")
 	if err != nil {
 		return
 	}
 
 	ic.lock.Lock()
 	defer ic.lock.Unlock()
-	ic.ForbiddenQuery = append(ic.ForbiddenQuery, r)
+	ic.ForbiddenQuery = append(ic.ForbiddenQuery, qf)
+	ic.extraForbidden = append(ic.extraForbidden, qf)
 	return
 }
 
 func (ic *InfluxCluster) EnsureQuery(s string) (err error) {
-	r, err := regexp.Compile(s)
+	qf, err := NewQueryFilter(s, s, "")
 	if err != nil {
 		return
 	}
 
 	ic.lock.Lock()
 	defer ic.lock.Unlock()
-	ic.ObligatedQuery = append(ic.ObligatedQuery, r)
+	ic.ObligatedQuery = append(ic.ObligatedQuery, qf)
+	ic.extraObligated = append(ic.extraObligated, qf)
+	return
+}
+
+// setQueryFilters installs the filters loaded, with the ones added by
+// ForbidQuery and EnsureQuery. Must hold the lock.
+func (ic *InfluxCluster) setQueryFilters(forbidden []*QueryFilter, obligated []*QueryFilter) {
+	ic.ForbiddenQuery = append(forbidden, ic.extraForbidden...)
+	ic.ObligatedQuery = append(obligated, ic.extraObligated...)
+}
+
+func (ic *InfluxCluster) loadQueryFilters() (forbidden []*QueryFilter, obligated []*QueryFilter, err error) {
+	cfgs, err := ic.cfgsrc.LoadQueryFilters()
+	if err != nil {
+		return
+	}
+	if len(cfgs) == 0 {
+		forbidden, obligated = DefaultQueryFilters()
+		return
+	}
+
+	var qf *QueryFilter
+	for name, cfg := range cfgs {
+		qf, err = NewQueryFilter(name, cfg.Pattern, cfg.Reason)
+		if err != nil {
+			log.Printf("query filter %s: %s", name, err)
+			return
+		}
+		if cfg.Type == FILTER_REQUIRE {
+			obligated = append(obligated, qf)
+		} else {
+			forbidden = append(forbidden, qf)
+		}
+	}
+	// same query gets the same reason.
+	sort.Slice(forbidden, func(i, j int) bool { return forbidden[i].Name < forbidden[j].Name })
+	sort.Slice(obligated, func(i, j int) bool { return obligated[i].Name < obligated[j].Name })
 	return
 }
 
@@ -225,39 +493,62 @@ func (ic *InfluxCluster) loadBackends() (backends map[string]BackendAPI, bas []B
 	}
 
 	for name, cfg := range bkcfgs {
-		backends[name], err = NewBackends(cfg, name)
+		var bs *Backends
+		bs, err = NewBackends(cfg, name)
 		if err != nil {
 			log.Printf("create backend error: %s", err)
 			return
 		}
+		backends[name] = bs
 	}
 
-	if ic.nexts != "" {
-		for _, nextname := range strings.Split(ic.nexts, ",") {
-			ba, ok := backends[nextname]
-			if !ok {
-				err = ErrBackendNotExist
-				log.Println(nextname, err)
-				continue
-			}
-			bas = append(bas, ba)
+	for _, nextname := range ic.nexts {
+		ba, ok := backends[nextname]
+		if !ok {
+			err = ErrBackendNotExist
+			log.Println(nextname, err)
+			continue
 		}
+		bas = append(bas, ba)
 	}
 
 	return
 }
 
-func (ic *InfluxCluster) loadMeasurements(backends map[string]BackendAPI) (m2bs map[string][]BackendAPI, err error) {
-	m2bs = make(map[string][]BackendAPI)
+func (ic *InfluxCluster) loadMeasurements(backends map[string]BackendAPI) (m2bs map[string][]BackendAPI, db2m2bs map[string]map[string][]BackendAPI, loads map[string]int, err error) {
+	loads = make(map[string]int)
 
 	m_map, err := ic.cfgsrc.LoadMeasurements()
 	if err != nil {
 		return
 	}
+	m2bs, err = mapBackends(m_map, backends, loads)
+	if err != nil {
+		return
+	}
 
+	d_map, err := ic.cfgsrc.LoadDatabaseMeasurements()
+	if err != nil {
+		return
+	}
+	db2m2bs = make(map[string]map[string][]BackendAPI, len(d_map))
+	for db, m_map := range d_map {
+		db2m2bs[db], err = mapBackends(m_map, backends, loads)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// mapBackends finds backends of measurements by names, and counts
+// measurements mapped to every backend in loads.
+func mapBackends(m_map map[string][]string, backends map[string]BackendAPI, loads map[string]int) (m2bs map[string][]BackendAPI, err error) {
+	m2bs = make(map[string][]BackendAPI)
 	for name, bs_names := range m_map {
 		var bss []BackendAPI
 		for _, bs_name := range bs_names {
+			loads[bs_name]++
 			bs, ok := backends[bs_name]
 			if !ok {
 				err = ErrBackendNotExist
@@ -271,13 +562,69 @@ func (ic *InfluxCluster) loadMeasurements(backends map[string]BackendAPI) (m2bs
 	return
 }
 
+func (ic *InfluxCluster) loadRules(backends map[string]BackendAPI) (rules RuleList, err error) {
+	cfgs, err := ic.cfgsrc.LoadRules()
+	if err != nil {
+		return
+	}
+
+	var rule *Rule
+	for name, cfg := range cfgs {
+		rule, err = NewRule(name, cfg, backends)
+		if err != nil {
+			return
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
+
 func (ic *InfluxCluster) LoadConfig() (err error) {
 	backends, bas, err := ic.loadBackends()
+	// backends of a config not loaded are closed, or their workers and files leak.
+	loaded := false
+	defer func() {
+		if !loaded {
+			closeBackends(backends)
+		}
+	}()
 	if err != nil {
 		return
 	}
 
-	m2bs, err := ic.loadMeasurements(backends)
+	m2bs, db2m2bs, loads, err := ic.loadMeasurements(backends)
+	if err != nil {
+		return
+	}
+
+	rules, err := ic.loadRules(backends)
+	if err != nil {
+		return
+	}
+	router := NewRouter(m2bs, rules)
+	for db, m2bs := range db2m2bs {
+		router.SetDatabase(db, m2bs)
+	}
+
+	users, err := ic.cfgsrc.LoadUsers()
+	if err != nil {
+		return
+	}
+	auth, err := NewAuthenticator(users)
+	if err != nil {
+		return
+	}
+
+	forbidden, obligated, err := ic.loadQueryFilters()
+	if err != nil {
+		return
+	}
+
+	limits, err := ic.cfgsrc.LoadLimits()
+	if err != nil {
+		return
+	}
+	limiter, err := NewLimiter(limits)
 	if err != nil {
 		return
 	}
@@ -286,10 +633,27 @@ func (ic *InfluxCluster) LoadConfig() (err error) {
 	orig_backends := ic.backends
 	ic.backends = backends
 	ic.bas = bas
-	ic.m2bs = m2bs
+	ic.router = router
+	ic.auth = auth
+	ic.limiter = limiter
+	ic.setQueryFilters(forbidden, obligated)
+	ic.loads = loads
+	ic.reassign()
 	ic.lock.Unlock()
+	loaded = true
+	ic.balancer.SetBackends(backends)
 
-	for name, bs := range orig_backends {
+	// routes may be changed, so are results.
+	ic.cache.Purge()
+
+	err = closeBackends(orig_backends)
+
+	ic.ReleaseHeld()
+	return
+}
+
+func closeBackends(backends map[string]BackendAPI) (err error) {
+	for name, bs := range backends {
 		err = bs.Close()
 		if err != nil {
 			log.Printf("fail in close backend %s", name)
@@ -298,6 +662,185 @@ func (ic *InfluxCluster) LoadConfig() (err error) {
 	return
 }
 
+// reassign rebuilds routes of assigned measurements on the new backends.
+// The ones mapped in config now are forgotten. Must hold the lock.
+func (ic *InfluxCluster) reassign() {
+	ic.assignedRoutes = make(map[string]*Route, len(ic.assigned))
+	for key, names := range ic.assigned {
+		_, ok := ic.router.Route(&RouteKey{Measurement: key})
+		if ok {
+			delete(ic.assigned, key)
+			continue
+		}
+
+		bs, err := ic.lookupBackends(names)
+		if err != nil {
+			log.Printf("measurement %s lost its backends: %s", key, err)
+			delete(ic.assigned, key)
+			continue
+		}
+		ic.assignedRoutes[key] = NewRoute(bs)
+		for _, name := range names {
+			ic.loads[name]++
+		}
+	}
+}
+
+// lookupBackends finds backends by names. Must hold the lock.
+func (ic *InfluxCluster) lookupBackends(names []string) (bs []BackendAPI, err error) {
+	for _, name := range names {
+		b, ok := ic.backends[name]
+		if !ok {
+			return nil, ErrBackendNotExist
+		}
+		bs = append(bs, b)
+	}
+	return
+}
+
+// Assign maps a new measurement to a backend group picked by assigner,
+// and saves it to config source, so queries of other nodes find it.
+func (ic *InfluxCluster) Assign(key string) (rt *Route, err error) {
+	ic.lock.RLock()
+	rt, ok := ic.assignedRoutes[key]
+	var names []string
+	if !ok {
+		names, err = ic.assigner.Pick(key, ic.loads)
+	}
+	ic.lock.RUnlock()
+	if ok || err != nil {
+		return
+	}
+
+	// not in the lock, or routing of all writes waits for redis.
+	if ic.assignPersist {
+		names, err = ic.cfgsrc.SaveMeasurement(key, names)
+		if err != nil {
+			return
+		}
+	}
+
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+
+	// another request may assign it just now.
+	rt, ok = ic.assignedRoutes[key]
+	if ok {
+		return
+	}
+
+	bs, err := ic.lookupBackends(names)
+	if err != nil {
+		return
+	}
+	rt = NewRoute(bs)
+	ic.assigned[key] = names
+	ic.assignedRoutes[key] = rt
+	for _, name := range names {
+		ic.loads[name]++
+	}
+
+	log.Printf("measurement %s assigned to %s", key, strings.Join(names, ","))
+	atomic.AddInt64(&ic.stats.MeasurementsAssigned, 1)
+	return
+}
+
+// ReleaseHeld writes the held points which have a route now.
+func (ic *InfluxCluster) ReleaseHeld() {
+	router := ic.GetRouter()
+	points := ic.holding.Release(func(rk *RouteKey) bool {
+		_, ok := ic.route(router, rk)
+		return ok
+	})
+	if len(points) == 0 {
+		return
+	}
+
+	for _, hp := range points {
+		ic.writeRow(hp.line, hp.params)
+		hp.params.wal.done()
+	}
+	log.Printf("%d held points released.", len(points))
+}
+
+// OpenWAL opens wal in WALDir of node, and writes records left in it by
+// the last run. It must be called after config is loaded, and before writes.
+// Writes are not kept in wal if WALDir is empty.
+func (ic *InfluxCluster) OpenWAL() (err error) {
+	if ic.walDir == "" {
+		return
+	}
+	ic.wal, err = OpenWAL(ic.walDir, ic.walSegmentSize)
+	if err != nil {
+		ic.wal = nil
+		return
+	}
+	err = ic.wal.Replay(func(p []byte, params *WriteParams) {
+		// queued is enough, they are in wal again.
+		params.Ack = ACK_ENQUEUE
+		atomic.AddInt64(&ic.stats.PointsReplayed, CountLines(p))
+		err := ic.Write(p, params)
+		if err != nil {
+			log.Printf("replay wal error: %s\n", err)
+		}
+	})
+	return
+}
+
+// HeldMeasurements counts points held of every unknown measurement.
+func (ic *InfluxCluster) HeldMeasurements() map[string]int {
+	return ic.holding.Measurements()
+}
+
+// Authenticate returns the policy of the user of request.
+// It's nil if auth is not enabled, everything is allowed.
+func (ic *InfluxCluster) Authenticate(req *http.Request) (policy *Policy, err error) {
+	if !ic.AuthEnabled {
+		return
+	}
+	ic.lock.RLock()
+	auth := ic.auth
+	ic.lock.RUnlock()
+	if auth == nil {
+		return nil, ErrAuthFailed
+	}
+	return auth.Authenticate(req)
+}
+
+func (ic *InfluxCluster) getLimiter() *Limiter {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	return ic.limiter
+}
+
+// LimitWrite checks points and bytes of p written by c with limits,
+// returns *LimitError if any is hit.
+func (ic *InfluxCluster) LimitWrite(c *Client, p []byte) (err error) {
+	limiter := ic.getLimiter()
+	if limiter == nil || !limiter.Enabled() {
+		return
+	}
+	err = limiter.AllowWrite(c, CountLines(p), int64(len(p)), time.Now())
+	if err != nil {
+		atomic.AddInt64(&ic.stats.WritesLimited, 1)
+	}
+	return
+}
+
+// LimitQuery checks a query of c with limits, returns *LimitError if any is
+// hit. Otherwise done must be called when the query ends.
+func (ic *InfluxCluster) LimitQuery(c *Client) (done func(), err error) {
+	limiter := ic.getLimiter()
+	if limiter == nil || !limiter.Enabled() {
+		return func() {}, nil
+	}
+	done, err = limiter.BeginQuery(c, time.Now())
+	if err != nil {
+		atomic.AddInt64(&ic.stats.QueriesLimited, 1)
+	}
+	return
+}
+
 func (ic *InfluxCluster) Ping() (version string, err error) {
 	atomic.AddInt64(&ic.stats.PingRequests, 1)
 	version = VERSION
@@ -310,47 +853,47 @@ func (ic *InfluxCluster) CheckQuery(q string) (err error) {
 
 	if len(ic.ForbiddenQuery) != 0 {
 		for _, fq := range ic.ForbiddenQuery {
-			if fq.MatchString(q) {
-				return ErrQueryForbidden
+			if fq.Match(q) {
+				return &FilterError{Filters: []*QueryFilter{fq}}
 			}
 		}
 	}
 
 	if len(ic.ObligatedQuery) != 0 {
 		for _, pq := range ic.ObligatedQuery {
-			if pq.MatchString(q) {
+			if pq.Match(q) {
 				return
 			}
 		}
-		return ErrQueryForbidden
+		return &FilterError{Filters: ic.ObligatedQuery}
 	}
 
 	return
 }
 
 func (ic *InfluxCluster) GetBackends(key string) (backends []BackendAPI, ok bool) {
-	ic.lock.RLock()
-	defer ic.lock.RUnlock()
-
-	backends, ok = ic.m2bs[key]
-	// match use prefix
-	if !ok {
-		for k, v := range ic.m2bs {
-			if strings.HasPrefix(key, k) {
-				backends = v
-				ok = true
-				break
-			}
-		}
-	}
+	return ic.GetRouter().Match(key)
+}
 
-	if !ok {
-		backends, ok = ic.m2bs["_default_"]
+// route finds rk in router, then in measurements assigned by this node.
+func (ic *InfluxCluster) route(router *Router, rk *RouteKey) (rt *Route, ok bool) {
+	rt, ok = router.Route(rk)
+	if ok {
+		return
 	}
 
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	rt, ok = ic.assignedRoutes[rk.Measurement]
 	return
 }
 
+func (ic *InfluxCluster) GetRouter() (router *Router) {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	return ic.router
+}
+
 func (ic *InfluxCluster) Query(w http.ResponseWriter, req *http.Request) (err error) {
 	atomic.AddInt64(&ic.stats.QueryRequests, 1)
 	defer func(start time.Time) {
@@ -383,12 +926,31 @@ func (ic *InfluxCluster) Query(w http.ResponseWriter, req *http.Request) (err er
 	err = ic.CheckQuery(q)
 	if err != nil {
 		w.WriteHeader(400)
-		w.Write([]byte("query forbidden"))
+		w.Write([]byte(err.Error()))
 		atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
 		return
 	}
 
-	key, err := GetMeasurementFromInfluxQL(q)
+	if ic.guard.Enabled() {
+		q, err = ic.guard.Check(q, time.Now())
+		if err != nil {
+			log.Printf("query error: %s,the query is %s\n", err, req.FormValue("q"))
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
+			return
+		}
+		req.Form.Set("q", q)
+	}
+
+	rk, err := GetRouteKeyFromInfluxQL(q)
+	if err == ErrConflictTags {
+		log.Printf("query error: %s,the query is %s\n", err, q)
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
+		return
+	}
 	if err != nil {
 		log.Printf("can't get measurement: %s\n", q)
 		w.WriteHeader(400)
@@ -396,19 +958,168 @@ func (ic *InfluxCluster) Query(w http.ResponseWriter, req *http.Request) (err er
 		atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
 		return
 	}
+	if rk.DB == "" {
+		rk.DB = req.FormValue("db")
+	}
+	if rk.RP == "" {
+		rk.RP = req.FormValue("rp")
+	}
 
-	apis, ok := ic.GetBackends(key)
+	router := ic.GetRouter()
+	// points are routed by the tag, a query without it can't be.
+	if tag := router.MissingTag(rk); tag != "" {
+		log.Printf("query without tag %s,the query is %s\n", tag, q)
+		w.WriteHeader(400)
+		w.Write([]byte("query needs " + tag + " = 'value' in where clause"))
+		atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
+		return
+	}
+
+	rt, ok := ic.route(router, rk)
 	if !ok {
-		log.Printf("unknown measurement: %s,the query is %s\n", key, q)
+		log.Printf("unknown measurement: %s,the query is %s\n", rk.Measurement, q)
 		w.WriteHeader(400)
 		w.Write([]byte("unknown measurement"))
 		atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
 		return
 	}
 
-	// same zone first, other zone. pass non-active.
-	// TODO: better way?
+	switch {
+	case ic.cache.Enabled():
+		err = ic.queryCached(w, req, q, rt)
+	case ic.coalesce:
+		err = ic.queryCoalesced(w, req, q, rt)
+	default:
+		err = ic.queryRoute(w, req, rt)
+	}
+	if err == nil {
+		return
+	}
+
+	w.WriteHeader(400)
+	w.Write([]byte("query error"))
+	atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
+	return
+}
+
+// queryRoute sends req to the backends of rt.
+func (ic *InfluxCluster) queryRoute(w http.ResponseWriter, req *http.Request, rt *Route) (err error) {
+	if rt.IsSharded() {
+		return ic.QueryShards(w, req, rt)
+	}
+	cands := ic.Candidates(rt.Backends)
+	if ic.hedger.Enabled() && len(cands) > 1 {
+		return ic.queryHedged(w, req, cands)
+	}
+	err = ErrBackendNotExist
+	for _, api := range cands {
+		err = ic.queryBackend(api, w, req)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+// queryCached answers req from cache if it can, or caches the response
+// of backends. X-Cache of response tells which happened.
+func (ic *InfluxCluster) queryCached(w http.ResponseWriter, req *http.Request, q string, rt *Route) (err error) {
+	now := time.Now()
+	key, ok := CacheKey(req, q)
+	var ttl time.Duration
+	if ok {
+		ttl, ok = ic.cache.TTLOf(q, now)
+	}
+	if !ok {
+		w.Header().Set("X-Cache", CACHE_BYPASS)
+		return ic.queryRoute(w, req, rt)
+	}
+
+	nocache, nostore := Bypass(req)
+	if !nocache {
+		if rb, hit := ic.cache.Get(key, now); hit {
+			atomic.AddInt64(&ic.stats.QueryCacheHits, 1)
+			w.Header().Set("X-Cache", CACHE_HIT)
+			rb.WriteTo(w)
+			return
+		}
+	}
+	atomic.AddInt64(&ic.stats.QueryCacheMisses, 1)
+
+	rb, err, shared := ic.fetch(req, key, rt)
+	if err != nil {
+		return
+	}
+	if rb.Status == 200 && !nostore && !shared {
+		evicted := ic.cache.Set(key, rb, ttl, now)
+		atomic.AddInt64(&ic.stats.QueryCacheEvicted, int64(evicted))
+	}
+	if nocache {
+		w.Header().Set("X-Cache", CACHE_BYPASS)
+	} else {
+		w.Header().Set("X-Cache", CACHE_MISS)
+	}
+	rb.WriteTo(w)
+	return
+}
+
+// queryCoalesced lets identical queries at the same time share the response.
+func (ic *InfluxCluster) queryCoalesced(w http.ResponseWriter, req *http.Request, q string, rt *Route) (err error) {
+	key, ok := CacheKey(req, q)
+	if !ok {
+		return ic.queryRoute(w, req, rt)
+	}
+	rb, err, _ := ic.fetch(req, key, rt)
+	if err != nil {
+		return
+	}
+	rb.WriteTo(w)
+	return
+}
 
+// fetch buffers the response of req, joins the same query in flight if
+// coalescing is enabled. shared is true if it's the response of another.
+func (ic *InfluxCluster) fetch(req *http.Request, key string, rt *Route) (rb *ResponseBuffer, err error, shared bool) {
+	if !ic.coalesce {
+		rb = NewResponseBuffer()
+		err = ic.queryRoute(rb, req, rt)
+		return
+	}
+
+	// the query is of all callers, it isn't canceled by the first one,
+	// but by coalescetimeout.
+	detached := CloneQueryRequest(req)
+	fn := func() (rb *ResponseBuffer, err error) {
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if ic.flightTimeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, ic.flightTimeout)
+		}
+		defer cancel()
+		rb = NewResponseBuffer()
+		err = ic.queryRoute(rb, detached.WithContext(ctx), rt)
+		return
+	}
+	rb, err, shared = ic.flights.Do(req.Context(), key, fn)
+	if shared {
+		atomic.AddInt64(&ic.stats.QueryCoalesced, 1)
+	}
+	return
+}
+
+// queryBackend sends req to api, counts it in the read stats of api.
+func (ic *InfluxCluster) queryBackend(api BackendAPI, w http.ResponseWriter, req *http.Request) (err error) {
+	done := ic.balancer.Begin(api)
+	err = api.Query(w, req)
+	if err != nil && req.Context().Err() != nil {
+		err = ErrQueryCanceled
+	}
+	done(err)
+	return
+}
+
+// Candidates orders the backends to query.
+// same zone first, ordered by the balancer, other zone. pass non-active.
+func (ic *InfluxCluster) Candidates(apis []BackendAPI) (cands []BackendAPI) {
 	for _, api := range apis {
 		if api.GetZone() != ic.Zone {
 			continue
@@ -416,11 +1127,9 @@ func (ic *InfluxCluster) Query(w http.ResponseWriter, req *http.Request) (err er
 		if !api.IsActive() || api.IsWriteOnly() {
 			continue
 		}
-		err = api.Query(w, req)
-		if err == nil {
-			return
-		}
+		cands = append(cands, api)
 	}
+	ic.balancer.Order(cands)
 
 	for _, api := range apis {
 		if api.GetZone() == ic.Zone {
@@ -429,21 +1138,151 @@ func (ic *InfluxCluster) Query(w http.ResponseWriter, req *http.Request) (err er
 		if !api.IsActive() {
 			continue
 		}
-		err = api.Query(w, req)
+		cands = append(cands, api)
+	}
+	return
+}
+
+// queryShard tries the replicas of a shard until one answers.
+func (ic *InfluxCluster) queryShard(req *http.Request, shard []BackendAPI) (rb *ResponseBuffer, err error) {
+	err = ErrShardUnavailable
+	for _, api := range ic.Candidates(shard) {
+		rb = NewResponseBuffer()
+		err = ic.queryBackend(api, rb, CloneQueryRequest(req))
 		if err == nil {
 			return
 		}
 	}
+	return nil, err
+}
 
-	w.WriteHeader(400)
-	w.Write([]byte("query error"))
-	atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
+// QueryShards sends the query to one replica of every shard, and merges
+// the results. Aggregates are computed in partials by shards, and reduced
+// here. Any shard failed will fail the whole query.
+func (ic *InfluxCluster) QueryShards(w http.ResponseWriter, req *http.Request, rt *Route) (err error) {
+	q := strings.TrimSpace(req.FormValue("q"))
+	plan, err := PlanQuery(q)
+	if err != nil {
+		// a wrong answer is worse than none, tell client why.
+		log.Printf("plan query error: %s,the query is %s\n", err, q)
+		p, _ := json.Marshal(map[string]string{"error": err.Error()})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		w.Write(p)
+		return nil
+	}
+
+	// we need plain json to merge.
+	req = CloneQueryRequest(req)
+	req.Form.Set("q", plan.Query)
+	req.Form.Del("chunked")
+	req.Header.Del("Accept")
+	req.Header.Del("Accept-Encoding")
+
+	rbs := make([]*ResponseBuffer, len(rt.Shards))
+	errs := make([]error, len(rt.Shards))
+	var wg sync.WaitGroup
+	for i, shard := range rt.Shards {
+		wg.Add(1)
+		go func(i int, shard []BackendAPI) {
+			defer wg.Done()
+			rbs[i], errs[i] = ic.queryShard(req, shard)
+		}(i, shard)
+	}
+	wg.Wait()
+
+	resps := make([]*Response, 0, len(rbs))
+	for i, rb := range rbs {
+		if errs[i] != nil {
+			log.Printf("query shard %d error: %s,the query is %s\n", i, errs[i], q)
+			return errs[i]
+		}
+		// pass errors of backend to client.
+		if rb.Status != 200 {
+			rb.WriteTo(w)
+			return
+		}
+
+		var resp *Response
+		resp, err = ParseResponse(rb.Body.Bytes())
+		if err != nil {
+			log.Printf("parse response of shard %d error: %s,the query is %s\n", i, err, q)
+			return
+		}
+		resps = append(resps, resp)
+	}
+
+	p, err := json.Marshal(MergeResponses(resps, plan.Merges))
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if version := rbs[0].Header().Get("X-Influxdb-Version"); version != "" {
+		w.Header().Set("X-Influxdb-Version", version)
+	}
+	w.WriteHeader(200)
+	w.Write(p)
 	return
 }
 
+// writeBatch groups lines of a request by backends,
+// so every backend gets them in one write.
+type writeBatch struct {
+	apis  []BackendAPI // in the order seen
+	bufs  map[BackendAPI]*bytes.Buffer
+	lines map[BackendAPI]int64
+	index map[BackendAPI]int
+	sets  map[string][]BackendAPI // backends of lines, only for quorum
+	held  []*heldPoint            // lines of unknown measurements to hold
+}
+
+func newWriteBatch() (wb *writeBatch) {
+	return &writeBatch{
+		bufs:  make(map[BackendAPI]*bytes.Buffer),
+		lines: make(map[BackendAPI]int64),
+		index: make(map[BackendAPI]int),
+	}
+}
+
+func (wb *writeBatch) add(api BackendAPI, line []byte) {
+	buf, ok := wb.bufs[api]
+	if !ok {
+		buf = &bytes.Buffer{}
+		wb.bufs[api] = buf
+		wb.index[api] = len(wb.apis)
+		wb.apis = append(wb.apis, api)
+	}
+	buf.Write(line)
+	buf.WriteByte('\n')
+	wb.lines[api]++
+}
+
+// addSet keeps apis a line is written to, if sets are kept.
+func (wb *writeBatch) addSet(apis []BackendAPI) {
+	if wb.sets == nil {
+		return
+	}
+	key := make([]byte, 0, 4*len(apis))
+	for _, api := range apis {
+		key = strconv.AppendInt(key, int64(wb.index[api]), 10)
+		key = append(key, ',')
+	}
+	if _, ok := wb.sets[string(key)]; !ok {
+		wb.sets[string(key)] = apis
+	}
+}
+
 // Wrong in one row will not stop others.
-// So don't try to return error, just print it.
-func (ic *InfluxCluster) WriteRow(line []byte) {
+// So errors are just printed, except ErrQueueFull of backends rejecting it,
+// and the ones of ack mode.
+func (ic *InfluxCluster) WriteRow(line []byte, params *WriteParams) (err error) {
+	wb := ic.newWriteBatch(params)
+	ic.addRow(line, params, wb)
+	return ic.writeBatch(wb, params)
+}
+
+func (ic *InfluxCluster) addRow(line []byte, params *WriteParams, wb *writeBatch) {
 	atomic.AddInt64(&ic.stats.PointsWritten, 1)
 	// maybe trim?
 	line = bytes.TrimRight(line, " \t\r\n")
@@ -452,35 +1291,132 @@ func (ic *InfluxCluster) WriteRow(line []byte) {
 	if len(line) == 0 {
 		return
 	}
+	ic.routeRow(line, params, wb)
+}
 
-	key, err := ScanKey(line)
+// writeRow writes a held line, it's acknowledged when held.
+func (ic *InfluxCluster) writeRow(line []byte, params *WriteParams) (err error) {
+	wb := newWriteBatch()
+	ic.routeRow(line, params, wb)
+	ic.hold(wb)
+	return ic.enqueueBatch(wb, params)
+}
+
+// hold lines of unknown measurements in wb.
+func (ic *InfluxCluster) hold(wb *writeBatch) {
+	for _, hp := range wb.held {
+		if ic.holding.Hold(hp.rk, hp.line, hp.params) {
+			atomic.AddInt64(&ic.stats.PointsHeldDropped, 1)
+		}
+		atomic.AddInt64(&ic.stats.PointsHeld, 1)
+	}
+}
+
+func (ic *InfluxCluster) newWriteBatch(params *WriteParams) (wb *writeBatch) {
+	wb = newWriteBatch()
+	if mode, _ := ic.ackOf(params); mode == ACK_QUORUM {
+		wb.sets = make(map[string][]BackendAPI)
+	}
+	return
+}
+
+// writeBatch sends every backend its lines, and returns by the ack mode.
+func (ic *InfluxCluster) writeBatch(wb *writeBatch, params *WriteParams) (err error) {
+	ic.hold(wb)
+	mode, quorum := ic.ackOf(params)
+	switch mode {
+	case ACK_DURABLE:
+		err = ic.writeDurable(wb, params)
+	case ACK_QUORUM:
+		err = ic.writeConfirmed(wb, params, quorum)
+	default:
+		return ic.enqueueBatch(wb, params)
+	}
+	if err != nil {
+		atomic.AddInt64(&ic.stats.WriteAcksFail, 1)
+	}
+	return
+}
+
+func (ic *InfluxCluster) enqueueBatch(wb *writeBatch, params *WriteParams) (err error) {
+	// backends don't block, a full queue is handled by their policies.
+	for _, api := range wb.apis {
+		e := ic.enqueue(api, wb.bufs[api].Bytes(), params)
+		if e != nil {
+			log.Printf("cluster write fail: %d lines, %s\n", wb.lines[api], e)
+			atomic.AddInt64(&ic.stats.PointsWrittenFail, wb.lines[api])
+			if e == ErrQueueFull {
+				err = e
+			}
+		}
+	}
+	return
+}
+
+// routeRow finds backends of line, and adds it to their batches.
+func (ic *InfluxCluster) routeRow(line []byte, params *WriteParams, wb *writeBatch) {
+	router := ic.GetRouter()
+	rk := &RouteKey{DB: params.DB, RP: params.RP}
+	var err error
+	if router.NeedTags() {
+		rk.Measurement, rk.Tags, err = ScanTags(line)
+	} else {
+		rk.Measurement, err = ScanKey(line)
+	}
 	if err != nil {
 		log.Printf("scan key error: %s\n", err)
 		atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
 		return
 	}
 
-	bs, ok := ic.GetBackends(key)
+	rt, ok := ic.route(router, rk)
 	if !ok {
-		log.Printf("new measurement: %s\n", key)
-		atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
-		// TODO: new measurement?
-		return
+		rt, ok = ic.routeUnknown(line, rk, params, wb)
+		if !ok {
+			return
+		}
 	}
 
-	// don't block here for a lont time, we just have one worker.
-	for _, b := range bs {
-		err = b.Write(line)
+	bs := rt.Backends
+	if rt.IsSharded() {
+		var serieskey []byte
+		serieskey, err = SeriesKey(line)
 		if err != nil {
-			log.Printf("cluster write fail: %s\n", key)
+			log.Printf("scan series key error: %s\n", err)
 			atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
 			return
 		}
+		bs = rt.GetShard(serieskey)
 	}
-	return
+
+	for _, b := range bs {
+		wb.add(b, line)
+	}
+	wb.addSet(bs)
+}
+
+// routeUnknown applies the unknown policy to a line no route matches.
+func (ic *InfluxCluster) routeUnknown(line []byte, rk *RouteKey, params *WriteParams, wb *writeBatch) (rt *Route, ok bool) {
+	switch ic.unknownPolicy {
+	case UNKNOWN_ASSIGN:
+		var err error
+		rt, err = ic.Assign(rk.Measurement)
+		if err == nil {
+			return rt, true
+		}
+		log.Printf("assign measurement %s error: %s\n", rk.Measurement, err)
+	case UNKNOWN_HOLD:
+		// held when the batch is written.
+		wb.held = append(wb.held, &heldPoint{rk: rk, line: line, params: params})
+		return nil, false
+	default:
+		log.Printf("new measurement: %s\n", rk.Measurement)
+	}
+	atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
+	return nil, false
 }
 
-func (ic *InfluxCluster) Write(p []byte) (err error) {
+func (ic *InfluxCluster) Write(p []byte, params *WriteParams) (err error) {
 	atomic.AddInt64(&ic.stats.WriteRequests, 1)
 	defer func(start time.Time) {
 		atomic.AddInt64(&ic.stats.WriteRequestDuration, time.Since(start).Nanoseconds())
@@ -488,6 +1424,23 @@ func (ic *InfluxCluster) Write(p []byte) (err error) {
 
 	buf := bytes.NewBuffer(p)
 
+	// with validation or policy, only good lines go to backends and nexts.
+	var lv *LineValidator
+	var good bytes.Buffer
+	var bad []string
+	var denied *AuthzError
+	var ndenied int
+	wb := ic.newWriteBatch(params)
+	if ic.ValidateLines {
+		lv = NewLineValidator(params.Precision)
+	}
+	filter := lv != nil || params.Policy != nil
+
+	// the record in wal is kept until backends have all lines of it.
+	entry := ic.wal.Begin()
+	params.wal = entry
+	defer entry.done()
+
 	var line []byte
 	for {
 		line, err = buf.ReadBytes('\n')
@@ -504,22 +1457,114 @@ func (ic *InfluxCluster) Write(p []byte) (err error) {
 			break
 		}
 
-		ic.WriteRow(line)
+		if filter {
+			line = bytes.TrimSpace(line)
+			if len(line) == 0 || line[0] == '#' {
+				continue
+			}
+			err = ic.checkLine(line, lv, params)
+			switch e := err.(type) {
+			case nil:
+			case *AuthzError:
+				atomic.AddInt64(&ic.stats.PointsDenied, 1)
+				denied = e
+				ndenied++
+				bad = append(bad, (&LineError{Line: line, Reason: e.Error()}).Error())
+				err = nil
+				continue
+			default:
+				atomic.AddInt64(&ic.stats.PointsInvalid, 1)
+				bad = append(bad, err.Error())
+				err = nil
+				continue
+			}
+			good.Write(line)
+			good.WriteByte('\n')
+		}
+
+		ic.addRow(line, params, wb)
 	}
 
+	if entry != nil {
+		body := p
+		if filter {
+			body = good.Bytes()
+		}
+		if len(body) != 0 {
+			err = ic.wal.Append(entry, body, params)
+		}
+		if err != nil {
+			// nothing is written, so the client can retry all.
+			log.Printf("append to wal error: %s\n", err)
+			atomic.AddInt64(&ic.stats.WALAppendsFail, 1)
+			atomic.AddInt64(&ic.stats.WriteRequestsFail, 1)
+			return ErrWALAppend
+		}
+	}
+	werr := ic.writeBatch(wb, params)
+
+	switch {
+	case !filter:
+		ic.writeNexts(p, params)
+	case good.Len() != 0:
+		ic.writeNexts(good.Bytes(), params)
+	}
+	if werr != nil {
+		// queue full or not acknowledged, lines may be written to some
+		// backends, client should retry all.
+		atomic.AddInt64(&ic.stats.WriteRequestsFail, 1)
+		return werr
+	}
+	if len(bad) != 0 {
+		written := bytes.Count(good.Bytes(), []byte{'\n'})
+		if written == 0 {
+			atomic.AddInt64(&ic.stats.WriteRequestsFail, 1)
+			// nothing but forbidden, tell it like influxdb.
+			if ndenied == len(bad) {
+				return denied
+			}
+		}
+		return &PartialWriteError{Errors: bad, Dropped: len(bad), Written: written}
+	}
+	return
+}
+
+// checkLine validates line, and checks if the user can write it.
+func (ic *InfluxCluster) checkLine(line []byte, lv *LineValidator, params *WriteParams) (err error) {
+	if lv != nil {
+		err = lv.Validate(line)
+		if err != nil {
+			return
+		}
+	}
+	if params.Policy == nil {
+		return
+	}
+
+	m, err := ScanKey(line)
+	if err != nil {
+		return &LineError{Line: line, Reason: err.Error()}
+	}
+	if !params.Policy.CanWrite(params.DB, m) {
+		return &AuthzError{User: params.Policy.User, Action: "write", Resource: params.DB + ":" + m}
+	}
+	return
+}
+
+// writeNexts copies p to the backends of nexts. They don't decide if the
+// write is done, errors are only logged and counted.
+func (ic *InfluxCluster) writeNexts(p []byte, params *WriteParams) {
 	ic.lock.RLock()
 	defer ic.lock.RUnlock()
 	if len(ic.bas) > 0 {
 		for _, n := range ic.bas {
-			err = n.Write(p)
+			err := ic.enqueue(n, p, params)
 			if err != nil {
-				log.Printf("error: %s\n", err)
-				atomic.AddInt64(&ic.stats.WriteRequestsFail, 1)
+				log.Printf("write nexts error: %s\n", err)
+				atomic.AddInt64(&ic.stats.PointsWrittenFail, CountLines(p))
 			}
 		}
 	}
-
-	return
 }
 
 func (ic *InfluxCluster) Close() (err error) {
@@ -9,7 +9,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -45,6 +49,44 @@ func TestScanKey(t *testing.T) {
 	return
 }
 
+func TestScanTags(t *testing.T) {
+	tests := []struct {
+		point string
+		key   string
+		tags  map[string]string
+	}{
+		{"cpu,host=server01,region=uswest value=1 1434055562000000000", "cpu",
+			map[string]string{"host": "server01", "region": "uswest"}},
+		{"cpu value=3,value2=4 1434055562000010000", "cpu", map[string]string{}},
+		{"temper\\ ature,mach\\=ine=unit\\,42,type=a\\ b internal=32", "temper ature",
+			map[string]string{"mach=ine": "unit,42", "type": "a b"}},
+	}
+
+	for _, tt := range tests {
+		key, tags, err := ScanTags([]byte(tt.point))
+		if err != nil {
+			t.Errorf("%s: %s", tt.point, err)
+			continue
+		}
+		if key != tt.key || len(tags) != len(tt.tags) {
+			t.Errorf("%s: %s %v", tt.point, key, tags)
+			continue
+		}
+		for k, v := range tt.tags {
+			if tags[k] != v {
+				t.Errorf("%s: %s %v", tt.point, key, tags)
+			}
+		}
+	}
+
+	for _, point := range []string{"cpu,host value=1", "cpu"} {
+		_, _, err := ScanTags([]byte(point))
+		if err == nil {
+			t.Errorf("%s: illegal point passed", point)
+		}
+	}
+}
+
 func BenchmarkScanKey(b *testing.B) {
 	buf := &bytes.Buffer{}
 	for i := 0; i < b.N; i++ {
@@ -76,6 +118,58 @@ func BenchmarkScanKey(b *testing.B) {
 	}
 }
 
+// queuedBackend passes every write through a queue to the buffer of
+// Backends, like its worker does.
+type queuedBackend struct {
+	dummyBackend
+	ch chan *writeItem
+	bs *Backends
+}
+
+func (qb *queuedBackend) Write(p []byte, params *WriteParams) (err error) {
+	qb.ch <- &writeItem{p: p, params: params}
+	item := <-qb.ch
+	qb.bs.WriteBuffer(item.p, item.params)
+	return
+}
+
+// BenchmarkClusterWrite writes requests of 1000 lines to two backends.
+func BenchmarkClusterWrite(b *testing.B) {
+	var qbs []*queuedBackend
+	var apis []BackendAPI
+	for i := 0; i < 2; i++ {
+		qb := &queuedBackend{
+			ch: make(chan *writeItem, 1),
+			bs: &Backends{MaxRowLimit: 1 << 30, batches: make(map[string]*batch)},
+		}
+		qbs = append(qbs, qb)
+		apis = append(apis, qb)
+	}
+	ic := NewInfluxCluster(&RedisConfigSource{}, &NodeConfig{})
+	ic.router = NewRouter(map[string][]BackendAPI{DEFAULT_KEY: apis}, nil)
+
+	buf := &bytes.Buffer{}
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(buf, "%s%d,a=%d,b=2 c=3 10000\n", "name", i, i)
+	}
+	p := buf.Bytes()
+	params := &WriteParams{DB: "test"}
+	b.SetBytes(int64(len(p)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := ic.Write(p, params)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		for _, qb := range qbs {
+			qb.bs.batches = make(map[string]*batch)
+			qb.bs.ch_timer = nil
+		}
+	}
+}
+
 func CreateTestInfluxCluster() (ic *InfluxCluster, err error) {
 	redisConfig := &RedisConfigSource{}
 	nodeConfig := &NodeConfig{}
@@ -87,7 +181,7 @@ func CreateTestInfluxCluster() (ic *InfluxCluster, err error) {
 	cfg, _ = CreateTestBackendConfig("test2")
 	bkcfgs["test2"] = cfg
 	cfg, _ = CreateTestBackendConfig("write_only")
-	cfg.WriteOnly = 1
+	cfg.WriteOnly = true
 	bkcfgs["write_only"] = cfg
 	for name, cfg := range bkcfgs {
 		backends[name], err = NewBackends(cfg, name)
@@ -96,12 +190,12 @@ func CreateTestInfluxCluster() (ic *InfluxCluster, err error) {
 		}
 	}
 	ic.backends = backends
-	ic.nexts = "test2"
+	ic.nexts = []string{"test2"}
 	ic.bas = append(ic.bas, backends["test2"])
 	m2bs := make(map[string][]BackendAPI)
 	m2bs["cpu"] = append(m2bs["cpu"], backends["write_only"], backends["test1"])
 	m2bs["write_only"] = append(m2bs["write_only"], backends["write_only"])
-	ic.m2bs = m2bs
+	ic.router = NewRouter(m2bs, nil)
 
 	return
 }
@@ -138,7 +232,7 @@ func TestInfluxdbClusterWrite(t *testing.T) {
 		},
 	}
 	for _, tt := range tests {
-		err := ic.Write(tt.args)
+		err := ic.Write(tt.args, &WriteParams{})
 		if err != nil {
 			t.Error(tt.name, err)
 			continue
@@ -146,6 +240,237 @@ func TestInfluxdbClusterWrite(t *testing.T) {
 	}
 	time.Sleep(time.Second)
 }
+
+type failBackend struct {
+	dummyBackend
+}
+
+func (fb *failBackend) Write(p []byte, params *WriteParams) (err error) {
+	return ErrQueueFull
+}
+
+func TestInfluxdbClusterWriteNextsFail(t *testing.T) {
+	ic, err := CreateTestInfluxCluster()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ic.Close()
+	ic.bas = []BackendAPI{&failBackend{}}
+
+	// nexts don't fail the write, only counted.
+	err = ic.Write([]byte("cpu value=1\ncpu value=2\n"), &WriteParams{})
+	if err != nil {
+		t.Errorf("write failed by nexts: %s", err)
+	}
+	if ic.stats.PointsWrittenFail != 2 || ic.stats.WriteRequestsFail != 0 {
+		t.Errorf("stats wrong: %d %d", ic.stats.PointsWrittenFail, ic.stats.WriteRequestsFail)
+	}
+}
+
+// backends closed by reload may still be written by writes routed before it.
+func TestInfluxdbClusterReloadWrite(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+	load := func(i int) map[string]BackendAPI {
+		cfg, _ := CreateTestBackendConfig("test")
+		cfg.URL = ts.URL
+		name := fmt.Sprintf("reload%d", i)
+		bs, err := NewBackends(cfg, name)
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+		return map[string]BackendAPI{name: bs}
+	}
+	defer func() {
+		for i := 0; i < 20; i++ {
+			os.Remove(fmt.Sprintf("reload%d.dat", i))
+			os.Remove(fmt.Sprintf("reload%d.rec", i))
+		}
+	}()
+
+	ic := NewInfluxCluster(&RedisConfigSource{}, &NodeConfig{})
+	ic.backends = load(0)
+	ic.router = NewRouter(map[string][]BackendAPI{"cpu": {ic.backends["reload0"]}}, nil)
+	defer ic.Close()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				ic.Write([]byte("cpu value=1\n"), &WriteParams{DB: "test"})
+			}
+		}()
+	}
+
+	// like LoadConfig, swap the backends and close the old ones.
+	for i := 1; i < 20; i++ {
+		backends := load(i)
+		ic.lock.Lock()
+		orig := ic.backends
+		ic.backends = backends
+		ic.router = NewRouter(map[string][]BackendAPI{"cpu": {backends[fmt.Sprintf("reload%d", i)]}}, nil)
+		ic.lock.Unlock()
+		closeBackends(orig)
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestInfluxdbClusterUnknown(t *testing.T) {
+	ic, err := CreateTestInfluxCluster()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ic.unknownPolicy = UNKNOWN_ASSIGN
+	ic.assigner = NewAssigner(ASSIGN_FIXED, []string{"test1|test2"})
+	ic.WriteRow([]byte("mem value=1"), &WriteParams{})
+	rt, ok := ic.route(ic.GetRouter(), &RouteKey{Measurement: "mem"})
+	if !ok || len(rt.Backends) != 2 || ic.loads["test1"] != 1 {
+		t.Errorf("measurement not assigned: %v", rt)
+	}
+
+	ic.unknownPolicy = UNKNOWN_HOLD
+	ic.WriteRow([]byte("disk value=1"), &WriteParams{})
+	if held := ic.HeldMeasurements(); held["disk"] != 1 {
+		t.Errorf("point not held: %v", held)
+	}
+
+	// operator maps disk, then reload.
+	ic.router = NewRouter(map[string][]BackendAPI{"disk": {ic.backends["test1"]}}, nil)
+	ic.ReleaseHeld()
+	if held := ic.HeldMeasurements(); len(held) != 0 {
+		t.Errorf("point not released: %v", held)
+	}
+	time.Sleep(time.Second)
+}
+
+func TestInfluxdbClusterWriteValidate(t *testing.T) {
+	ic, err := CreateTestInfluxCluster()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ic.ValidateLines = true
+
+	err = ic.Write([]byte("cpu value=1\n# comment\ncpu value=\n\ncpu,host value=2\n"), &WriteParams{})
+	want := "partial write: unable to parse 'cpu value=': missing field value\n" +
+		"unable to parse 'cpu,host value=2': missing tag value dropped=2"
+	if err == nil || err.Error() != want {
+		t.Errorf("partial write wrong: %v", err)
+	}
+
+	err = ic.Write([]byte("cpu value=1 1\ncpu value=2 2\n"), &WriteParams{Precision: "s"})
+	if err != nil {
+		t.Errorf("error: %s", err)
+	}
+	time.Sleep(time.Second)
+}
+
+func TestInfluxdbClusterWritePolicy(t *testing.T) {
+	ic, err := CreateTestInfluxCluster()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	policy, err := NewPolicy("collector", &UserConfig{Write: []string{"test:cpu"}})
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+
+	err = ic.Write([]byte("cpu value=1\nmem value=2\n"), &WriteParams{DB: "test", Policy: policy})
+	want := "partial write: unable to parse 'mem value=2': user 'collector' not authorized to write test:mem dropped=1"
+	if err == nil || err.Error() != want {
+		t.Errorf("partial write wrong: %v", err)
+	}
+
+	err = ic.Write([]byte("mem value=2\n"), &WriteParams{DB: "test", Policy: policy})
+	if _, ok := err.(*AuthzError); !ok {
+		t.Errorf("forbidden write passed: %v", err)
+	}
+	time.Sleep(time.Second)
+}
+
+func TestInfluxdbClusterCheckQuery(t *testing.T) {
+	ic, err := CreateTestInfluxCluster()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ic.CheckQuery("select * from cpu where time > now() - 1h")
+	if err == nil || !strings.HasPrefix(err.Error(), "query forbidden by default_forbid") {
+		t.Errorf("default filter wrong: %v", err)
+	}
+
+	no_regex, _ := NewQueryFilter("no_regex", "FROM /", "regex sources are slow")
+	time_bound, _ := NewQueryFilter("time_bound", "(?i)where.*time", "need a time range")
+	show, _ := NewQueryFilter("show", "(?i)^show", "")
+	ic.ForbiddenQuery = []*QueryFilter{no_regex}
+	ic.ObligatedQuery = []*QueryFilter{show, time_bound}
+
+	tests := []struct {
+		q    string
+		want string
+	}{
+		{"SELECT * FROM cpu WHERE time > 0", ""},
+		{"SHOW TAG KEYS", ""},
+		{"SELECT v FROM /cpu/ WHERE time > 0", "query forbidden by no_regex: regex sources are slow"},
+		{"SELECT v FROM cpu", "query forbidden by show,time_bound: need a time range"},
+	}
+	for _, tt := range tests {
+		err = ic.CheckQuery(tt.q)
+		if (err == nil && tt.want != "") || (err != nil && err.Error() != tt.want) {
+			t.Errorf("%s: %v", tt.q, err)
+		}
+	}
+}
+
+func TestInfluxdbClusterReloadQueryFilters(t *testing.T) {
+	ic := NewInfluxCluster(&RedisConfigSource{}, &NodeConfig{})
+	defer ic.Close()
+	if err := ic.ForbidQuery("(?i)from secret"); err != nil {
+		t.Errorf("error: %s", err)
+	}
+	if err := ic.EnsureQuery("(?i)^show"); err != nil {
+		t.Errorf("error: %s", err)
+	}
+
+	// like LoadConfig, filters added at runtime are kept.
+	forbidden, obligated := DefaultQueryFilters()
+	ic.lock.Lock()
+	ic.setQueryFilters(forbidden, obligated)
+	ic.lock.Unlock()
+	if len(ic.ForbiddenQuery) != 2 || len(ic.ObligatedQuery) != 2 {
+		t.Errorf("filters wrong: %d %d", len(ic.ForbiddenQuery), len(ic.ObligatedQuery))
+	}
+
+	err := ic.CheckQuery("SELECT v FROM secret WHERE time > now() - 1h")
+	if err == nil || !strings.HasPrefix(err.Error(), "query forbidden by (?i)from secret") {
+		t.Errorf("runtime filter lost: %v", err)
+	}
+	if err = ic.CheckQuery("SHOW DATABASES"); err != nil {
+		t.Errorf("runtime filter lost: %v", err)
+	}
+	if err = ic.CheckQuery("SELECT v FROM cpu WHERE time > now() - 1h"); err != nil {
+		t.Errorf("error: %v", err)
+	}
+}
+
 func TestInfluxdbClusterPing(t *testing.T) {
 	ic, err := CreateTestInfluxCluster()
 	if err != nil {
@@ -247,3 +572,97 @@ func TestInfluxdbClusterQuery(t *testing.T) {
 		}
 	}
 }
+
+func CreateTestQueryBackend(body string) (hb *HttpBackend, ts *httptest.Server) {
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer req.Body.Close()
+		w.Header().Add("X-Influxdb-Version", VERSION)
+		if req.URL.Path != "/query" {
+			w.WriteHeader(204)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(body))
+	}))
+	hb = NewHttpBackend(&BackendConfig{
+		URL:           ts.URL,
+		DB:            "test",
+		Timeout:       time.Second,
+		CheckInterval: time.Second,
+	})
+	return
+}
+
+func TestInfluxdbClusterQueryShards(t *testing.T) {
+	bodies := []string{
+		`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","v"],"values":[[1,1],[3,3]]}]}]}`,
+		`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","v"],"values":[[2,2]]}]}]}`,
+	}
+	backends := make(map[string]BackendAPI)
+	var names []string
+	for i, body := range bodies {
+		hb, ts := CreateTestQueryBackend(body)
+		defer ts.Close()
+		defer hb.Close()
+		name := fmt.Sprintf("shard%d", i)
+		backends[name] = hb
+		names = append(names, name)
+	}
+
+	rule, err := NewRule("cpu", &RuleConfig{
+		Match:    "glob",
+		Pattern:  "cpu",
+		Backends: names,
+		Replicas: 1,
+	}, backends)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ic := NewInfluxCluster(&RedisConfigSource{}, &NodeConfig{})
+	ic.router = NewRouter(nil, RuleList{rule})
+
+	q := url.Values{}
+	q.Set("db", "test")
+	q.Set("q", "SELECT v FROM cpu WHERE time > now() - 1h")
+	req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+	w := NewDummyResponseWriter()
+	err = ic.Query(w, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	want := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","v"],"values":[[1,1],[2,2],[3,3]]}]}]}`
+	if w.status != 200 || w.buffer.String() != want {
+		t.Errorf("query shards wrong: %d %s", w.status, w.buffer.String())
+	}
+
+	// can't be merged, should not send to shards.
+	q.Set("q", "SELECT percentile(v, 95) FROM cpu WHERE time > now() - 1h GROUP BY time(1m)")
+	req, _ = http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+	w = NewDummyResponseWriter()
+	err = ic.Query(w, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if w.status != 400 || !strings.Contains(w.buffer.String(), "percentile") {
+		t.Errorf("query shards wrong: %d %s", w.status, w.buffer.String())
+	}
+
+	// every shard would write its part into the target.
+	q.Set("q", "SELECT mean(v) INTO cpu_1m FROM cpu WHERE time > now() - 1h GROUP BY time(1m), *")
+	req, _ = http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+	w = NewDummyResponseWriter()
+	err = ic.Query(w, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if w.status != 400 || !strings.Contains(w.buffer.String(), "INTO cpu_1m") {
+		t.Errorf("query shards wrong: %d %s", w.status, w.buffer.String())
+	}
+}
@@ -4,8 +4,75 @@
 
 package backend
 
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	FILTER_FORBID  = "forbid"
+	FILTER_REQUIRE = "require"
+)
+
 var (
 	ForbidCmds   = "(?i:select\\s+\\*|^\\s*delete|^\\s*drop|^\\s*grant|^\\s*revoke|\\(\\)\\$)"
 	SupportCmds  = "(?i:where.*time|show.*from)"
 	ExecutorCmds = "(?i:show.*measurements)"
 )
+
+// QueryFilter is a rule on queries. A query matches any forbid filter is
+// rejected, so is a query matches none of the require filters.
+type QueryFilter struct {
+	Name   string
+	Reason string
+	re     *regexp.Regexp
+}
+
+func NewQueryFilter(name string, pattern string, reason string) (qf *QueryFilter, err error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return
+	}
+	qf = &QueryFilter{Name: name, Reason: reason, re: re}
+	return
+}
+
+func (qf *QueryFilter) Match(q string) bool {
+	return qf.re.MatchString(q)
+}
+
+// FilterError tells client the filters which rejected the query.
+type FilterError struct {
+	Filters []*QueryFilter
+}
+
+func (e *FilterError) Error() string {
+	var names, reasons []string
+	for _, qf := range e.Filters {
+		names = append(names, qf.Name)
+		if qf.Reason != "" {
+			reasons = append(reasons, qf.Reason)
+		}
+	}
+	s := "query forbidden by " + strings.Join(names, ",")
+	if len(reasons) != 0 {
+		s += ": " + strings.Join(reasons, "; ")
+	}
+	return s
+}
+
+// DefaultQueryFilters are used if no filter is configured.
+func DefaultQueryFilters() (forbidden []*QueryFilter, obligated []*QueryFilter) {
+	qf, err := NewQueryFilter("default_forbid", ForbidCmds, "select *, delete, drop, grant and revoke are not allowed")
+	if err != nil {
+		panic(err)
+	}
+	forbidden = append(forbidden, qf)
+
+	qf, err = NewQueryFilter("default_require", SupportCmds, "select needs a time condition, show needs from")
+	if err != nil {
+		panic(err)
+	}
+	obligated = append(obligated, qf)
+	return
+}
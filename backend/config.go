@@ -5,11 +5,13 @@
 package backend
 
 import (
+	"encoding/json"
 	"errors"
 	"log"
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/redis.v5"
 )
@@ -22,56 +24,407 @@ var (
 	ErrIllegalConfig = errors.New("illegal config")
 )
 
+// LoadStructFromMap sets the fields of the struct pointed by o from data.
+// The key of a field is its lowercased name, or the name in its config tag.
+// Keys not in data leave the field untouched, so several maps can be layered.
+//
+// Supported types are string, int, bool, float, time.Duration, []string and
+// map[string]string. A duration is a string like "10s", or a bare integer in
+// the unit given by the unit tag (ms by default). A list is comma separated
+// or a JSON array. A map is "k1=v1,k2=v2", a JSON object, or separated keys
+// like "headers.x-token".
 func LoadStructFromMap(data map[string]string, o interface{}) (err error) {
-	var x int
 	val := reflect.ValueOf(o).Elem()
 	for i := 0; i < val.NumField(); i++ {
 		valueField := val.Field(i)
 		typeField := val.Type().Field(i)
+		name := fieldName(typeField)
+
+		if typeField.Type.Kind() == reflect.Map {
+			err = loadMapField(data, name, valueField)
+			if err != nil {
+				log.Printf("%s: %s", err, name)
+				return
+			}
+			continue
+		}
 
-		name := strings.ToLower(typeField.Name)
 		s, ok := data[name]
 		if !ok {
 			continue
 		}
 
-		switch typeField.Type.Kind() {
-		case reflect.String:
-			valueField.SetString(s)
-		case reflect.Int:
-			x, err = strconv.Atoi(s)
-			if err != nil {
-				log.Printf("%s: %s", err, name)
-				return
+		err = setField(valueField, typeField, s)
+		if err != nil {
+			log.Printf("%s: %s", err, name)
+			return
+		}
+	}
+	return
+}
+
+// ApplyDefaults sets every field which has a default tag to that value.
+// Call it before LoadStructFromMap.
+func ApplyDefaults(o interface{}) (err error) {
+	val := reflect.ValueOf(o).Elem()
+	for i := 0; i < val.NumField(); i++ {
+		typeField := val.Type().Field(i)
+		s, ok := typeField.Tag.Lookup("default")
+		if !ok {
+			continue
+		}
+
+		err = setField(val.Field(i), typeField, s)
+		if err != nil {
+			log.Printf("%s: default of %s", err, typeField.Name)
+			return
+		}
+	}
+	return
+}
+
+// ValidateStruct checks the required, oneof and min tags of the struct pointed by o.
+func ValidateStruct(o interface{}) (err error) {
+	val := reflect.ValueOf(o).Elem()
+	for i := 0; i < val.NumField(); i++ {
+		valueField := val.Field(i)
+		typeField := val.Type().Field(i)
+		name := fieldName(typeField)
+
+		if typeField.Tag.Get("required") == "true" && isZero(valueField) {
+			log.Printf("%s is required", name)
+			return ErrIllegalConfig
+		}
+
+		if oneof, ok := typeField.Tag.Lookup("oneof"); ok && valueField.Kind() == reflect.String {
+			found := false
+			for _, choice := range strings.Split(oneof, ",") {
+				found = found || valueField.String() == choice
 			}
-			valueField.SetInt(int64(x))
+			if !found {
+				log.Printf("%s must be one of %s", name, oneof)
+				return ErrIllegalConfig
+			}
+		}
+
+		s, ok := typeField.Tag.Lookup("min")
+		if !ok {
+			continue
+		}
+		limit, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			log.Printf("%s: min of %s", err, name)
+			return ErrIllegalConfig
+		}
+
+		var v float64
+		switch valueField.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			v = float64(valueField.Int())
+		case reflect.Float32, reflect.Float64:
+			v = valueField.Float()
+		case reflect.Slice, reflect.Map, reflect.String:
+			v = float64(valueField.Len())
+		default:
+			continue
 		}
+		if v < limit {
+			log.Printf("%s must be at least %s", name, s)
+			return ErrIllegalConfig
+		}
+	}
+	return
+}
+
+func fieldName(typeField reflect.StructField) (name string) {
+	name = typeField.Tag.Get("config")
+	if name == "" {
+		name = strings.ToLower(typeField.Name)
+	}
+	return
+}
+
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String:
+		return v.Len() == 0
+	}
+	return v.Interface() == reflect.Zero(v.Type()).Interface()
+}
+
+func setField(valueField reflect.Value, typeField reflect.StructField, s string) (err error) {
+	s = strings.TrimSpace(s)
+
+	if typeField.Type == durationType {
+		var d time.Duration
+		d, err = ParseDuration(s, typeField.Tag.Get("unit"))
+		if err != nil {
+			return
+		}
+		valueField.SetInt(int64(d))
+		return
+	}
+
+	switch typeField.Type.Kind() {
+	case reflect.String:
+		valueField.SetString(s)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var x int64
+		x, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return
+		}
+		valueField.SetInt(x)
+	case reflect.Bool:
+		var b bool
+		b, err = strconv.ParseBool(s)
+		if err != nil {
+			return
+		}
+		valueField.SetBool(b)
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		f, err = strconv.ParseFloat(s, 64)
+		if err != nil {
+			return
+		}
+		valueField.SetFloat(f)
+	case reflect.Slice:
+		if typeField.Type.Elem().Kind() != reflect.String {
+			return ErrIllegalConfig
+		}
+		var l []string
+		l, err = ParseList(s)
+		if err != nil {
+			return
+		}
+		valueField.Set(reflect.ValueOf(l))
+	case reflect.Map:
+		var m map[string]string
+		m, err = ParseMap(s)
+		if err != nil {
+			return
+		}
+		valueField.Set(reflect.ValueOf(m))
+	default:
+		return ErrIllegalConfig
+	}
+	return
+}
+
+func loadMapField(data map[string]string, name string, valueField reflect.Value) (err error) {
+	t := valueField.Type()
+	if t.Key().Kind() != reflect.String || t.Elem().Kind() != reflect.String {
+		return ErrIllegalConfig
+	}
+
+	m := make(map[string]string)
+	if s, ok := data[name]; ok {
+		m, err = ParseMap(s)
+		if err != nil {
+			return
+		}
+	}
+
+	prefix := name + "."
+	for k, v := range data {
+		if strings.HasPrefix(k, prefix) && len(k) > len(prefix) {
+			m[k[len(prefix):]] = v
+		}
+	}
+
+	if len(m) != 0 {
+		valueField.Set(reflect.ValueOf(m))
+	}
+	return
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// ParseDuration reads "10s" like strings, or bare integers in unit.
+// unit is one of ns, us, ms, s, m, h, and ms if empty.
+func ParseDuration(s string, unit string) (d time.Duration, err error) {
+	if s == "" {
+		return
+	}
+
+	x, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.ParseDuration(s)
+	}
+
+	if unit == "" {
+		unit = "ms"
+	}
+	u, err := time.ParseDuration("1" + unit)
+	if err != nil {
+		return
+	}
+	d = time.Duration(x) * u
+	return
+}
+
+// ParseList reads comma separated strings or a JSON array.
+func ParseList(s string) (l []string, err error) {
+	if strings.HasPrefix(s, "[") {
+		err = json.Unmarshal([]byte(s), &l)
+		return
+	}
+
+	for _, i := range strings.Split(s, ",") {
+		i = strings.TrimSpace(i)
+		if i != "" {
+			l = append(l, i)
+		}
+	}
+	return
+}
+
+// ParseMap reads "k1=v1,k2=v2" or a JSON object.
+func ParseMap(s string) (m map[string]string, err error) {
+	m = make(map[string]string)
+	if strings.HasPrefix(s, "{") {
+		err = json.Unmarshal([]byte(s), &m)
+		return
+	}
+
+	for _, i := range strings.Split(s, ",") {
+		i = strings.TrimSpace(i)
+		if i == "" {
+			continue
+		}
+		kv := strings.SplitN(i, "=", 2)
+		if len(kv) != 2 {
+			err = ErrIllegalConfig
+			return
+		}
+		m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
 	}
 	return
 }
 
 type NodeConfig struct {
-	ListenAddr   string
-	DB           string
-	Zone         string
-	Nexts        string
-	Interval     int
-	IdleTimeout  int
-	WriteTracing int
-	QueryTracing int
+	ListenAddr    string
+	DB            []string // databases served, any if empty
+	Zone          string
+	Nexts         []string
+	Interval      time.Duration `unit:"s"` // of statistics, 10s if 0
+	IdleTimeout   time.Duration `unit:"s" default:"10s"`
+	WriteTracing  bool
+	QueryTracing  bool
+	ValidateLines bool // reject bad lines, instead of letting them fail a batch
+	AuthEnabled   bool // clients must be users of proxy
+
+	// what to do with points of measurements no route matches.
+	// drop them, assign a backend group to the measurement, or hold them
+	// until the measurement is mapped and config is reloaded.
+	UnknownPolicy  string   `default:"drop" oneof:"drop,assign,hold"`
+	AssignStrategy string   `default:"hash" oneof:"least-loaded,hash,fixed"`
+	AssignGroups   []string // backends in a group are joined by |
+	AssignPersist  bool     `default:"true"`
+	HoldLimit      int      `default:"100000" min:"1"`
+
+	// guardrails on the cost of select statements, see Guard.
+	RequireTimeBound bool
+	MaxTimeRange     time.Duration `unit:"s"`
+	MaxPoints        int64         `min:"0"`
+	ForbidSelectAll  bool
+	ForbidGroupByAll bool
+	DefaultTimeRange time.Duration `unit:"s"`
+
+	// cache of query results in bytes, 0 disables it, see QueryCache.
+	CacheSize      int64         `min:"0"`
+	CacheTTL       time.Duration `unit:"s" default:"10m"`
+	CacheRecentTTL time.Duration `unit:"s" default:"10s"` // for time ranges touch now
+
+	CoalesceQueries bool          // identical queries at the same time share a response
+	CoalesceTimeout time.Duration `unit:"s" default:"10m"` // a shared query isn't canceled by clients, but by it
+
+	// how reads are spread on replicas in the zone, see Balancer.
+	ReadBalance string `default:"order" oneof:"order,round-robin,least-outstanding,ewma,p2c"`
+
+	// send a query to the next replica too, if no answer in the delay,
+	// or the percentile of latency of the replica, see Hedger.
+	HedgeDelay      time.Duration `unit:"ms"`
+	HedgePercentile float64       `min:"0"`
+
+	// when writes are acknowledged, requests can ask for another by ack.
+	// WriteQuorum is of backends of every line, the majority if 0.
+	WriteAck        string        `default:"enqueue" oneof:"enqueue,durable,quorum"`
+	WriteQuorum     int           `min:"0"`
+	WriteAckTimeout time.Duration `unit:"ms" default:"10s"`
+
+	// bodies of writes are appended to wal in it before acknowledged, see WAL.
+	WALDir         string
+	WALSegmentSize int64 `default:"67108864" min:"1"`
 }
 
 type BackendConfig struct {
-	URL             string
-	DB              string
+	URL             string            `required:"true"`
+	DB              string            // db of client not in Databases goes to it, if set
+	Databases       map[string]string // db of client to db of this backend
+	RPs             map[string]string // rp of client to rp of this backend
+	Username        string            // credentials of this backend, instead of clients'
+	Password        string
 	Zone            string
-	Interval        int
-	Timeout         int
-	TimeoutQuery    int
-	MaxRowLimit     int
-	CheckInterval   int
-	RewriteInterval int
-	WriteOnly       int
+	Interval        time.Duration `default:"1s"`
+	Timeout         time.Duration `default:"10s"`
+	TimeoutQuery    time.Duration `default:"10m"`
+	MaxRowLimit     int           `default:"10000" min:"1"`
+	QueueSize       int           `default:"1024" min:"1"` // points queued to be batched
+	QueueFull       string        `default:"spill" oneof:"spill,drop-oldest,reject"`
+	CheckInterval   time.Duration `default:"1s"`
+	RewriteInterval time.Duration `default:"10s"`
+	WriteOnly       bool
+	Headers         map[string]string
+
+	// more flush triggers of a batch, 0 is off.
+	MaxBatchBytes      int           `min:"0"` // uncompressed
+	MaxBatchCompressed int           `min:"0"` // gzipped, as far as compressed
+	MaxBatchAge        time.Duration `min:"0"`
+
+	// if AdaptiveBatch, the row limit halves when a batch is written slower
+	// than SlowWrite, and grows back to MaxRowLimit when written fast.
+	AdaptiveBatch bool
+	MinRowLimit   int           `default:"100" min:"1"`
+	SlowWrite     time.Duration `default:"1s"`
+}
+
+// RuleConfig routes measurements matched by Pattern to Backends.
+// Match is regex or glob. Rules with lower Priority are tried first.
+// If Tag is set, Pattern matches the value of that tag instead.
+// DB and RP limit the rule to those write or query parameters.
+// If Replicas is set, Backends are split into shards of that many replicas,
+// and each series is written to one shard by consistent hash.
+type RuleConfig struct {
+	Match    string `default:"regex"`
+	Pattern  string `required:"true"`
+	Tag      string
+	DB       string
+	RP       string
+	Priority int
+	Backends []string `min:"1"`
+	Replicas int      `min:"0"`
+}
+
+// QueryFilterConfig forbids queries matched by Pattern, or requires
+// queries to match one of the require filters. Reason is told to client.
+type QueryFilterConfig struct {
+	Type    string `default:"forbid" oneof:"forbid,require"`
+	Pattern string `required:"true"`
+	Reason  string
+}
+
+// LimitConfig limits clients by ip, user or db, whose value matches
+// Match in glob. Rates are per second, 0 is unlimited.
+type LimitConfig struct {
+	Key         string        `default:"ip" oneof:"ip,user,db"`
+	Match       string        `default:"*"`
+	WritePoints float64       `min:"0"`
+	WriteBytes  float64       `min:"0"`
+	Queries     float64       `min:"0"`
+	Concurrent  int           `min:"0"`      // queries at the same time
+	Burst       time.Duration `default:"1s"` // buckets hold tokens of it
 }
 
 type RedisConfigSource struct {
@@ -89,6 +442,11 @@ func NewRedisConfigSource(options *redis.Options, node string) (rcs *RedisConfig
 }
 
 func (rcs *RedisConfigSource) LoadNode() (nodecfg NodeConfig, err error) {
+	err = ApplyDefaults(&nodecfg)
+	if err != nil {
+		return
+	}
+
 	val, err := rcs.client.HGetAll("default_node").Result()
 	if err != nil {
 		log.Printf("redis load error: b:%s", rcs.node)
@@ -112,6 +470,12 @@ func (rcs *RedisConfigSource) LoadNode() (nodecfg NodeConfig, err error) {
 		log.Printf("redis load error: b:%s", rcs.node)
 		return
 	}
+
+	err = ValidateStruct(&nodecfg)
+	if err != nil {
+		log.Printf("node config illegal: %s", rcs.node)
+		return
+	}
 	log.Printf("node config loaded.")
 	return
 }
@@ -147,28 +511,20 @@ func (rcs *RedisConfigSource) LoadConfigFromRedis(name string) (cfg *BackendConf
 	}
 
 	cfg = &BackendConfig{}
-	err = LoadStructFromMap(val, cfg)
+	err = ApplyDefaults(cfg)
 	if err != nil {
 		return
 	}
 
-	if cfg.Interval == 0 {
-		cfg.Interval = 1000
-	}
-	if cfg.Timeout == 0 {
-		cfg.Timeout = 10000
-	}
-	if cfg.TimeoutQuery == 0 {
-		cfg.TimeoutQuery = 600000
-	}
-	if cfg.MaxRowLimit == 0 {
-		cfg.MaxRowLimit = 10000
-	}
-	if cfg.CheckInterval == 0 {
-		cfg.CheckInterval = 1000
+	err = LoadStructFromMap(val, cfg)
+	if err != nil {
+		return
 	}
-	if cfg.RewriteInterval == 0 {
-		cfg.RewriteInterval = 10000
+
+	err = ValidateStruct(cfg)
+	if err != nil {
+		log.Printf("backend config illegal: b:%s", name)
+		return
 	}
 	return
 }
@@ -196,3 +552,223 @@ func (rcs *RedisConfigSource) LoadMeasurements() (m_map map[string][]string, err
 	log.Printf("%d measurements loaded from redis.", len(m_map))
 	return
 }
+
+// LoadDatabaseMeasurements loads measurements mapped only in a db.
+// Keys are d:<db>:<measurement>, so db can't have a colon.
+func (rcs *RedisConfigSource) LoadDatabaseMeasurements() (d_map map[string]map[string][]string, err error) {
+	d_map = make(map[string]map[string][]string)
+
+	names, err := rcs.client.Keys("d:*").Result()
+	if err != nil {
+		log.Printf("read redis error: %s", err)
+		return
+	}
+
+	var length int64
+	for _, key := range names {
+		kv := strings.SplitN(key[2:], ":", 2)
+		if len(kv) != 2 {
+			log.Printf("illegal key: %s", key)
+			continue
+		}
+
+		length, err = rcs.client.LLen(key).Result()
+		if err != nil {
+			return
+		}
+		m_map, ok := d_map[kv[0]]
+		if !ok {
+			m_map = make(map[string][]string)
+			d_map[kv[0]] = m_map
+		}
+		m_map[kv[1]], err = rcs.client.LRange(key, 0, length).Result()
+		if err != nil {
+			return
+		}
+	}
+	log.Printf("measurements of %d databases loaded from redis.", len(d_map))
+	return
+}
+
+// saveMeasurement pushes backends to the list of a measurement if it's
+// empty, and returns the list. It's atomic in redis.
+const saveMeasurement = `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	redis.call("RPUSH", KEYS[1], unpack(ARGV))
+end
+return redis.call("LRANGE", KEYS[1], 0, -1)
+`
+
+// SaveMeasurement maps a new measurement to backends, if it's not mapped yet.
+// The mapping already in redis wins, so nodes agree on it.
+func (rcs *RedisConfigSource) SaveMeasurement(name string, backends []string) (saved []string, err error) {
+	key := "m:" + name
+	values := make([]interface{}, len(backends))
+	for i, b := range backends {
+		values[i] = b
+	}
+	res, err := rcs.client.Eval(saveMeasurement, []string{key}, values...).Result()
+	if err != nil {
+		log.Printf("write redis error: %s", err)
+		return
+	}
+
+	items, _ := res.([]interface{})
+	for _, item := range items {
+		b, ok := item.(string)
+		if !ok {
+			err = ErrIllegalConfig
+			return
+		}
+		saved = append(saved, b)
+	}
+	if len(saved) == 0 {
+		err = ErrIllegalConfig
+		return
+	}
+	log.Printf("measurement %s saved to redis as %s.", name, strings.Join(saved, ","))
+	return
+}
+
+func (rcs *RedisConfigSource) LoadUsers() (users map[string]*UserConfig, err error) {
+	users = make(map[string]*UserConfig)
+
+	names, err := rcs.client.Keys("u:*").Result()
+	if err != nil {
+		log.Printf("read redis error: %s", err)
+		return
+	}
+
+	var val map[string]string
+	for _, key := range names {
+		val, err = rcs.client.HGetAll(key).Result()
+		if err != nil {
+			log.Printf("redis load error: %s", key)
+			return
+		}
+
+		cfg := &UserConfig{}
+		err = ApplyDefaults(cfg)
+		if err != nil {
+			return
+		}
+		err = LoadStructFromMap(val, cfg)
+		if err != nil {
+			return
+		}
+		users[key[2:]] = cfg
+	}
+	log.Printf("%d users loaded from redis.", len(users))
+	return
+}
+
+func (rcs *RedisConfigSource) LoadQueryFilters() (filters map[string]*QueryFilterConfig, err error) {
+	filters = make(map[string]*QueryFilterConfig)
+
+	names, err := rcs.client.Keys("f:*").Result()
+	if err != nil {
+		log.Printf("read redis error: %s", err)
+		return
+	}
+
+	var val map[string]string
+	for _, key := range names {
+		val, err = rcs.client.HGetAll(key).Result()
+		if err != nil {
+			log.Printf("redis load error: %s", key)
+			return
+		}
+
+		cfg := &QueryFilterConfig{}
+		err = ApplyDefaults(cfg)
+		if err != nil {
+			return
+		}
+		err = LoadStructFromMap(val, cfg)
+		if err != nil {
+			return
+		}
+		err = ValidateStruct(cfg)
+		if err != nil {
+			log.Printf("query filter config illegal: %s", key)
+			return
+		}
+		filters[key[2:]] = cfg
+	}
+	log.Printf("%d query filters loaded from redis.", len(filters))
+	return
+}
+
+func (rcs *RedisConfigSource) LoadLimits() (limits map[string]*LimitConfig, err error) {
+	limits = make(map[string]*LimitConfig)
+
+	names, err := rcs.client.Keys("l:*").Result()
+	if err != nil {
+		log.Printf("read redis error: %s", err)
+		return
+	}
+
+	var val map[string]string
+	for _, key := range names {
+		val, err = rcs.client.HGetAll(key).Result()
+		if err != nil {
+			log.Printf("redis load error: %s", key)
+			return
+		}
+
+		cfg := &LimitConfig{}
+		err = ApplyDefaults(cfg)
+		if err != nil {
+			return
+		}
+		err = LoadStructFromMap(val, cfg)
+		if err != nil {
+			return
+		}
+		err = ValidateStruct(cfg)
+		if err != nil {
+			log.Printf("limit config illegal: %s", key)
+			return
+		}
+		limits[key[2:]] = cfg
+	}
+	log.Printf("%d limits loaded from redis.", len(limits))
+	return
+}
+
+func (rcs *RedisConfigSource) LoadRules() (rules map[string]*RuleConfig, err error) {
+	rules = make(map[string]*RuleConfig)
+
+	names, err := rcs.client.Keys("r:*").Result()
+	if err != nil {
+		log.Printf("read redis error: %s", err)
+		return
+	}
+
+	var val map[string]string
+	for _, key := range names {
+		val, err = rcs.client.HGetAll(key).Result()
+		if err != nil {
+			log.Printf("redis load error: %s", key)
+			return
+		}
+
+		cfg := &RuleConfig{}
+		err = ApplyDefaults(cfg)
+		if err != nil {
+			return
+		}
+		err = LoadStructFromMap(val, cfg)
+		if err != nil {
+			return
+		}
+		err = ValidateStruct(cfg)
+		if err != nil {
+			log.Printf("rule config illegal: %s", key)
+			return
+		}
+		rules[key[2:]] = cfg
+	}
+	log.Printf("%d rules loaded from redis.", len(rules))
+	return
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadStructFromMap(t *testing.T) {
+	cfg := &BackendConfig{}
+	err := ApplyDefaults(cfg)
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+
+	err = LoadStructFromMap(map[string]string{
+		"url":             "http://localhost:8086",
+		"interval":        "200",
+		"timeout":         "3s",
+		"writeonly":       "1",
+		"maxrowlimit":     "500",
+		"headers":         "X-A=1, X-B=2",
+		"headers.X-Token": "abc",
+	}, cfg)
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+
+	err = ValidateStruct(cfg)
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+
+	if cfg.Interval != 200*time.Millisecond || cfg.Timeout != 3*time.Second {
+		t.Errorf("duration wrong: %s, %s", cfg.Interval, cfg.Timeout)
+	}
+	if cfg.TimeoutQuery != 10*time.Minute || cfg.RewriteInterval != 10*time.Second {
+		t.Errorf("default wrong: %s, %s", cfg.TimeoutQuery, cfg.RewriteInterval)
+	}
+	if !cfg.WriteOnly || cfg.MaxRowLimit != 500 {
+		t.Errorf("value wrong: %v, %d", cfg.WriteOnly, cfg.MaxRowLimit)
+	}
+	if len(cfg.Headers) != 3 || cfg.Headers["X-B"] != "2" || cfg.Headers["X-Token"] != "abc" {
+		t.Errorf("headers wrong: %v", cfg.Headers)
+	}
+}
+
+func TestLoadNodeConfig(t *testing.T) {
+	nodecfg := &NodeConfig{}
+	err := ApplyDefaults(nodecfg)
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+
+	err = LoadStructFromMap(map[string]string{
+		"nexts":        "a, b,c",
+		"interval":     "30",
+		"writetracing": "true",
+	}, nodecfg)
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	err = LoadStructFromMap(map[string]string{
+		"nexts": "[\"d\"]",
+	}, nodecfg)
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+
+	if len(nodecfg.Nexts) != 1 || nodecfg.Nexts[0] != "d" {
+		t.Errorf("nexts wrong: %v", nodecfg.Nexts)
+	}
+	if nodecfg.Interval != 30*time.Second || nodecfg.IdleTimeout != 10*time.Second {
+		t.Errorf("duration wrong: %s, %s", nodecfg.Interval, nodecfg.IdleTimeout)
+	}
+	if !nodecfg.WriteTracing || nodecfg.QueryTracing {
+		t.Errorf("tracing wrong")
+	}
+}
+
+func TestIllegalConfig(t *testing.T) {
+	tests := []map[string]string{
+		{"url": "http://localhost:8086", "timeout": "10 seconds"},
+		{"url": "http://localhost:8086", "writeonly": "maybe"},
+		{"url": "http://localhost:8086", "headers": "X-A"},
+	}
+	for _, data := range tests {
+		cfg := &BackendConfig{}
+		err := LoadStructFromMap(data, cfg)
+		if err == nil {
+			t.Errorf("illegal config passed: %v", data)
+		}
+	}
+
+	cfg := &BackendConfig{}
+	ApplyDefaults(cfg)
+	if ValidateStruct(cfg) == nil {
+		t.Errorf("config without url passed")
+	}
+
+	cfg.URL = "http://localhost:8086"
+	cfg.MaxRowLimit = 0
+	if ValidateStruct(cfg) == nil {
+		t.Errorf("config with zero maxrowlimit passed")
+	}
+}
@@ -28,21 +28,21 @@ func NewFileBackend(filename string) (fb *FileBackend, err error) {
 	}
 
 	fb.producer, err = os.OpenFile(filename+".dat",
-		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
 	if err != nil {
 		log.Print("open producer error: ", err)
 		return
 	}
 
 	fb.consumer, err = os.OpenFile(filename+".dat",
-		os.O_RDONLY, 0644)
+		os.O_RDONLY, 0600)
 	if err != nil {
 		log.Print("open consumer error: ", err)
 		return
 	}
 
 	fb.meta, err = os.OpenFile(filename+".rec",
-		os.O_RDWR|os.O_CREATE, 0644)
+		os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
 		log.Print("open meta error: ", err)
 		return
@@ -135,7 +135,7 @@ func (fb *FileBackend) CleanUp() (err error) {
 	}
 
 	fb.producer, err = os.OpenFile(fb.filename+".dat",
-		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
 	if err != nil {
 		log.Print("open producer error: ", err)
 		return
@@ -0,0 +1,70 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+type flightCall struct {
+	done chan struct{}
+	rb   *ResponseBuffer
+	err  error
+}
+
+// QueryGroup coalesces identical queries in flight. The first caller of
+// a key starts the query, the others join it and share its response.
+type QueryGroup struct {
+	lock  sync.Mutex
+	calls map[string]*flightCall
+}
+
+func NewQueryGroup() (g *QueryGroup) {
+	return &QueryGroup{calls: make(map[string]*flightCall)}
+}
+
+// Do runs fn once for the callers of key at the same time. fn runs on its
+// own, so a caller gone by ctx doesn't fail the others. shared is true
+// if the response is of another caller. rb is read only.
+func (g *QueryGroup) Do(ctx context.Context, key string, fn func() (*ResponseBuffer, error)) (rb *ResponseBuffer, err error, shared bool) {
+	g.lock.Lock()
+	c, shared := g.calls[key]
+	if !shared {
+		// waiters get an error if fn panics.
+		c = &flightCall{done: make(chan struct{}), err: ErrInternal}
+		g.calls[key] = c
+		go g.call(c, key, fn)
+	}
+	g.lock.Unlock()
+
+	select {
+	case <-c.done:
+		return c.rb, c.err, shared
+	case <-ctx.Done():
+		return nil, ErrQueryCanceled, shared
+	}
+}
+
+func (g *QueryGroup) call(c *flightCall, key string, fn func() (*ResponseBuffer, error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("query in flight panic: %v\n", r)
+		}
+		g.lock.Lock()
+		delete(g.calls, key)
+		g.lock.Unlock()
+		close(c.done)
+	}()
+	c.rb, c.err = fn()
+}
+
+// Len is the number of keys in flight.
+func (g *QueryGroup) Len() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return len(g.calls)
+}
@@ -0,0 +1,169 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueryGroup(t *testing.T) {
+	g := NewQueryGroup()
+	release := make(chan struct{})
+	var calls, nshared int64
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rb, err, shared := g.Do(context.Background(), "key", func() (*ResponseBuffer, error) {
+				atomic.AddInt64(&calls, 1)
+				<-release
+				rb := NewResponseBuffer()
+				rb.Write([]byte("result"))
+				return rb, nil
+			})
+			if err != nil || rb.Body.String() != "result" {
+				t.Errorf("wrong response: %v, %v", rb, err)
+			}
+			if shared {
+				atomic.AddInt64(&nshared, 1)
+			}
+		}()
+	}
+	for g.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 || nshared != 9 {
+		t.Errorf("%d calls, %d shared", calls, nshared)
+	}
+	if g.Len() != 0 {
+		t.Errorf("%d keys left", g.Len())
+	}
+}
+
+func TestInfluxdbClusterQueryCoalesced(t *testing.T) {
+	var queries int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/query" {
+			w.WriteHeader(204)
+			return
+		}
+		atomic.AddInt64(&queries, 1)
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(200)
+		w.Write([]byte(`{"results":[{}]}`))
+	}))
+	defer ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	api, err := NewBackends(cfg, "coalesce")
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	defer os.Remove("coalesce.dat")
+	defer os.Remove("coalesce.rec")
+	ic := NewInfluxCluster(&RedisConfigSource{}, &NodeConfig{CoalesceQueries: true})
+	ic.router = NewRouter(map[string][]BackendAPI{"cpu": {api}}, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			form := url.Values{"db": {"test"}, "q": {"SELECT v FROM cpu WHERE time > now() - 1h"}}
+			req, _ := http.NewRequest("GET", "/query?"+form.Encode(), nil)
+			w := NewDummyResponseWriter()
+			err := ic.Query(w, req)
+			if err != nil || w.status != 200 || w.buffer.String() != `{"results":[{}]}` {
+				t.Errorf("wrong response: %d, %s, %v", w.status, w.buffer.String(), err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if queries == 5 {
+		t.Errorf("queries not coalesced")
+	}
+}
+
+func TestInfluxdbClusterQueryCoalescedCancel(t *testing.T) {
+	var queries int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/query" {
+			w.WriteHeader(204)
+			return
+		}
+		atomic.AddInt64(&queries, 1)
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(200)
+		w.Write([]byte(`{"results":[{}]}`))
+	}))
+	defer ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	api, err := NewBackends(cfg, "coalesce_cancel")
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	defer os.Remove("coalesce_cancel.dat")
+	defer os.Remove("coalesce_cancel.rec")
+	ic := NewInfluxCluster(&RedisConfigSource{}, &NodeConfig{CoalesceQueries: true, CoalesceTimeout: time.Second})
+	ic.router = NewRouter(map[string][]BackendAPI{"cpu": {api}}, nil)
+
+	form := url.Values{"db": {"test"}, "q": {"SELECT v FROM cpu WHERE time > now() - 1h"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	leader, _ := http.NewRequest("GET", "/query?"+form.Encode(), nil)
+	leader = leader.WithContext(ctx)
+	lerr := make(chan error, 1)
+	go func() {
+		lerr <- ic.Query(NewDummyResponseWriter(), leader)
+	}()
+	for ic.flights.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the leader is gone, the one joined still gets the response.
+	werr := make(chan error, 1)
+	w := NewDummyResponseWriter()
+	go func() {
+		req, _ := http.NewRequest("GET", "/query?"+form.Encode(), nil)
+		werr <- ic.Query(w, req)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err = <-lerr:
+		if err != ErrQueryCanceled {
+			t.Errorf("leader not canceled: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("leader still waiting")
+	}
+	err = <-werr
+	if err != nil || w.status != 200 || w.buffer.String() != `{"results":[{}]}` {
+		t.Errorf("wrong response: %d, %s, %v", w.status, w.buffer.String(), err)
+	}
+	if queries != 1 {
+		t.Errorf("%d queries", queries)
+	}
+}
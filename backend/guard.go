@@ -0,0 +1,388 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTimeExpr = errors.New("can't evaluate time")
+
+	explainPrefix = regexp.MustCompile(`(?i)^\s*EXPLAIN(\s+ANALYZE)?\s+`)
+)
+
+// GuardError tells which limit of Guard a query hits.
+// Limit is the name of it in node config.
+type GuardError struct {
+	Limit  string
+	Reason string
+}
+
+func (e *GuardError) Error() string {
+	return "query hits " + e.Limit + ": " + e.Reason
+}
+
+// Guard limits the cost of select statements, by their ASTs.
+type Guard struct {
+	RequireTimeBound bool          // a lower bound of time is required
+	MaxTimeRange     time.Duration // upper bound is now if not given
+	MaxPoints        int64         // time range / interval of group by time()
+	ForbidSelectAll  bool          // SELECT * needs LIMIT
+	ForbidGroupByAll bool          // GROUP BY * needs SLIMIT
+	DefaultTimeRange time.Duration // time > now() - it is added if no lower bound
+}
+
+func NewGuard(nodecfg *NodeConfig) (g *Guard) {
+	return &Guard{
+		RequireTimeBound: nodecfg.RequireTimeBound,
+		MaxTimeRange:     nodecfg.MaxTimeRange,
+		MaxPoints:        nodecfg.MaxPoints,
+		ForbidSelectAll:  nodecfg.ForbidSelectAll,
+		ForbidGroupByAll: nodecfg.ForbidGroupByAll,
+		DefaultTimeRange: nodecfg.DefaultTimeRange,
+	}
+}
+
+func (g *Guard) Enabled() bool {
+	return g.RequireTimeBound || g.MaxTimeRange > 0 || g.MaxPoints > 0 ||
+		g.ForbidSelectAll || g.ForbidGroupByAll || g.DefaultTimeRange > 0
+}
+
+// Check checks every select in q. If default time range is added to any
+// of them, s is the query rewritten, or it's q.
+func (g *Guard) Check(q string, now time.Time) (s string, err error) {
+	stmts, err := ParseQuery(q)
+	if err != nil {
+		return g.checkUnparsed(q, now, err)
+	}
+
+	rewritten := false
+	for _, stmt := range stmts {
+		sel, ok := stmt.(*SelectStatement)
+		if !ok {
+			continue
+		}
+		var added bool
+		added, err = g.checkSelect(sel, now)
+		if err != nil {
+			return
+		}
+		rewritten = rewritten || added
+	}
+
+	if !rewritten {
+		return q, nil
+	}
+	l := make([]string, len(stmts))
+	for i, stmt := range stmts {
+		l[i] = stmt.String()
+	}
+	return strings.Join(l, "; "), nil
+}
+
+// checkUnparsed checks statements of q one by one, if the parser doesn't
+// know one of them, and the select explained, which it doesn't know either.
+func (g *Guard) checkUnparsed(q string, now time.Time, perr error) (s string, err error) {
+	parts := SplitStatements(q)
+	if len(parts) > 1 {
+		rewritten := false
+		for i, part := range parts {
+			s, err = g.Check(part, now)
+			if err != nil {
+				return
+			}
+			rewritten = rewritten || s != part
+			parts[i] = s
+		}
+		if !rewritten {
+			return q, nil
+		}
+		return strings.Join(parts, "; "), nil
+	}
+
+	if loc := explainPrefix.FindStringIndex(q); loc != nil {
+		inner := q[loc[1]:]
+		s, err = g.Check(inner, now)
+		if err != nil {
+			return
+		}
+		return q[:loc[1]] + s, nil
+	}
+
+	if StatementType(q) == STMT_SELECT {
+		return "", &GuardError{Limit: "parser", Reason: "can't check the query, " + perr.Error()}
+	}
+	return q, nil
+}
+
+func (g *Guard) checkSelect(s *SelectStatement, now time.Time) (added bool, err error) {
+	if g.ForbidSelectAll && s.Limit == 0 {
+		for _, f := range s.Fields {
+			if _, ok := f.Expr.(*Wildcard); ok {
+				return false, &GuardError{Limit: "forbidselectall", Reason: "SELECT * needs LIMIT"}
+			}
+		}
+	}
+	if g.ForbidGroupByAll && s.SLimit == 0 && groupBySeries(s) {
+		return false, &GuardError{Limit: "forbidgroupbyall", Reason: "GROUP BY * needs SLIMIT"}
+	}
+
+	min, max, err := statementTimeRange(s, now)
+	if err != nil {
+		return false, &GuardError{Limit: "parser", Reason: err.Error()}
+	}
+
+	if min.IsZero() && g.DefaultTimeRange > 0 {
+		bound := &BinaryExpr{
+			Op:  GT,
+			LHS: &VarRef{Val: "time"},
+			RHS: &BinaryExpr{Op: SUB, LHS: &Call{Name: "now"}, RHS: &DurationLiteral{Val: g.DefaultTimeRange}},
+		}
+		if s.Condition == nil {
+			s.Condition = bound
+		} else {
+			s.Condition = &BinaryExpr{Op: AND, LHS: &ParenExpr{Expr: s.Condition}, RHS: bound}
+		}
+		min, added = now.Add(-g.DefaultTimeRange), true
+	}
+
+	if min.IsZero() && g.RequireTimeBound {
+		return added, &GuardError{Limit: "requiretimebound", Reason: "a lower bound of time is required, like time > now() - 1h"}
+	}
+	if max.IsZero() {
+		max = now
+	}
+	// the min and max time of influxdb are as good as none.
+	unbounded := min.IsZero() || !min.After(time.Unix(0, MIN_NANO_TIME)) || !max.Before(time.Unix(0, MAX_NANO_TIME)) ||
+		max.Sub(min) == time.Duration(math.MaxInt64)
+
+	if g.MaxTimeRange > 0 {
+		switch {
+		case unbounded:
+			return added, &GuardError{Limit: "maxtimerange", Reason: "time range is unbounded, at most " + readableDuration(g.MaxTimeRange)}
+		case max.Sub(min) > g.MaxTimeRange:
+			return added, &GuardError{
+				Limit:  "maxtimerange",
+				Reason: "time range " + readableDuration(max.Sub(min)) + " is longer than " + readableDuration(g.MaxTimeRange),
+			}
+		}
+	}
+
+	interval := groupByInterval(s)
+	if g.MaxPoints > 0 && interval > 0 {
+		if unbounded {
+			return added, &GuardError{Limit: "maxpoints", Reason: "time range is unbounded"}
+		}
+		points := int64(max.Sub(min) / interval)
+		if points > g.MaxPoints {
+			return added, &GuardError{
+				Limit: "maxpoints",
+				Reason: strconv.FormatInt(points, 10) + " points of time(" + readableDuration(interval) +
+					") in a series, at most " + strconv.FormatInt(g.MaxPoints, 10),
+			}
+		}
+	}
+	return
+}
+
+// readableDuration is d in seconds, like 1h30m0s, or less if d is.
+func readableDuration(d time.Duration) string {
+	if d >= time.Second {
+		d -= d % time.Second
+	}
+	return d.String()
+}
+
+// groupByInterval returns the interval of GROUP BY time(), or 0.
+func groupByInterval(s *SelectStatement) time.Duration {
+	for _, d := range s.Dimensions {
+		c, ok := d.(*Call)
+		if !ok || c.Name != "time" || len(c.Args) == 0 {
+			continue
+		}
+		if dl, ok := c.Args[0].(*DurationLiteral); ok {
+			return dl.Val
+		}
+	}
+	return 0
+}
+
+// statementTimeRange is time range of s in its condition, and of the
+// subqueries it reads. Zero min or max is unbounded.
+func statementTimeRange(s *SelectStatement, now time.Time) (min, max time.Time, err error) {
+	min, max, err = TimeRange(s.Condition, now)
+	if err != nil {
+		return
+	}
+
+	// rows of sources are in the union of their ranges.
+	var smin, smax time.Time
+	for i, m := range s.Sources {
+		var mmin, mmax time.Time
+		if m.SubQuery != nil {
+			mmin, mmax, err = statementTimeRange(m.SubQuery, now)
+			if err != nil {
+				return
+			}
+		}
+		if i == 0 {
+			smin, smax = mmin, mmax
+			continue
+		}
+		smin, smax = unionRange(smin, smax, mmin, mmax)
+	}
+	min, max = intersectRange(min, max, smin, smax)
+	return
+}
+
+func intersectRange(min1, max1, min2, max2 time.Time) (min, max time.Time) {
+	min, max = min1, max1
+	if min.IsZero() || (!min2.IsZero() && min2.After(min)) {
+		min = min2
+	}
+	if max.IsZero() || (!max2.IsZero() && max2.Before(max)) {
+		max = max2
+	}
+	return
+}
+
+func unionRange(min1, max1, min2, max2 time.Time) (min, max time.Time) {
+	if !min1.IsZero() && !min2.IsZero() {
+		min = min1
+		if min2.Before(min) {
+			min = min2
+		}
+	}
+	if !max1.IsZero() && !max2.IsZero() {
+		max = max1
+		if max2.After(max) {
+			max = max2
+		}
+	}
+	return
+}
+
+// TimeRange finds the bounds of time in cond. Zero min or max is unbounded.
+func TimeRange(cond Expr, now time.Time) (min, max time.Time, err error) {
+	switch e := cond.(type) {
+	case *ParenExpr:
+		return TimeRange(e.Expr, now)
+	case *BinaryExpr:
+		switch e.Op {
+		case AND, OR:
+			var lmin, lmax, rmin, rmax time.Time
+			lmin, lmax, err = TimeRange(e.LHS, now)
+			if err != nil {
+				return
+			}
+			rmin, rmax, err = TimeRange(e.RHS, now)
+			if err != nil {
+				return
+			}
+			if e.Op == AND {
+				min, max = intersectRange(lmin, lmax, rmin, rmax)
+			} else {
+				min, max = unionRange(lmin, lmax, rmin, rmax)
+			}
+			return
+		case EQ, LT, LTE, GT, GTE:
+			return timeCompare(e, now)
+		}
+	}
+	return
+}
+
+func isTimeRef(e Expr) bool {
+	ref, ok := e.(*VarRef)
+	return ok && strings.ToLower(ref.Val) == "time"
+}
+
+func timeCompare(e *BinaryExpr, now time.Time) (min, max time.Time, err error) {
+	op, other := e.Op, e.RHS
+	switch {
+	case isTimeRef(e.LHS):
+	case isTimeRef(e.RHS):
+		other = e.LHS
+		// 1h < time is time > 1h.
+		switch op {
+		case LT:
+			op = GT
+		case LTE:
+			op = GTE
+		case GT:
+			op = LT
+		case GTE:
+			op = LTE
+		}
+	default:
+		return
+	}
+
+	t, err := evalTime(other, now)
+	if err != nil {
+		return
+	}
+	switch op {
+	case EQ:
+		min, max = t, t
+	case GT, GTE:
+		min = t
+	case LT, LTE:
+		max = t
+	}
+	return
+}
+
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999", "2006-01-02"}
+
+func evalTime(e Expr, now time.Time) (t time.Time, err error) {
+	switch n := e.(type) {
+	case *ParenExpr:
+		return evalTime(n.Expr, now)
+	case *Call:
+		if strings.ToLower(n.Name) == "now" && len(n.Args) == 0 {
+			return now, nil
+		}
+	case *StringLiteral:
+		for _, layout := range timeLayouts {
+			t, err = time.Parse(layout, n.Val)
+			if err == nil {
+				return
+			}
+		}
+	case *NumberLiteral:
+		return time.Unix(0, int64(n.Val)).UTC(), nil
+	case *DurationLiteral:
+		return time.Unix(0, int64(n.Val)).UTC(), nil
+	case *BinaryExpr:
+		if n.Op != ADD && n.Op != SUB {
+			break
+		}
+		t, err = evalTime(n.LHS, now)
+		if err != nil {
+			return
+		}
+		var d time.Duration
+		switch r := n.RHS.(type) {
+		case *DurationLiteral:
+			d = r.Val
+		case *NumberLiteral:
+			d = time.Duration(r.Val)
+		default:
+			return t, ErrTimeExpr
+		}
+		if n.Op == SUB {
+			d = -d
+		}
+		return t.Add(d), nil
+	}
+	return t, ErrTimeExpr
+}
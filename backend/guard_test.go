@@ -0,0 +1,137 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeRange(t *testing.T) {
+	now := time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		cond string
+		min  string
+		max  string
+	}{
+		{"time > now() - 1h", "2017-01-01T23:00:00Z", ""},
+		{"host = 'a' AND time >= '2017-01-01T00:00:00Z' AND time < '2017-01-01 12:00:00'", "2017-01-01T00:00:00Z", "2017-01-01T12:00:00Z"},
+		{"now() - 2d < time AND (time > now() - 1d OR host = 'a')", "2016-12-31T00:00:00Z", ""},
+		{"(time > now() - 1h AND host = 'a') OR (time > now() - 2h AND host = 'b')", "2017-01-01T22:00:00Z", ""},
+		{"time > now() - 1h OR host = 'a'", "", ""},
+		{"time > 1483228800000000000 + 1h", "2017-01-01T01:00:00Z", ""},
+	}
+
+	for _, tt := range tests {
+		cond, err := ParseExpr(tt.cond)
+		if err != nil {
+			t.Errorf("%s: %s", tt.cond, err)
+			continue
+		}
+		min, max, err := TimeRange(cond, now)
+		if err != nil {
+			t.Errorf("%s: %s", tt.cond, err)
+			continue
+		}
+		var smin, smax string
+		if !min.IsZero() {
+			smin = min.UTC().Format(time.RFC3339)
+		}
+		if !max.IsZero() {
+			smax = max.UTC().Format(time.RFC3339)
+		}
+		if smin != tt.min || smax != tt.max {
+			t.Errorf("%s: %s, %s", tt.cond, smin, smax)
+		}
+	}
+}
+
+func TestGuard(t *testing.T) {
+	now := time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC)
+	g := &Guard{
+		RequireTimeBound: true,
+		MaxTimeRange:     7 * 24 * time.Hour,
+		MaxPoints:        2000,
+		ForbidSelectAll:  true,
+		ForbidGroupByAll: true,
+	}
+
+	tests := []struct {
+		q     string
+		limit string
+	}{
+		{"SELECT mean(v) FROM cpu WHERE time > now() - 1d GROUP BY time(1m)", ""},
+		{"SELECT v FROM cpu WHERE host = 'a' -- time", "requiretimebound"},
+		{"SELECT v FROM cpu WHERE time > now() - 1h OR true", "requiretimebound"},
+		{"SELECT v FROM cpu WHERE time > now() - 30d", "maxtimerange"},
+		{"SELECT mean(v) FROM cpu WHERE time > now() - 1d GROUP BY time(10s)", "maxpoints"},
+		{"SELECT * FROM cpu WHERE time > now() - 1h", "forbidselectall"},
+		{"SELECT * FROM cpu WHERE time > now() - 1h LIMIT 10", ""},
+		{"SELECT v FROM cpu WHERE time > now() - 1h GROUP BY *", "forbidgroupbyall"},
+		{"SELECT max(v) FROM (SELECT v FROM cpu WHERE time > now() - 1h)", ""},
+		{"SHOW TAG KEYS FROM cpu", ""},
+		{"EXPLAIN SELECT v FROM cpu WHERE time > now() - 30d", "maxtimerange"},
+		{"explain analyze SELECT * FROM cpu WHERE time > now() - 1h", "forbidselectall"},
+		{"EXPLAIN ANALYZE SELECT v FROM cpu WHERE time > now() - 1h", ""},
+		{"SHOW DATABASES; EXPLAIN ANALYZE SELECT v FROM cpu", "requiretimebound"},
+	}
+	for _, tt := range tests {
+		_, err := g.Check(tt.q, now)
+		limit := ""
+		if err != nil {
+			ge, ok := err.(*GuardError)
+			if !ok {
+				t.Errorf("%s: %s", tt.q, err)
+				continue
+			}
+			limit = ge.Limit
+		}
+		if limit != tt.limit {
+			t.Errorf("%s: %v", tt.q, err)
+		}
+	}
+}
+
+func TestGuardDefaultTimeRange(t *testing.T) {
+	g := &Guard{DefaultTimeRange: time.Hour}
+
+	q, err := g.Check("SELECT v FROM cpu WHERE host = 'a' OR host = 'b'; SELECT v FROM mem WHERE time > now() - 1d", time.Now())
+	want := "SELECT v FROM cpu WHERE (host = 'a' OR host = 'b') AND time > now() - 1h; SELECT v FROM mem WHERE time > now() - 1d"
+	if err != nil || q != want {
+		t.Errorf("default time range wrong: %s, %v", q, err)
+	}
+
+	q, err = g.Check("EXPLAIN ANALYZE SELECT v FROM cpu", time.Now())
+	if err != nil || q != "EXPLAIN ANALYZE SELECT v FROM cpu WHERE time > now() - 1h" {
+		t.Errorf("default time range of explain wrong: %s, %v", q, err)
+	}
+
+	q, err = g.Check("SELECT v FROM cpu WHERE time > now() - 1d", time.Now())
+	if err != nil || q != "SELECT v FROM cpu WHERE time > now() - 1d" {
+		t.Errorf("query rewritten: %s, %v", q, err)
+	}
+}
+
+func TestGuardReason(t *testing.T) {
+	now := time.Date(2017, 1, 2, 0, 0, 0, 123456789, time.UTC)
+	g := &Guard{MaxTimeRange: 7 * 24 * time.Hour, MaxPoints: 100}
+
+	tests := []struct {
+		q      string
+		reason string
+	}{
+		{"SELECT v FROM cpu WHERE time > '2016-12-01T00:00:00Z'", "time range 768h0m0s is longer than 168h0m0s"},
+		{"SELECT v FROM cpu WHERE time > '1000-01-01'", "time range is unbounded, at most 168h0m0s"},
+		{"SELECT v FROM cpu WHERE time > '2016-12-24T12:00:00.5Z'", "time range 203h59m59s is longer than 168h0m0s"},
+		{"SELECT mean(v) FROM cpu WHERE time > now() - 1h GROUP BY time(10s)", "360 points of time(10s) in a series, at most 100"},
+	}
+	for _, tt := range tests {
+		_, err := g.Check(tt.q, now)
+		ge, ok := err.(*GuardError)
+		if !ok || ge.Reason != tt.reason {
+			t.Errorf("%s: %v", tt.q, err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrQueryCanceled = errors.New("query canceled")
+)
+
+// Hedger tells when to send a query to the next replica, if the one
+// running hasn't answered.
+type Hedger struct {
+	Delay      time.Duration // fixed delay
+	Percentile float64       // delay at the percentile of latency, Delay until enough reads
+}
+
+func NewHedger(nodecfg *NodeConfig) (h *Hedger) {
+	return &Hedger{
+		Delay:      nodecfg.HedgeDelay,
+		Percentile: nodecfg.HedgePercentile,
+	}
+}
+
+func (h *Hedger) Enabled() bool {
+	return h.Delay > 0 || h.Percentile > 0
+}
+
+// DelayOf is the delay for a read on backend of rs, 0 is never.
+func (h *Hedger) DelayOf(rs *ReadStats) time.Duration {
+	if h.Percentile > 0 {
+		if d, ok := rs.Percentile(h.Percentile); ok {
+			return d
+		}
+	}
+	return h.Delay
+}
+
+type hedgeResult struct {
+	i   int
+	rb  *ResponseBuffer
+	err error
+}
+
+// queryHedged tries cands in order. The next one is sent the query if the
+// last one hasn't answered in its delay or failed. The first answer wins,
+// the others are canceled.
+func (ic *InfluxCluster) queryHedged(w http.ResponseWriter, req *http.Request, cands []BackendAPI) (err error) {
+	results := make(chan *hedgeResult, len(cands))
+	cancels := make([]context.CancelFunc, 0, len(cands))
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+
+	hedged := make([]bool, len(cands))
+	next, running := 0, 0
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	launch := func() {
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels = append(cancels, cancel)
+		r := CloneQueryRequest(req).WithContext(ctx)
+		api, i := cands[next], next
+		go func() {
+			rb := NewResponseBuffer()
+			err := ic.queryBackend(api, rb, r)
+			results <- &hedgeResult{i: i, rb: rb, err: err}
+		}()
+		next++
+		running++
+
+		if timer != nil {
+			timer.Stop()
+		}
+		timer, timeout = nil, nil
+		if next < len(cands) {
+			if d := ic.hedger.DelayOf(ic.balancer.Stats(api)); d > 0 {
+				timer = time.NewTimer(d)
+				timeout = timer.C
+			}
+		}
+	}
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	err = ErrBackendNotExist
+	launch()
+	for running > 0 {
+		select {
+		case r := <-results:
+			running--
+			if r.err == nil {
+				if hedged[r.i] {
+					atomic.AddInt64(&ic.stats.QueryHedgeWins, 1)
+				}
+				r.rb.WriteTo(w)
+				return nil
+			}
+			err = r.err
+			if next < len(cands) {
+				launch()
+			}
+		case <-timeout:
+			hedged[next] = true
+			atomic.AddInt64(&ic.stats.QueryHedges, 1)
+			launch()
+		}
+	}
+	return
+}
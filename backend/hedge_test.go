@@ -0,0 +1,95 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHedgerDelayOf(t *testing.T) {
+	h := &Hedger{Delay: time.Second, Percentile: 90}
+	rs := &ReadStats{}
+	if d := h.DelayOf(rs); d != time.Second {
+		t.Errorf("delay without reads: %s", d)
+	}
+	for i := 1; i <= 20; i++ {
+		rs.observe(time.Duration(i) * time.Millisecond)
+	}
+	if d := h.DelayOf(rs); d != 18*time.Millisecond {
+		t.Errorf("delay at p90: %s", d)
+	}
+}
+
+func TestInfluxdbClusterQueryHedged(t *testing.T) {
+	canceled := make(chan struct{}, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/query" {
+			w.WriteHeader(204)
+			return
+		}
+		select {
+		case <-req.Context().Done():
+			canceled <- struct{}{}
+		case <-time.After(2 * time.Second):
+			w.WriteHeader(200)
+			w.Write([]byte("slow"))
+		}
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	var apis []BackendAPI
+	for i, ts := range []*httptest.Server{slow, fast} {
+		cfg, _ := CreateTestBackendConfig("test")
+		cfg.URL = ts.URL
+		name := "hedge" + strconv.Itoa(i)
+		api, err := NewBackends(cfg, name)
+		if err != nil {
+			t.Errorf("error: %s", err)
+			return
+		}
+		defer os.Remove(name + ".dat")
+		defer os.Remove(name + ".rec")
+		apis = append(apis, api)
+	}
+	ic := NewInfluxCluster(&RedisConfigSource{}, &NodeConfig{HedgeDelay: 50 * time.Millisecond})
+	ic.router = NewRouter(map[string][]BackendAPI{"cpu": apis}, nil)
+
+	form := url.Values{"db": {"test"}, "q": {"SELECT v FROM cpu WHERE time > now() - 1h"}}
+	req, _ := http.NewRequest("GET", "/query?"+form.Encode(), nil)
+	w := NewDummyResponseWriter()
+	start := time.Now()
+	err := ic.Query(w, req)
+	if err != nil || w.status != 200 || w.buffer.String() != "fast" {
+		t.Errorf("wrong response: %d, %s, %v", w.status, w.buffer.String(), err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("hedged query took %s", time.Since(start))
+	}
+	if atomic.LoadInt64(&ic.stats.QueryHedges) != 1 || atomic.LoadInt64(&ic.stats.QueryHedgeWins) != 1 {
+		t.Errorf("%d hedges, %d wins", ic.stats.QueryHedges, ic.stats.QueryHedgeWins)
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Errorf("slow query not canceled")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if !apis[0].IsActive() {
+		t.Errorf("canceled backend set inactive")
+	}
+}
@@ -14,16 +14,45 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	ErrBadRequest = errors.New("Bad Request")
-	ErrNotFound   = errors.New("Not Found")
-	ErrInternal   = errors.New("Internal Error")
-	ErrUnknown    = errors.New("Unknown Error")
+	ErrBadRequest   = errors.New("Bad Request")
+	ErrNotFound     = errors.New("Not Found")
+	ErrUnauthorized = errors.New("Unauthorized")
+	ErrInternal     = errors.New("Internal Error")
+	ErrUnknown      = errors.New("Unknown Error")
 )
 
+// atomicBool is a bool read and written by many goroutines.
+type atomicBool int32
+
+func (b *atomicBool) Get() bool {
+	return atomic.LoadInt32((*int32)(b)) != 0
+}
+
+func (b *atomicBool) Set(v bool) {
+	var i int32
+	if v {
+		i = 1
+	}
+	atomic.StoreInt32((*int32)(b), i)
+}
+
+// CompareAndSwap sets b to new if it's old, and tells if it's set.
+func (b *atomicBool) CompareAndSwap(old, new bool) bool {
+	var o, n int32
+	if old {
+		o = 1
+	}
+	if new {
+		n = 1
+	}
+	return atomic.CompareAndSwapInt32((*int32)(b), o, n)
+}
+
 func Compress(buf *bytes.Buffer, p []byte) (err error) {
 	zip := gzip.NewWriter(buf)
 	n, err := zip.Write(p)
@@ -41,32 +70,42 @@ func Compress(buf *bytes.Buffer, p []byte) (err error) {
 type HttpBackend struct {
 	client    *http.Client
 	transport http.Transport
-	Interval  int
+	Interval  time.Duration
 	URL       string
 	DB        string
+	Databases map[string]string // db of client to db of backend
+	RPs       map[string]string // rp of client to rp of backend
 	Zone      string
-	Active    bool
-	running   bool
-	WriteOnly int
+	Headers   map[string]string
+	Username  string
+	Password  string
+	active    atomicBool
+	running   atomicBool
+	WriteOnly bool
 }
 
 func NewHttpBackend(cfg *BackendConfig) (hb *HttpBackend) {
 	hb = &HttpBackend{
 		client: &http.Client{
-			Timeout: time.Millisecond * time.Duration(cfg.Timeout),
+			Timeout: cfg.Timeout,
 		},
 		// TODO: query timeout? use req.Cancel
 		// client_query: &http.Client{
-		// 	Timeout: time.Millisecond * time.Duration(cfg.TimeoutQuery),
+		// 	Timeout: cfg.TimeoutQuery,
 		// },
 		Interval:  cfg.CheckInterval,
 		URL:       cfg.URL,
 		DB:        cfg.DB,
+		Databases: cfg.Databases,
+		RPs:       cfg.RPs,
 		Zone:      cfg.Zone,
-		Active:    true,
-		running:   true,
+		Headers:   cfg.Headers,
+		Username:  cfg.Username,
+		Password:  cfg.Password,
 		WriteOnly: cfg.WriteOnly,
 	}
+	hb.active.Set(true)
+	hb.running.Set(true)
 	go hb.CheckActive()
 	return
 }
@@ -75,26 +114,73 @@ func NewHttpBackend(cfg *BackendConfig) (hb *HttpBackend) {
 
 func (hb *HttpBackend) CheckActive() {
 	var err error
-	for hb.running {
+	for hb.running.Get() {
 		_, err = hb.Ping()
-		hb.Active = (err == nil)
-		time.Sleep(time.Millisecond * time.Duration(hb.Interval))
+		hb.active.Set(err == nil)
+		time.Sleep(hb.Interval)
 	}
 }
 
 func (hb *HttpBackend) IsWriteOnly() bool {
-	if hb.WriteOnly == 0 {
-		return false
-	}
-	return true
+	return hb.WriteOnly
 }
 
 func (hb *HttpBackend) IsActive() bool {
-	return hb.Active
+	return hb.active.Get()
+}
+
+// setHeaders adds the extra headers and credentials configured for this backend.
+func (hb *HttpBackend) setHeaders(req *http.Request) {
+	for k, v := range hb.Headers {
+		req.Header.Set(k, v)
+	}
+	if hb.Username != "" {
+		req.SetBasicAuth(hb.Username, hb.Password)
+	}
+}
+
+// Database maps db of client to db of this backend.
+// Dbs not in Databases go to DB, or keep their names if DB is empty.
+func (hb *HttpBackend) Database(db string) string {
+	if mapped, ok := hb.Databases[db]; ok {
+		return mapped
+	}
+	if hb.DB != "" {
+		return hb.DB
+	}
+	return db
+}
+
+// RetentionPolicy maps rp of client to rp of this backend.
+func (hb *HttpBackend) RetentionPolicy(rp string) string {
+	if mapped, ok := hb.RPs[rp]; ok {
+		return mapped
+	}
+	return rp
+}
+
+// rewriteQuery renames db and rp qualifiers in q to the ones of this backend.
+func (hb *HttpBackend) rewriteQuery(q string) string {
+	if hb.DB == "" && len(hb.Databases) == 0 && len(hb.RPs) == 0 {
+		return q
+	}
+	s, err := RewriteQualifiers(q, hb.Database, hb.RetentionPolicy)
+	if err != nil {
+		// the parser doesn't know it, let backend tell.
+		return q
+	}
+	return s
 }
 
 func (hb *HttpBackend) Ping() (version string, err error) {
-	resp, err := hb.client.Get(hb.URL + "/ping")
+	req, err := http.NewRequest("GET", hb.URL+"/ping", nil)
+	if err != nil {
+		log.Print("internal request error: ", err)
+		return
+	}
+	hb.setHeaders(req)
+
+	resp, err := hb.client.Do(req)
 	if err != nil {
 		log.Print("http error: ", err)
 		return
@@ -135,20 +221,38 @@ func (hb *HttpBackend) Query(w http.ResponseWriter, req *http.Request) (err erro
 	if len(req.Form) == 0 {
 		req.Form = url.Values{}
 	}
-	req.Form.Set("db", hb.DB)
+	// req goes to other backends if this one fails, leave its form alone.
+	form := url.Values{}
+	for k, v := range req.Form {
+		form[k] = v
+	}
+	form.Set("db", hb.Database(req.Form.Get("db")))
+	if rp := req.Form.Get("rp"); rp != "" {
+		form.Set("rp", hb.RetentionPolicy(rp))
+	}
+	form.Set("q", hb.rewriteQuery(req.Form.Get("q")))
+	if hb.Username != "" {
+		form.Del("u")
+		form.Del("p")
+	}
 	req.ContentLength = 0
 
-	req.URL, err = url.Parse(hb.URL + "/query?" + req.Form.Encode())
+	req.URL, err = url.Parse(hb.URL + "/query?" + form.Encode())
 	if err != nil {
 		log.Print("internal url parse error: ", err)
 		return
 	}
 
+	hb.setHeaders(req)
+
 	q := strings.TrimSpace(req.FormValue("q"))
 	resp, err := hb.transport.RoundTrip(req)
 	if err != nil {
 		log.Printf("query error: %s,the query is %s\n", err, q)
-		hb.Active = false
+		// canceled by client or proxy, backend is fine.
+		if req.Context().Err() == nil {
+			hb.active.Set(false)
+		}
 		return
 	}
 	defer resp.Body.Close()
@@ -166,7 +270,7 @@ func (hb *HttpBackend) Query(w http.ResponseWriter, req *http.Request) (err erro
 	return
 }
 
-func (hb *HttpBackend) Write(p []byte) (err error) {
+func (hb *HttpBackend) Write(p []byte, params *WriteParams) (err error) {
 	var buf bytes.Buffer
 	err = Compress(&buf, p)
 	if err != nil {
@@ -175,21 +279,38 @@ func (hb *HttpBackend) Write(p []byte) (err error) {
 	}
 
 	log.Printf("http backend write %s", hb.DB)
-	err = hb.WriteStream(&buf, true)
+	err = hb.WriteStream(&buf, true, params)
 	return
 }
 
-func (hb *HttpBackend) WriteCompressed(p []byte) (err error) {
+func (hb *HttpBackend) WriteCompressed(p []byte, params *WriteParams) (err error) {
 	buf := bytes.NewBuffer(p)
-	err = hb.WriteStream(buf, true)
+	err = hb.WriteStream(buf, true, params)
 	return
 }
 
-func (hb *HttpBackend) WriteStream(stream io.Reader, compressed bool) (err error) {
-	q := url.Values{}
-	q.Set("db", hb.DB)
+// WriteStream sends points to backend, with db and rp mapped, precision and
+// consistency of params. Credentials of client are sent in basic auth,
+// unless this backend has its own.
+func (hb *HttpBackend) WriteStream(stream io.Reader, compressed bool, params *WriteParams) (err error) {
+	if params == nil {
+		params = &WriteParams{}
+	}
+	q := params.Values()
+	q.Set("db", hb.Database(params.DB))
+	if params.RP != "" {
+		q.Set("rp", hb.RetentionPolicy(params.RP))
+	}
 
 	req, err := http.NewRequest("POST", hb.URL+"/write?"+q.Encode(), stream)
+	if err != nil {
+		log.Print("internal request error: ", err)
+		return
+	}
+	if params.User != "" {
+		req.SetBasicAuth(params.User, params.Password)
+	}
+	hb.setHeaders(req)
 	if compressed {
 		req.Header.Add("Content-Encoding", "gzip")
 	}
@@ -197,7 +318,7 @@ func (hb *HttpBackend) WriteStream(stream io.Reader, compressed bool) (err error
 	resp, err := hb.client.Do(req)
 	if err != nil {
 		log.Print("http error: ", err)
-		hb.Active = false
+		hb.active.Set(false)
 		return
 	}
 	defer resp.Body.Close()
@@ -221,6 +342,8 @@ func (hb *HttpBackend) WriteStream(stream io.Reader, compressed bool) (err error
 		err = ErrBadRequest
 	case 404:
 		err = ErrNotFound
+	case 401, 403:
+		err = ErrUnauthorized
 	default: // mostly tcp connection timeout
 		log.Printf("status: %d", resp.StatusCode)
 		err = ErrUnknown
@@ -229,7 +352,7 @@ func (hb *HttpBackend) WriteStream(stream io.Reader, compressed bool) (err error
 }
 
 func (hb *HttpBackend) Close() (err error) {
-	hb.running = false
+	hb.running.Set(false)
 	hb.transport.CloseIdleConnections()
 	return
 }
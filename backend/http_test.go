@@ -11,6 +11,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 )
 
 func HandlerAny(w http.ResponseWriter, req *http.Request) {
@@ -26,12 +27,12 @@ func CreateTestBackendConfig(dbname string) (cfg *BackendConfig, ts *httptest.Se
 	cfg = &BackendConfig{
 		URL:             ts.URL,
 		DB:              dbname,
-		Interval:        200,
-		Timeout:         4000,
-		TimeoutQuery:    6000,
+		Interval:        200 * time.Millisecond,
+		Timeout:         4 * time.Second,
+		TimeoutQuery:    6 * time.Second,
 		MaxRowLimit:     1000,
-		CheckInterval:   1000,
-		RewriteInterval: 1000,
+		CheckInterval:   time.Second,
+		RewriteInterval: time.Second,
 	}
 	return
 }
@@ -42,7 +43,7 @@ func TestHttpBackendWrite(t *testing.T) {
 	hb := NewHttpBackend(cfg)
 	defer hb.Close()
 
-	err := hb.Write([]byte("cpu,host=server01,region=uswest value=1 1434055562000000000\ncpu value=3,value2=4 1434055562000010000"))
+	err := hb.Write([]byte("cpu,host=server01,region=uswest value=1 1434055562000000000\ncpu value=3,value2=4 1434055562000010000"), &WriteParams{})
 	if err != nil {
 		t.Errorf("error: %s", err)
 		return
@@ -63,7 +64,7 @@ func TestHttpBackendWriteCompressed(t *testing.T) {
 		return
 	}
 	p = buf.Bytes()
-	err = hb.WriteCompressed(p)
+	err = hb.WriteCompressed(p, &WriteParams{})
 	if err != nil {
 		t.Errorf("error: %s", err)
 		return
@@ -142,3 +143,64 @@ func TestHttpBackendQuery(t *testing.T) {
 		return
 	}
 }
+
+func TestHttpBackendDatabase(t *testing.T) {
+	hb := &HttpBackend{Databases: map[string]string{"team_a": "a"}}
+	if hb.Database("team_a") != "a" || hb.Database("team_b") != "team_b" {
+		t.Errorf("database not mapped")
+	}
+
+	hb.DB = "test"
+	if hb.Database("team_a") != "a" || hb.Database("team_b") != "test" {
+		t.Errorf("database not mapped")
+	}
+}
+
+func TestHttpBackendRewrite(t *testing.T) {
+	var got []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer req.Body.Close()
+		got = append(got, req.URL.RawQuery)
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	hb := &HttpBackend{
+		client:    &http.Client{},
+		URL:       ts.URL,
+		Databases: map[string]string{"team_a": "a"},
+		RPs:       map[string]string{"raw": "hot"},
+	}
+
+	q := url.Values{}
+	q.Set("db", "team_a")
+	q.Set("q", "SELECT v FROM team_a.raw.cpu WHERE time > 0")
+	req, err := http.NewRequest("GET", ts.URL+"/query?"+q.Encode(), nil)
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	req.ParseForm()
+	err = hb.Query(NewDummyResponseWriter(), req)
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+
+	err = hb.Write([]byte("cpu value=1"), &WriteParams{DB: "team_a", RP: "raw"})
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+
+	want := []string{
+		"db=a&q=SELECT+v+FROM+a.hot.cpu+WHERE+time+%3E+0",
+		"db=a&rp=hot",
+	}
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("rewrite wrong: %q", got)
+	}
+	if req.Form.Get("db") != "team_a" {
+		t.Errorf("form of client changed")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"errors"
 	"log"
+	"sort"
 	"strings"
 )
 
@@ -139,6 +140,128 @@ func GetMeasurementFromInfluxQL(q string) (m string, err error) {
 	return "", ErrIllegalQL
 }
 
+// GetRouteKeyFromInfluxQL finds the measurement, db, rp and tag conditions of
+// the first statement. Statements the parser can't read fall back to
+// GetMeasurementFromInfluxQL.
+func GetRouteKeyFromInfluxQL(q string) (rk *RouteKey, err error) {
+	stmts, err := ParseQuery(q)
+	if err != nil || len(stmts) == 0 {
+		var m string
+		m, err = GetMeasurementFromInfluxQL(q)
+		if err != nil {
+			return
+		}
+		return &RouteKey{Measurement: m}, nil
+	}
+
+	var sources []*Measurement
+	var cond Expr
+	switch stmt := stmts[0].(type) {
+	case *SelectStatement:
+		sources, cond = stmt.Sources, stmt.Condition
+	case *ShowStatement:
+		sources, cond = stmt.Sources, stmt.Condition
+	}
+	if len(sources) == 0 {
+		return nil, ErrIllegalQL
+	}
+
+	tags, err := TagConditions(cond)
+	if err != nil {
+		return
+	}
+	rk = &RouteKey{Tags: tags}
+	m := sources[0]
+	for m.SubQuery != nil {
+		tags, err = TagConditions(m.SubQuery.Condition)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range tags {
+			err = addTagCondition(rk.Tags, k, v)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(m.SubQuery.Sources) == 0 {
+			return nil, ErrIllegalQL
+		}
+		m = m.SubQuery.Sources[0]
+	}
+
+	rk.DB = m.Database
+	rk.RP = m.RetentionPolicy
+	rk.Measurement = m.Name
+	if m.Regex != nil {
+		rk.Measurement = m.Regex.String()
+	}
+	return
+}
+
+type splice struct {
+	pos  int
+	end  int
+	text string
+}
+
+// RewriteQualifiers renames the db and rp of sources, and the db of
+// SHOW ... ON, by db and rp. The rest of q is kept as it is.
+func RewriteQualifiers(q string, db func(string) string, rp func(string) string) (s string, err error) {
+	stmts, err := ParseQuery(q)
+	if err != nil {
+		return
+	}
+
+	var splices []splice
+	var walk func(sources []*Measurement)
+	walk = func(sources []*Measurement) {
+		for _, m := range sources {
+			if m.SubQuery != nil {
+				walk(m.SubQuery.Sources)
+				continue
+			}
+			if m.End <= m.Pos {
+				continue
+			}
+			n := *m
+			if n.Database != "" {
+				n.Database = db(n.Database)
+			}
+			if n.RetentionPolicy != "" {
+				n.RetentionPolicy = rp(n.RetentionPolicy)
+			}
+			if n.Database != m.Database || n.RetentionPolicy != m.RetentionPolicy {
+				splices = append(splices, splice{m.Pos, m.End, n.String()})
+			}
+		}
+	}
+
+	for _, stmt := range stmts {
+		switch stmt := stmt.(type) {
+		case *SelectStatement:
+			walk(stmt.Sources)
+		case *ShowStatement:
+			walk(stmt.Sources)
+			if stmt.Database != "" && stmt.DBEnd > stmt.DBPos {
+				name := db(stmt.Database)
+				if name != stmt.Database {
+					splices = append(splices, splice{stmt.DBPos, stmt.DBEnd, QuoteIdent(name)})
+				}
+			}
+		}
+	}
+
+	// from the end, so positions before are still right.
+	sort.Slice(splices, func(i, j int) bool {
+		return splices[i].pos > splices[j].pos
+	})
+	s = q
+	for _, sp := range splices {
+		s = s[:sp.pos] + sp.text + s[sp.end:]
+	}
+	return
+}
+
 func getMeasurement(tokens []string) (m string) {
 	if len(tokens) >= 2 && strings.HasPrefix(tokens[1], ".") {
 		m = tokens[1]
@@ -111,3 +111,99 @@ func BenchmarkInfluxQL(b *testing.B) {
 		}
 	}
 }
+
+func TestGetRouteKeyFromInfluxQL(t *testing.T) {
+	tests := []struct {
+		q    string
+		db   string
+		rp   string
+		m    string
+		tags map[string]string
+	}{
+		{"SELECT v FROM cpu WHERE tenant = 'foo' AND time > now() - 1h", "", "", "cpu",
+			map[string]string{"tenant": "foo"}},
+		{"SELECT v FROM \"db\".\"rp\".\"cpu.load\"", "db", "rp", "cpu.load", map[string]string{}},
+		{"SELECT max(v) FROM (SELECT mean(v) AS v FROM cpu WHERE tenant = 'foo' GROUP BY host)", "", "", "cpu",
+			map[string]string{"tenant": "foo"}},
+		{"SHOW TAG KEYS FROM cpu WHERE tenant = 'bar'", "", "", "cpu", map[string]string{"tenant": "bar"}},
+		{"SELECT v FROM /cpu.*/", "", "", "/cpu.*/", map[string]string{}},
+		{"DELETE FROM \"cpu\" WHERE time < '2000-01-01T00:00:00Z'", "", "", "cpu", nil},
+	}
+
+	for _, tt := range tests {
+		rk, err := GetRouteKeyFromInfluxQL(tt.q)
+		if err != nil {
+			t.Errorf("%s: %s", tt.q, err)
+			continue
+		}
+		if rk.DB != tt.db || rk.RP != tt.rp || rk.Measurement != tt.m || len(rk.Tags) != len(tt.tags) {
+			t.Errorf("%s: %#v", tt.q, rk)
+			continue
+		}
+		for k, v := range tt.tags {
+			if rk.Tags[k] != v {
+				t.Errorf("%s: %#v", tt.q, rk)
+			}
+		}
+	}
+}
+
+func TestGetRouteKeyConflictTags(t *testing.T) {
+	for _, q := range []string{
+		"SELECT v FROM cpu WHERE tenant = 'foo' AND tenant = 'bar'",
+		"SELECT max(v) FROM (SELECT v FROM cpu WHERE tenant = 'foo') WHERE tenant = 'bar'",
+	} {
+		_, err := GetRouteKeyFromInfluxQL(q)
+		if err != ErrConflictTags {
+			t.Errorf("%s: %v", q, err)
+		}
+	}
+}
+
+func TestRewriteQualifiers(t *testing.T) {
+	db := func(s string) string {
+		if s == "team_a" {
+			return "a"
+		}
+		return s
+	}
+	rp := func(s string) string {
+		if s == "raw" {
+			return "hot"
+		}
+		return s
+	}
+
+	tests := []struct {
+		q    string
+		want string
+	}{
+		{
+			q:    "SELECT v FROM \"team_a\".\"raw\".\"cpu\" WHERE time > now() - 1h",
+			want: "SELECT v FROM a.hot.cpu WHERE time > now() - 1h",
+		},
+		{
+			q:    "select max(v) from (select v from team_a..cpu, raw.mem) where time > 0; select v from team_b.raw./cpu.*/",
+			want: "select max(v) from (select v from a..cpu, hot.mem) where time > 0; select v from team_b.hot./cpu.*/",
+		},
+		{
+			q:    "SHOW TAG KEYS ON team_a FROM \"1d\".cpu",
+			want: "SHOW TAG KEYS ON a FROM \"1d\".cpu",
+		},
+		{
+			q:    "SELECT v FROM cpu WHERE time > 0",
+			want: "SELECT v FROM cpu WHERE time > 0",
+		},
+	}
+
+	for _, tt := range tests {
+		s, err := RewriteQualifiers(tt.q, db, rp)
+		if err != nil {
+			t.Errorf("%s: %s", tt.q, err)
+			continue
+		}
+		if s != tt.want {
+			t.Errorf("%s:\n%s\n%s", tt.q, s, tt.want)
+		}
+	}
+}
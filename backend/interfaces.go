@@ -16,6 +16,13 @@ type BackendAPI interface {
 	IsWriteOnly() (b bool)
 	Ping() (version string, err error)
 	GetZone() (zone string)
-	Write(p []byte) (err error)
+	Write(p []byte, params *WriteParams) (err error)
 	Close() (err error)
 }
+
+// AckWriter is a backend that can tell when a write is safe,
+// for ACK_DURABLE and ACK_QUORUM.
+type AckWriter interface {
+	WriteDurable(p []byte, params *WriteParams) (err error)
+	WriteConfirmed(p []byte, params *WriteParams) (ack <-chan error, err error)
+}
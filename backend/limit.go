@@ -0,0 +1,293 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	LIMIT_IP   = "ip"
+	LIMIT_USER = "user"
+	LIMIT_DB   = "db"
+)
+
+const (
+	// states of clients not seen for it are dropped.
+	limitIdle     = 10 * time.Minute
+	limitSweepGap = time.Minute
+)
+
+// LimitError tells which limit a client hits, and when to retry.
+type LimitError struct {
+	Limit      string
+	Resource   string
+	Client     string
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return "limited by " + e.Limit + " on " + e.Resource + " of " + e.Client +
+		", retry after " + strconv.Itoa(e.RetryAfterSeconds()) + "s"
+}
+
+// RetryAfterSeconds is RetryAfter rounded up, for the Retry-After header.
+func (e *LimitError) RetryAfterSeconds() int {
+	s := int((e.RetryAfter + time.Second - 1) / time.Second)
+	if s < 1 {
+		s = 1
+	}
+	return s
+}
+
+// Client is who sends a request, limits are keyed by one of them.
+type Client struct {
+	IP   string
+	User string
+	DB   string
+}
+
+// NewClient finds the client of req. User is of policy if auth is enabled,
+// or empty, since credentials not checked can be anyone's.
+func NewClient(req *http.Request, db string, policy *Policy) (c *Client) {
+	c = &Client{IP: req.RemoteAddr, DB: db}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		c.IP = host
+	}
+	if policy != nil {
+		c.User = policy.User
+	}
+	return
+}
+
+// value of c by key, a client without user is limited by ip.
+func (c *Client) value(key string) string {
+	switch key {
+	case LIMIT_USER:
+		if c.User != "" {
+			return c.User
+		}
+	case LIMIT_DB:
+		return c.DB
+	}
+	return c.IP
+}
+
+// TokenBucket gets Rate tokens a second, holds Capacity at most.
+type TokenBucket struct {
+	Rate     float64
+	Capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func NewTokenBucket(rate float64, burst time.Duration, now time.Time) (tb *TokenBucket) {
+	capacity := rate * burst.Seconds()
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &TokenBucket{Rate: rate, Capacity: capacity, tokens: capacity, last: now}
+}
+
+// Wait is how long until n tokens can be taken. n more than capacity
+// can be taken when the bucket is full, the tokens owed delay the next.
+func (tb *TokenBucket) Wait(n float64, now time.Time) time.Duration {
+	if now.After(tb.last) {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.Rate
+		if tb.tokens > tb.Capacity {
+			tb.tokens = tb.Capacity
+		}
+		tb.last = now
+	}
+	if n > tb.Capacity {
+		n = tb.Capacity
+	}
+	if tb.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - tb.tokens) / tb.Rate * float64(time.Second))
+}
+
+func (tb *TokenBucket) Take(n float64) {
+	tb.tokens -= n
+}
+
+type limitRule struct {
+	Name  string
+	cfg   *LimitConfig
+	match *regexp.Regexp
+}
+
+type limitState struct {
+	points  *TokenBucket
+	bytes   *TokenBucket
+	queries *TokenBucket
+	running int
+	used    time.Time
+}
+
+// Limiter limits writes and queries of clients by LimitConfigs.
+// Every client matches a rule has its own buckets of the rule.
+type Limiter struct {
+	lock   sync.Mutex
+	rules  []*limitRule
+	states map[string]*limitState // by name of rule and client
+	swept  time.Time
+}
+
+func NewLimiter(cfgs map[string]*LimitConfig) (l *Limiter, err error) {
+	l = &Limiter{states: make(map[string]*limitState)}
+	for name, cfg := range cfgs {
+		rule := &limitRule{Name: name, cfg: cfg}
+		rule.match, err = regexp.Compile(GlobToRegexp(cfg.Match))
+		if err != nil {
+			return
+		}
+		l.rules = append(l.rules, rule)
+	}
+	sort.Slice(l.rules, func(i, j int) bool { return l.rules[i].Name < l.rules[j].Name })
+	return
+}
+
+func (l *Limiter) Enabled() bool {
+	return len(l.rules) != 0
+}
+
+// state of c in rule, nil if rule doesn't match c.
+func (l *Limiter) state(rule *limitRule, c *Client, now time.Time) (st *limitState, client string) {
+	v := c.value(rule.cfg.Key)
+	if !rule.match.MatchString(v) {
+		return nil, ""
+	}
+	client = rule.cfg.Key + " " + QuoteString(v)
+	key := rule.Name + "\n" + v
+	st, ok := l.states[key]
+	if !ok {
+		cfg := rule.cfg
+		st = &limitState{}
+		if cfg.WritePoints > 0 {
+			st.points = NewTokenBucket(cfg.WritePoints, cfg.Burst, now)
+		}
+		if cfg.WriteBytes > 0 {
+			st.bytes = NewTokenBucket(cfg.WriteBytes, cfg.Burst, now)
+		}
+		if cfg.Queries > 0 {
+			st.queries = NewTokenBucket(cfg.Queries, cfg.Burst, now)
+		}
+		l.states[key] = st
+	}
+	st.used = now
+	return
+}
+
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < limitSweepGap {
+		return
+	}
+	l.swept = now
+	for key, st := range l.states {
+		if st.running == 0 && now.Sub(st.used) > limitIdle {
+			delete(l.states, key)
+		}
+	}
+}
+
+// AllowWrite takes tokens of points and bytes from every rule matches c,
+// or none of them if any rule is hit.
+func (l *Limiter) AllowWrite(c *Client, points int64, nbytes int64, now time.Time) (err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.sweep(now)
+
+	var took []*limitState
+	for _, rule := range l.rules {
+		st, client := l.state(rule, c, now)
+		if st == nil {
+			continue
+		}
+		if st.points != nil {
+			if d := st.points.Wait(float64(points), now); d > 0 {
+				return &LimitError{Limit: rule.Name, Resource: "write points", Client: client, RetryAfter: d}
+			}
+		}
+		if st.bytes != nil {
+			if d := st.bytes.Wait(float64(nbytes), now); d > 0 {
+				return &LimitError{Limit: rule.Name, Resource: "write bytes", Client: client, RetryAfter: d}
+			}
+		}
+		took = append(took, st)
+	}
+	for _, st := range took {
+		if st.points != nil {
+			st.points.Take(float64(points))
+		}
+		if st.bytes != nil {
+			st.bytes.Take(float64(nbytes))
+		}
+	}
+	return
+}
+
+// BeginQuery takes a token of queries and a slot of concurrent queries from
+// every rule matches c. done must be called when the query ends.
+func (l *Limiter) BeginQuery(c *Client, now time.Time) (done func(), err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.sweep(now)
+
+	var took []*limitState
+	for _, rule := range l.rules {
+		st, client := l.state(rule, c, now)
+		if st == nil {
+			continue
+		}
+		if st.queries != nil {
+			if d := st.queries.Wait(1, now); d > 0 {
+				return nil, &LimitError{Limit: rule.Name, Resource: "queries", Client: client, RetryAfter: d}
+			}
+		}
+		if rule.cfg.Concurrent > 0 && st.running >= rule.cfg.Concurrent {
+			return nil, &LimitError{Limit: rule.Name, Resource: "concurrent queries", Client: client, RetryAfter: time.Second}
+		}
+		took = append(took, st)
+	}
+
+	for _, st := range took {
+		if st.queries != nil {
+			st.queries.Take(1)
+		}
+		st.running++
+	}
+	return func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		for _, st := range took {
+			st.running--
+		}
+	}, nil
+}
+
+// CountLines is the number of points in p, in line protocol.
+func CountLines(p []byte) (n int64) {
+	for len(p) != 0 {
+		var line []byte
+		if i := bytes.IndexByte(p, '\n'); i != -1 {
+			line, p = p[:i], p[i+1:]
+		} else {
+			line, p = p, nil
+		}
+		if len(bytes.TrimSpace(line)) != 0 {
+			n++
+		}
+	}
+	return
+}
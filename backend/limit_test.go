@@ -0,0 +1,132 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	tb := NewTokenBucket(10, time.Second, now)
+	if d := tb.Wait(10, now); d != 0 {
+		t.Errorf("full bucket waits %s", d)
+	}
+	tb.Take(10)
+	if d := tb.Wait(5, now); d != 500*time.Millisecond {
+		t.Errorf("empty bucket waits %s", d)
+	}
+	if d := tb.Wait(5, now.Add(500*time.Millisecond)); d != 0 {
+		t.Errorf("refilled bucket waits %s", d)
+	}
+
+	// more than capacity passes a full bucket, and delays the next.
+	tb = NewTokenBucket(10, time.Second, now)
+	if d := tb.Wait(30, now); d != 0 {
+		t.Errorf("full bucket waits %s", d)
+	}
+	tb.Take(30)
+	if d := tb.Wait(1, now.Add(time.Second)); d != 1100*time.Millisecond {
+		t.Errorf("bucket in debt waits %s", d)
+	}
+}
+
+func TestLimiterWrite(t *testing.T) {
+	l, err := NewLimiter(map[string]*LimitConfig{
+		"points": {Key: LIMIT_DB, Match: "test*", WritePoints: 100, Burst: time.Second},
+		"bytes":  {Key: LIMIT_IP, Match: "*", WriteBytes: 1000, Burst: time.Second},
+	})
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	now := time.Now()
+	c := &Client{IP: "10.0.0.1", DB: "test"}
+
+	err = l.AllowWrite(c, 100, 500, now)
+	if err != nil {
+		t.Errorf("error: %s", err)
+	}
+	err = l.AllowWrite(c, 10, 10, now)
+	le, ok := err.(*LimitError)
+	if !ok || le.Limit != "points" || le.Resource != "write points" || le.RetryAfter != 100*time.Millisecond {
+		t.Errorf("points not limited: %v", err)
+	}
+
+	// other db, same ip.
+	err = l.AllowWrite(&Client{IP: "10.0.0.1", DB: "other"}, 10, 600, now)
+	le, ok = err.(*LimitError)
+	if !ok || le.Limit != "bytes" || le.Client != "ip '10.0.0.1'" || le.RetryAfterSeconds() != 1 {
+		t.Errorf("bytes not limited: %v", err)
+	}
+	err = l.AllowWrite(&Client{IP: "10.0.0.2", DB: "other"}, 10, 600, now)
+	if err != nil {
+		t.Errorf("error: %s", err)
+	}
+}
+
+func TestLimiterQuery(t *testing.T) {
+	l, err := NewLimiter(map[string]*LimitConfig{
+		"analyst": {Key: LIMIT_USER, Match: "*", Queries: 2, Concurrent: 1, Burst: 2 * time.Second},
+	})
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	now := time.Now()
+	c := &Client{User: "alice"}
+
+	done, err := l.BeginQuery(c, now)
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	_, err = l.BeginQuery(c, now)
+	if le, ok := err.(*LimitError); !ok || le.Resource != "concurrent queries" {
+		t.Errorf("concurrent queries not limited: %v", err)
+	}
+	_, err = l.BeginQuery(&Client{User: "bob"}, now)
+	if err != nil {
+		t.Errorf("error: %s", err)
+	}
+	done()
+
+	for i := 0; i < 3; i++ {
+		done, err = l.BeginQuery(c, now)
+		if err != nil {
+			t.Errorf("error: %s", err)
+			return
+		}
+		done()
+	}
+	_, err = l.BeginQuery(c, now)
+	if le, ok := err.(*LimitError); !ok || le.Resource != "queries" || le.RetryAfter != 500*time.Millisecond {
+		t.Errorf("queries not limited: %v", err)
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/query?u=alice&p=secret", nil)
+	req.RemoteAddr = "10.0.0.1:5678"
+	c := NewClient(req, "test", nil)
+	if c.IP != "10.0.0.1" || c.User != "" || c.DB != "test" {
+		t.Errorf("wrong client: %v", c)
+	}
+	if c.value(LIMIT_USER) != "10.0.0.1" {
+		t.Errorf("user of unchecked credentials: %s", c.value(LIMIT_USER))
+	}
+	c = NewClient(req, "test", &Policy{User: "bob"})
+	if c.User != "bob" || c.value(LIMIT_USER) != "bob" {
+		t.Errorf("wrong client: %v", c)
+	}
+}
+
+func TestCountLines(t *testing.T) {
+	if n := CountLines([]byte("cpu v=1\n\ncpu v=2\r\n  \ncpu v=3")); n != 3 {
+		t.Errorf("%d lines", n)
+	}
+}
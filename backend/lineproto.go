@@ -0,0 +1,290 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	FIELD_FLOAT = iota + 1
+	FIELD_INTEGER
+	FIELD_UNSIGNED
+	FIELD_STRING
+	FIELD_BOOLEAN
+)
+
+var fieldTypeNames = map[int]string{
+	FIELD_FLOAT:    "float",
+	FIELD_INTEGER:  "integer",
+	FIELD_UNSIGNED: "unsigned",
+	FIELD_STRING:   "string",
+	FIELD_BOOLEAN:  "boolean",
+}
+
+// same as influxdb, the min and max are kept for special use.
+const (
+	MIN_NANO_TIME = int64(math.MinInt64) + 2
+	MAX_NANO_TIME = int64(math.MaxInt64) - 1
+)
+
+var (
+	ErrMissingMeasurement = errors.New("missing measurement")
+	ErrMissingTagKey      = errors.New("missing tag key")
+	ErrMissingTagValue    = errors.New("missing tag value")
+	ErrMissingFields      = errors.New("missing fields")
+	ErrMissingFieldKey    = errors.New("missing field key")
+	ErrMissingFieldValue  = errors.New("missing field value")
+	ErrInvalidNumber      = errors.New("invalid number")
+	ErrInvalidFieldValue  = errors.New("invalid field value")
+	ErrUnbalancedQuotes   = errors.New("unbalanced quotes")
+	ErrBadTimestamp       = errors.New("bad timestamp")
+	ErrTimeOutOfRange     = errors.New("time outside range")
+)
+
+// LineError is a line rejected, in the message format of influxdb.
+type LineError struct {
+	Line   []byte
+	Reason string
+}
+
+func (e *LineError) Error() string {
+	return "unable to parse '" + string(e.Line) + "': " + e.Reason
+}
+
+// PartialWriteError tells client which lines are dropped.
+// If some lines are written, it's a partial write like influxdb says.
+type PartialWriteError struct {
+	Errors  []string
+	Dropped int
+	Written int
+}
+
+func (e *PartialWriteError) Error() string {
+	reason := strings.Join(e.Errors, "\n")
+	if e.Written == 0 {
+		return reason
+	}
+	return "partial write: " + reason + " dropped=" + strconv.Itoa(e.Dropped)
+}
+
+// LinePoint is what ParseLine reads from a line.
+type LinePoint struct {
+	Measurement string
+	Fields      map[string]int // key to FIELD_* type
+	Time        int64
+	HasTime     bool
+}
+
+// PrecisionFactor returns nanoseconds of a unit of precision.
+func PrecisionFactor(precision string) int64 {
+	switch precision {
+	case "u":
+		return 1000
+	case "ms":
+		return 1000000
+	case "s":
+		return 1000000000
+	case "m":
+		return 60 * 1000000000
+	case "h":
+		return 3600 * 1000000000
+	}
+	return 1
+}
+
+// scanTo returns the position of the first byte in stops from i, not escaped.
+func scanTo(line []byte, i int, stops string) int {
+	for ; i < len(line); i++ {
+		switch {
+		case line[i] == '\\':
+			i++
+		case strings.IndexByte(stops, line[i]) != -1:
+			return i
+		}
+	}
+	return len(line)
+}
+
+func unescape(b []byte) string {
+	if bytes.IndexByte(b, '\\') == -1 {
+		return string(b)
+	}
+	buf := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] == '\\' && i+1 < len(b) {
+			i++
+		}
+		buf = append(buf, b[i])
+	}
+	return string(buf)
+}
+
+// ParseLine checks the syntax of a line, in line protocol of influxdb.
+func ParseLine(line []byte, precision string) (lp *LinePoint, err error) {
+	lp = &LinePoint{Fields: make(map[string]int)}
+	n := len(line)
+
+	i := scanTo(line, 0, ", ")
+	if i == 0 {
+		return nil, ErrMissingMeasurement
+	}
+	lp.Measurement = unescape(line[:i])
+
+	for i < n && line[i] == ',' {
+		k := scanTo(line, i+1, "=, ")
+		if k == i+1 {
+			return nil, ErrMissingTagKey
+		}
+		if k >= n || line[k] != '=' {
+			return nil, ErrMissingTagValue
+		}
+		i = scanTo(line, k+1, ", ")
+		if i == k+1 {
+			return nil, ErrMissingTagValue
+		}
+	}
+
+	for i < n && line[i] == ' ' {
+		i++
+	}
+	if i >= n {
+		return nil, ErrMissingFields
+	}
+
+	for {
+		k := scanTo(line, i, "=, ")
+		if k == i {
+			return nil, ErrMissingFieldKey
+		}
+		if k >= n || line[k] != '=' {
+			return nil, ErrMissingFieldValue
+		}
+
+		v := k + 1
+		var e, typ int
+		switch {
+		case v >= n || line[v] == ' ' || line[v] == ',':
+			return nil, ErrMissingFieldValue
+		case line[v] == '"':
+			e = v + 1
+			for ; e < n && line[e] != '"'; e++ {
+				if line[e] == '\\' {
+					e++
+				}
+			}
+			if e >= n {
+				return nil, ErrUnbalancedQuotes
+			}
+			e++
+			typ = FIELD_STRING
+		default:
+			e = scanTo(line, v, " ,")
+			typ, err = fieldType(line[v:e])
+			if err != nil {
+				return nil, err
+			}
+		}
+		lp.Fields[unescape(line[i:k])] = typ
+
+		i = e
+		if i >= n || line[i] != ',' {
+			break
+		}
+		i++
+	}
+
+	for i < n && line[i] == ' ' {
+		i++
+	}
+	if i >= n {
+		return
+	}
+
+	lp.Time, err = strconv.ParseInt(string(line[i:]), 10, 64)
+	if err != nil {
+		return nil, ErrBadTimestamp
+	}
+	factor := PrecisionFactor(precision)
+	if lp.Time < MIN_NANO_TIME/factor || lp.Time > MAX_NANO_TIME/factor {
+		return nil, ErrTimeOutOfRange
+	}
+	lp.HasTime = true
+	return
+}
+
+func fieldType(v []byte) (typ int, err error) {
+	s := string(v)
+	switch s {
+	case "t", "T", "true", "True", "TRUE", "f", "F", "false", "False", "FALSE":
+		return FIELD_BOOLEAN, nil
+	}
+
+	last := s[len(s)-1]
+	switch {
+	case last == 'i':
+		_, err = strconv.ParseInt(s[:len(s)-1], 10, 64)
+		typ = FIELD_INTEGER
+	case last == 'u':
+		_, err = strconv.ParseUint(s[:len(s)-1], 10, 64)
+		typ = FIELD_UNSIGNED
+	case strings.IndexByte("+-.0123456789", s[0]) == -1:
+		return 0, ErrInvalidFieldValue
+	default:
+		// ParseFloat takes Inf, NaN and hex, influxdb doesn't.
+		for i := 0; i < len(s); i++ {
+			if strings.IndexByte("+-.0123456789eE", s[i]) == -1 {
+				return 0, ErrInvalidNumber
+			}
+		}
+		_, err = strconv.ParseFloat(s, 64)
+		typ = FIELD_FLOAT
+	}
+	if err != nil {
+		return 0, ErrInvalidNumber
+	}
+	return
+}
+
+// LineValidator checks lines of a write request, including field types
+// conflicted with former lines of the same measurement.
+type LineValidator struct {
+	Precision string
+	types     map[string]int
+}
+
+func NewLineValidator(precision string) (lv *LineValidator) {
+	return &LineValidator{
+		Precision: precision,
+		types:     make(map[string]int),
+	}
+}
+
+func (lv *LineValidator) Validate(line []byte) (err error) {
+	lp, err := ParseLine(line, lv.Precision)
+	if err != nil {
+		return &LineError{Line: line, Reason: err.Error()}
+	}
+
+	for key, typ := range lp.Fields {
+		exist, ok := lv.types[lp.Measurement+","+key]
+		if ok && exist != typ {
+			return &LineError{
+				Line: line,
+				Reason: "field type conflict: input field \"" + key + "\" on measurement \"" +
+					lp.Measurement + "\" is type " + fieldTypeNames[typ] +
+					", already exists as type " + fieldTypeNames[exist],
+			}
+		}
+	}
+	for key, typ := range lp.Fields {
+		lv.types[lp.Measurement+","+key] = typ
+	}
+	return
+}
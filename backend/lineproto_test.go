@@ -0,0 +1,91 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line string
+		err  error
+	}{
+		{"cpu,host=server01,region=uswest value=1 1434055562000000000", nil},
+		{"cpu value=3i,v2=4u,v3=-1.5e3,ok=t,s=\"a \\\"b\\\" c\"", nil},
+		{"temper\\ ature,mach\\=ine=unit\\,42 internal=32", nil},
+		{"cpu  value=1  -1", nil},
+		{",host=a value=1", ErrMissingMeasurement},
+		{"cpu,=a value=1", ErrMissingTagKey},
+		{"cpu,host value=1", ErrMissingTagValue},
+		{"cpu,host= value=1", ErrMissingTagValue},
+		{"cpu", ErrMissingFields},
+		{"cpu,host=a ", ErrMissingFields},
+		{"cpu =1", ErrMissingFieldKey},
+		{"cpu value", ErrMissingFieldValue},
+		{"cpu value=", ErrMissingFieldValue},
+		{"cpu value=1,", ErrMissingFieldKey},
+		{"cpu value=1.2.3", ErrInvalidNumber},
+		{"cpu value=12ai", ErrInvalidNumber},
+		{"cpu value=-1u", ErrInvalidNumber},
+		{"cpu value=yes", ErrInvalidFieldValue},
+		{"cpu value=NaN", ErrInvalidFieldValue},
+		{"cpu value=+Inf", ErrInvalidNumber},
+		{"cpu value=-NaN", ErrInvalidNumber},
+		{"cpu value=0x1p3", ErrInvalidNumber},
+		{"cpu value=\"abc", ErrUnbalancedQuotes},
+		{"cpu value=1 abc", ErrBadTimestamp},
+		{"cpu value=1 1 2", ErrBadTimestamp},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseLine([]byte(tt.line), "")
+		if err != tt.err {
+			t.Errorf("%s: %v, want %v", tt.line, err, tt.err)
+		}
+	}
+
+	lp, err := ParseLine([]byte("temper\\ ature,a=b v=1i,s=\"x\" 10"), "s")
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	if lp.Measurement != "temper ature" || lp.Fields["v"] != FIELD_INTEGER || lp.Fields["s"] != FIELD_STRING || lp.Time != 10 {
+		t.Errorf("point wrong: %#v", lp)
+	}
+
+	_, err = ParseLine([]byte("cpu value=1 9223372036854775"), "ms")
+	if err != ErrTimeOutOfRange {
+		t.Errorf("time should be out of range: %v", err)
+	}
+}
+
+func TestLineValidator(t *testing.T) {
+	lv := NewLineValidator("")
+	err := lv.Validate([]byte("cpu value=1"))
+	if err != nil {
+		t.Errorf("error: %s", err)
+	}
+	err = lv.Validate([]byte("cpu value=1i"))
+	want := "unable to parse 'cpu value=1i': field type conflict: input field \"value\" on measurement \"cpu\" is type integer, already exists as type float"
+	if err == nil || err.Error() != want {
+		t.Errorf("conflict not found: %v", err)
+	}
+	err = lv.Validate([]byte("mem value=1i"))
+	if err != nil {
+		t.Errorf("error: %s", err)
+	}
+}
+
+func TestPartialWriteError(t *testing.T) {
+	e := &PartialWriteError{Errors: []string{"a", "b"}, Dropped: 2, Written: 1}
+	if e.Error() != "partial write: a\nb dropped=2" {
+		t.Errorf("error wrong: %s", e)
+	}
+	e.Written = 0
+	if e.Error() != "a\nb" {
+		t.Errorf("error wrong: %s", e)
+	}
+}
@@ -0,0 +1,339 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+var (
+	ErrIllegalResponse = errors.New("illegal response")
+)
+
+// ResponseBuffer is a http.ResponseWriter keeps everything in memory,
+// so a response can be checked or merged before sending to client.
+type ResponseBuffer struct {
+	header http.Header
+	Status int
+	Body   bytes.Buffer
+}
+
+func NewResponseBuffer() (rb *ResponseBuffer) {
+	return &ResponseBuffer{
+		header: make(http.Header),
+	}
+}
+
+func (rb *ResponseBuffer) Header() http.Header {
+	return rb.header
+}
+
+func (rb *ResponseBuffer) Write(p []byte) (n int, err error) {
+	if rb.Status == 0 {
+		rb.Status = 200
+	}
+	return rb.Body.Write(p)
+}
+
+func (rb *ResponseBuffer) WriteHeader(code int) {
+	rb.Status = code
+}
+
+// WriteTo sends the buffered response to w.
+func (rb *ResponseBuffer) WriteTo(w http.ResponseWriter) {
+	copyHeader(w.Header(), rb.header)
+	w.WriteHeader(rb.Status)
+	w.Write(rb.Body.Bytes())
+}
+
+// CloneQueryRequest copies req, so it can be sent to many backends at the
+// same time. The copy has no body, all parameters are in its Form.
+func CloneQueryRequest(req *http.Request) (r *http.Request) {
+	r = new(http.Request)
+	*r = *req
+	r.Body = nil
+	r.ContentLength = 0
+	r.RequestURI = ""
+	r.PostForm = nil
+
+	r.Form = make(url.Values, len(req.Form))
+	for k, vv := range req.Form {
+		r.Form[k] = append([]string(nil), vv...)
+	}
+
+	r.Header = make(http.Header, len(req.Header))
+	copyHeader(r.Header, req.Header)
+	return
+}
+
+// Series, Result and Response are the json of InfluxDB query response.
+type Series struct {
+	Name    string            `json:"name,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Columns []string          `json:"columns"`
+	Values  [][]interface{}   `json:"values,omitempty"`
+	Partial bool              `json:"partial,omitempty"`
+}
+
+type Result struct {
+	StatementID int               `json:"statement_id"`
+	Series      []*Series         `json:"series,omitempty"`
+	Messages    []json.RawMessage `json:"messages,omitempty"`
+	Partial     bool              `json:"partial,omitempty"`
+	Err         string            `json:"error,omitempty"`
+}
+
+type Response struct {
+	Results []*Result `json:"results"`
+	Err     string    `json:"error,omitempty"`
+}
+
+func ParseResponse(p []byte) (resp *Response, err error) {
+	resp = &Response{}
+	dec := json.NewDecoder(bytes.NewReader(p))
+	dec.UseNumber()
+	err = dec.Decode(resp)
+	return
+}
+
+// Key identifies a series by name and tags. Shards may give it different
+// columns, like SELECT * of fields only written to some of them.
+func (s *Series) Key() string {
+	var buf bytes.Buffer
+	buf.WriteString(s.Name)
+	keys := make([]string, 0, len(s.Tags))
+	for k := range s.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		buf.WriteByte(',')
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		buf.WriteString(s.Tags[k])
+	}
+	return buf.String()
+}
+
+// merge appends rows of other to s. Columns are the union of both, values
+// missing in rows are nil.
+func (s *Series) merge(other *Series) {
+	index := make(map[string]int, len(s.Columns))
+	for i, c := range s.Columns {
+		index[c] = i
+	}
+	same := len(other.Columns) == len(s.Columns)
+	pos := make([]int, len(other.Columns))
+	for i, c := range other.Columns {
+		j, ok := index[c]
+		if !ok {
+			j = len(s.Columns)
+			index[c] = j
+			s.Columns = append(s.Columns, c)
+		}
+		pos[i] = j
+		if i != j {
+			same = false
+		}
+	}
+	if same {
+		s.Values = append(s.Values, other.Values...)
+		return
+	}
+
+	for i, row := range s.Values {
+		if len(row) < len(s.Columns) {
+			s.Values[i] = append(row, make([]interface{}, len(s.Columns)-len(row))...)
+		}
+	}
+	for _, row := range other.Values {
+		widened := make([]interface{}, len(s.Columns))
+		for i, v := range row {
+			if i < len(pos) {
+				widened[pos[i]] = v
+			}
+		}
+		s.Values = append(s.Values, widened)
+	}
+}
+
+// timeValue reads a time column, in epoch integer or RFC3339 string.
+func timeValue(v interface{}) (t int64, ok bool) {
+	switch x := v.(type) {
+	case json.Number:
+		i, err := x.Int64()
+		if err == nil {
+			return i, true
+		}
+		f, err := x.Float64()
+		if err == nil {
+			return int64(f), true
+		}
+	case string:
+		tm, err := time.Parse(time.RFC3339Nano, x)
+		if err == nil {
+			return tm.UnixNano(), true
+		}
+	case float64:
+		return int64(x), true
+	case int64:
+		return x, true
+	}
+	return 0, false
+}
+
+// SortValues sorts rows by the time in their first column.
+func SortValues(values [][]interface{}, desc bool) {
+	sort.SliceStable(values, func(i, j int) bool {
+		if len(values[i]) == 0 || len(values[j]) == 0 {
+			return false
+		}
+		ti, _ := timeValue(values[i][0])
+		tj, _ := timeValue(values[j][0])
+		if desc {
+			return ti > tj
+		}
+		return ti < tj
+	})
+}
+
+// MergeOptions tells how to merge each statement.
+type MergeOptions struct {
+	Descending bool
+	Limit      int
+	Offset     int
+	SLimit     int
+	SOffset    int
+	Distinct   bool       // rows without time, like results of SHOW
+	Aggregate  *Aggregate // reduce partials, nil if rows are raw
+}
+
+// MergeResponses merges the responses of the same query from many shards.
+// Series with the same name and tags are joined and sorted by time.
+// opts are per statement, missing ones mean ascending without limit.
+func MergeResponses(resps []*Response, opts []MergeOptions) (merged *Response) {
+	merged = &Response{}
+	for _, resp := range resps {
+		if resp.Err != "" {
+			merged.Err = resp.Err
+			return
+		}
+	}
+
+	var nresults int
+	for _, resp := range resps {
+		if len(resp.Results) > nresults {
+			nresults = len(resp.Results)
+		}
+	}
+
+	for i := 0; i < nresults; i++ {
+		result := &Result{StatementID: i}
+		index := make(map[string]*Series)
+		for _, resp := range resps {
+			if i >= len(resp.Results) {
+				continue
+			}
+			r := resp.Results[i]
+			result.StatementID = r.StatementID
+			if r.Err != "" {
+				result.Err = r.Err
+			}
+			if r.Partial {
+				result.Partial = true
+			}
+			result.Messages = append(result.Messages, r.Messages...)
+
+			for _, s := range r.Series {
+				key := s.Key()
+				exist, ok := index[key]
+				if !ok {
+					index[key] = s
+					result.Series = append(result.Series, s)
+					continue
+				}
+				exist.merge(s)
+			}
+		}
+
+		if result.Err != "" {
+			result.Series = nil
+			merged.Results = append(merged.Results, result)
+			continue
+		}
+
+		var opt MergeOptions
+		if i < len(opts) {
+			opt = opts[i]
+		}
+		sort.SliceStable(result.Series, func(a, b int) bool {
+			return result.Series[a].Key() < result.Series[b].Key()
+		})
+		result.Series = limitSeries(result.Series, opt.SLimit, opt.SOffset)
+		for _, s := range result.Series {
+			switch {
+			case opt.Aggregate != nil:
+				opt.Aggregate.Reduce(s, opt.Descending)
+			case len(s.Columns) != 0 && s.Columns[0] == "time":
+				SortValues(s.Values, opt.Descending)
+			case opt.Distinct:
+				s.Values = distinctValues(s.Values)
+			}
+			s.Values = limitValues(s.Values, opt.Limit, opt.Offset)
+		}
+		merged.Results = append(merged.Results, result)
+	}
+	return
+}
+
+func limitValues(values [][]interface{}, limit, offset int) [][]interface{} {
+	if offset > 0 {
+		if offset >= len(values) {
+			return nil
+		}
+		values = values[offset:]
+	}
+	if limit > 0 && limit < len(values) {
+		values = values[:limit]
+	}
+	return values
+}
+
+func limitSeries(series []*Series, limit, offset int) []*Series {
+	if offset > 0 {
+		if offset >= len(series) {
+			return nil
+		}
+		series = series[offset:]
+	}
+	if limit > 0 && limit < len(series) {
+		series = series[:limit]
+	}
+	return series
+}
+
+// distinctValues sorts rows and drops the same ones from other shards.
+func distinctValues(values [][]interface{}) (distinct [][]interface{}) {
+	keys := make(map[string]bool, len(values))
+	for _, row := range values {
+		p, err := json.Marshal(row)
+		if err != nil || keys[string(p)] {
+			continue
+		}
+		keys[string(p)] = true
+		distinct = append(distinct, row)
+	}
+	sort.SliceStable(distinct, func(i, j int) bool {
+		return fmt.Sprint(distinct[i]...) < fmt.Sprint(distinct[j]...)
+	})
+	return
+}
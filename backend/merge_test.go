@@ -0,0 +1,94 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func mustParseResponse(t *testing.T, s string) (resp *Response) {
+	resp, err := ParseResponse([]byte(s))
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	return
+}
+
+func TestMergeResponses(t *testing.T) {
+	resps := []*Response{
+		mustParseResponse(t, `{"results":[{"statement_id":0,"series":[
+			{"name":"cpu","columns":["time","v"],"values":[[1,1],[3,3]]},
+			{"name":"cpu","tags":{"host":"b"},"columns":["time","v"],"values":[[1,10]]}]}]}`),
+		mustParseResponse(t, `{"results":[{"statement_id":0,"series":[
+			{"name":"cpu","columns":["time","v"],"values":[[2,2],[4,4]]},
+			{"name":"cpu","tags":{"host":"a"},"columns":["time","v"],"values":[[1,20]]}]}]}`),
+		mustParseResponse(t, `{"results":[{"statement_id":0}]}`),
+	}
+
+	merged := MergeResponses(resps, []MergeOptions{{Limit: 3}})
+	p, err := json.Marshal(merged)
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	want := `{"results":[{"statement_id":0,"series":[` +
+		`{"name":"cpu","columns":["time","v"],"values":[[1,1],[2,2],[3,3]]},` +
+		`{"name":"cpu","tags":{"host":"a"},"columns":["time","v"],"values":[[1,20]]},` +
+		`{"name":"cpu","tags":{"host":"b"},"columns":["time","v"],"values":[[1,10]]}]}]}`
+	if string(p) != want {
+		t.Errorf("merged wrong:\n%s\n%s", p, want)
+	}
+}
+
+func TestMergeResponsesRFC3339(t *testing.T) {
+	resps := []*Response{
+		mustParseResponse(t, `{"results":[{"statement_id":0,"series":[
+			{"name":"cpu","columns":["time","v"],"values":[["2017-01-01T00:00:00.5Z",1],["2017-01-01T00:00:02Z",3]]}]}]}`),
+		mustParseResponse(t, `{"results":[{"statement_id":0,"series":[
+			{"name":"cpu","columns":["time","v"],"values":[["2017-01-01T00:00:01Z",2]]}]}]}`),
+	}
+
+	merged := MergeResponses(resps, []MergeOptions{{Descending: true}})
+	values := merged.Results[0].Series[0].Values
+	if len(values) != 3 || values[0][1].(json.Number) != "3" || values[2][1].(json.Number) != "1" {
+		t.Errorf("merged wrong: %v", values)
+	}
+}
+
+func TestMergeResponsesColumns(t *testing.T) {
+	// fields written to one shard only, a series gets the columns of all.
+	resps := []*Response{
+		mustParseResponse(t, `{"results":[{"statement_id":0,"series":[
+			{"name":"cpu","columns":["time","v"],"values":[[1,1],[3,3]]}]}]}`),
+		mustParseResponse(t, `{"results":[{"statement_id":0,"series":[
+			{"name":"cpu","columns":["time","u","v"],"values":[[2,20,2]]}]}]}`),
+		mustParseResponse(t, `{"results":[{"statement_id":0,"series":[
+			{"name":"cpu","columns":["time","w"],"values":[[4,400]]}]}]}`),
+	}
+
+	p, err := json.Marshal(MergeResponses(resps, nil))
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	want := `{"results":[{"statement_id":0,"series":[` +
+		`{"name":"cpu","columns":["time","v","u","w"],"values":[[1,1,null,null],[2,2,20,null],[3,3,null,null],[4,null,null,400]]}]}]}`
+	if string(p) != want {
+		t.Errorf("merged wrong:\n%s\n%s", p, want)
+	}
+}
+
+func TestMergeResponsesError(t *testing.T) {
+	resps := []*Response{
+		mustParseResponse(t, `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","v"],"values":[[1,1]]}]}]}`),
+		mustParseResponse(t, `{"results":[{"statement_id":0,"error":"database not found: test"}]}`),
+	}
+
+	merged := MergeResponses(resps, nil)
+	if merged.Results[0].Err == "" || merged.Results[0].Series != nil {
+		t.Errorf("error should be kept: %v", merged.Results[0])
+	}
+}
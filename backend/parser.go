@@ -0,0 +1,1515 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnexpectedToken      = errors.New("unexpected token")
+	ErrUnsupportedStatement = errors.New("unsupported statement")
+	ErrIllegalDuration      = errors.New("illegal duration")
+	ErrConflictTags         = errors.New("conflicting tag conditions")
+)
+
+// A small InfluxQL parser. It understands SELECT and SHOW ... FROM,
+// which is what the proxy needs to route, check and rewrite queries.
+//
+// The influxql of influxdb isn't used, though the client comes with it.
+// Its AST keeps no positions, and RewriteQualifiers splices db and rp
+// names into the query as the client wrote it, so backends get the rest
+// untouched. And its statements change with the version of influxdb, the
+// proxy should not be bound to one. parser_upstream_test.go checks what we
+// print means the same to influxql as what clients sent.
+
+type Token int
+
+const (
+	ILLEGAL Token = iota
+	EOF
+	IDENT
+	STRING
+	NUMBER
+	INTEGER
+	DURATION
+	REGEX
+
+	ADD
+	SUB
+	MUL
+	DIV
+	MOD
+	BITAND
+	BITOR
+	BITXOR
+	AND
+	OR
+	EQ
+	NEQ
+	EQREGEX
+	NEQREGEX
+	LT
+	LTE
+	GT
+	GTE
+
+	LPAREN
+	RPAREN
+	COMMA
+	DOT
+	SEMICOLON
+	DOUBLECOLON
+	COLON
+)
+
+var operators = map[Token]string{
+	ADD:      "+",
+	SUB:      "-",
+	MUL:      "*",
+	DIV:      "/",
+	MOD:      "%",
+	BITAND:   "&",
+	BITOR:    "|",
+	BITXOR:   "^",
+	AND:      "AND",
+	OR:       "OR",
+	EQ:       "=",
+	NEQ:      "!=",
+	EQREGEX:  "=~",
+	NEQREGEX: "!~",
+	LT:       "<",
+	LTE:      "<=",
+	GT:       ">",
+	GTE:      ">=",
+}
+
+func (tok Token) Precedence() int {
+	switch tok {
+	case OR:
+		return 1
+	case AND:
+		return 2
+	case EQ, NEQ, EQREGEX, NEQREGEX, LT, LTE, GT, GTE:
+		return 4
+	case ADD, SUB, BITOR, BITXOR:
+		return 5
+	case MUL, DIV, MOD, BITAND:
+		return 6
+	}
+	return 0
+}
+
+type Item struct {
+	Tok    Token
+	Pos    int
+	End    int
+	Lit    string // unescaped
+	Quoted bool   // ident in double quotes
+}
+
+// IsKeyword tells if item is the unquoted keyword kw, case insensitive.
+func (it Item) IsKeyword(kw string) bool {
+	return it.Tok == IDENT && !it.Quoted && strings.EqualFold(it.Lit, kw)
+}
+
+type Scanner struct {
+	s   string
+	pos int
+}
+
+func NewScanner(s string) *Scanner {
+	return &Scanner{s: s}
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (sc *Scanner) skip() {
+	for sc.pos < len(sc.s) {
+		c := sc.s[sc.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			sc.pos++
+		case strings.HasPrefix(sc.s[sc.pos:], "--"):
+			end := strings.IndexByte(sc.s[sc.pos:], '\n')
+			if end == -1 {
+				sc.pos = len(sc.s)
+			} else {
+				sc.pos += end + 1
+			}
+		case strings.HasPrefix(sc.s[sc.pos:], "/*"):
+			end := strings.Index(sc.s[sc.pos+2:], "*/")
+			if end == -1 {
+				sc.pos = len(sc.s)
+			} else {
+				sc.pos += end + 4
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (sc *Scanner) Scan() (it Item) {
+	sc.skip()
+	it.Pos = sc.pos
+	defer func() {
+		it.End = sc.pos
+	}()
+
+	if sc.pos >= len(sc.s) {
+		it.Tok = EOF
+		return
+	}
+
+	c := sc.s[sc.pos]
+	switch {
+	case isLetter(c):
+		start := sc.pos
+		for sc.pos < len(sc.s) && (isLetter(sc.s[sc.pos]) || isDigit(sc.s[sc.pos])) {
+			sc.pos++
+		}
+		it.Lit = sc.s[start:sc.pos]
+		switch strings.ToUpper(it.Lit) {
+		case "AND":
+			it.Tok = AND
+		case "OR":
+			it.Tok = OR
+		default:
+			it.Tok = IDENT
+		}
+		return
+	case isDigit(c) || (c == '.' && sc.pos+1 < len(sc.s) && isDigit(sc.s[sc.pos+1])):
+		return sc.scanNumber()
+	case c == '"':
+		it.Tok = IDENT
+		it.Quoted = true
+		it.Lit, it.Tok = sc.scanQuoted('"', IDENT)
+		return
+	case c == '\'':
+		it.Lit, it.Tok = sc.scanQuoted('\'', STRING)
+		return
+	}
+
+	two := ""
+	if sc.pos+1 < len(sc.s) {
+		two = sc.s[sc.pos : sc.pos+2]
+	}
+	switch two {
+	case "!=", "<>":
+		it.Tok = NEQ
+	case "=~":
+		it.Tok = EQREGEX
+	case "!~":
+		it.Tok = NEQREGEX
+	case "<=":
+		it.Tok = LTE
+	case ">=":
+		it.Tok = GTE
+	case "::":
+		it.Tok = DOUBLECOLON
+	}
+	if it.Tok != ILLEGAL {
+		sc.pos += 2
+		it.Lit = two
+		return
+	}
+
+	sc.pos++
+	it.Lit = string(c)
+	switch c {
+	case '+':
+		it.Tok = ADD
+	case '-':
+		it.Tok = SUB
+	case '*':
+		it.Tok = MUL
+	case '/':
+		it.Tok = DIV
+	case '%':
+		it.Tok = MOD
+	case '&':
+		it.Tok = BITAND
+	case '|':
+		it.Tok = BITOR
+	case '^':
+		it.Tok = BITXOR
+	case '=':
+		it.Tok = EQ
+	case '<':
+		it.Tok = LT
+	case '>':
+		it.Tok = GT
+	case '(':
+		it.Tok = LPAREN
+	case ')':
+		it.Tok = RPAREN
+	case ',':
+		it.Tok = COMMA
+	case '.':
+		it.Tok = DOT
+	case ';':
+		it.Tok = SEMICOLON
+	case ':':
+		it.Tok = COLON
+	}
+	return
+}
+
+var durationUnits = []string{"ns", "ms", "us", "µs", "u", "µ", "s", "m", "h", "d", "w"}
+
+func (sc *Scanner) scanNumber() (it Item) {
+	start := sc.pos
+	it.Tok = INTEGER
+	for sc.pos < len(sc.s) && isDigit(sc.s[sc.pos]) {
+		sc.pos++
+	}
+	if sc.pos < len(sc.s) && sc.s[sc.pos] == '.' && sc.pos+1 < len(sc.s) && isDigit(sc.s[sc.pos+1]) {
+		it.Tok = NUMBER
+		sc.pos++
+		for sc.pos < len(sc.s) && isDigit(sc.s[sc.pos]) {
+			sc.pos++
+		}
+	}
+
+	// 10m or 1h30m
+	if it.Tok == INTEGER {
+		for {
+			unit := ""
+			for _, u := range durationUnits {
+				if strings.HasPrefix(sc.s[sc.pos:], u) {
+					unit = u
+					break
+				}
+			}
+			if unit == "" {
+				break
+			}
+			end := sc.pos + len(unit)
+			if end < len(sc.s) && isLetter(sc.s[end]) {
+				break
+			}
+			it.Tok = DURATION
+			sc.pos = end
+			if sc.pos >= len(sc.s) || !isDigit(sc.s[sc.pos]) {
+				break
+			}
+			for sc.pos < len(sc.s) && isDigit(sc.s[sc.pos]) {
+				sc.pos++
+			}
+		}
+	}
+	it.Lit = sc.s[start:sc.pos]
+	return
+}
+
+func (sc *Scanner) scanQuoted(quote byte, tok Token) (lit string, t Token) {
+	var buf bytes.Buffer
+	sc.pos++
+	for sc.pos < len(sc.s) {
+		c := sc.s[sc.pos]
+		switch c {
+		case quote:
+			sc.pos++
+			return buf.String(), tok
+		case '\\':
+			if sc.pos+1 >= len(sc.s) {
+				sc.pos = len(sc.s)
+				return buf.String(), ILLEGAL
+			}
+			sc.pos++
+			switch sc.s[sc.pos] {
+			case 'n':
+				buf.WriteByte('\n')
+			case '\\', '"', '\'':
+				buf.WriteByte(sc.s[sc.pos])
+			default:
+				buf.WriteByte('\\')
+				buf.WriteByte(sc.s[sc.pos])
+			}
+			sc.pos++
+		default:
+			buf.WriteByte(c)
+			sc.pos++
+		}
+	}
+	return buf.String(), ILLEGAL
+}
+
+// ScanRegex reads a /regex/ at pos.
+func (sc *Scanner) ScanRegex(pos int) (it Item) {
+	sc.pos = pos
+	it.Pos = pos
+	it.Tok = ILLEGAL
+	if sc.pos >= len(sc.s) || sc.s[sc.pos] != '/' {
+		it.End = sc.pos
+		return
+	}
+
+	var buf bytes.Buffer
+	sc.pos++
+	for sc.pos < len(sc.s) {
+		c := sc.s[sc.pos]
+		switch {
+		case c == '/':
+			sc.pos++
+			it.Tok = REGEX
+			it.Lit = buf.String()
+			it.End = sc.pos
+			return
+		case c == '\\' && sc.pos+1 < len(sc.s) && sc.s[sc.pos+1] == '/':
+			buf.WriteByte('/')
+			sc.pos += 2
+		default:
+			buf.WriteByte(c)
+			sc.pos++
+		}
+	}
+	it.End = sc.pos
+	return
+}
+
+// ParseInfluxDuration reads InfluxQL durations, like 10m, 1h30m or 1w.
+func ParseInfluxDuration(s string) (d time.Duration, err error) {
+	i := 0
+	for i < len(s) {
+		start := i
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+		if start == i {
+			return 0, ErrIllegalDuration
+		}
+		n, err := strconv.ParseInt(s[start:i], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		var unit time.Duration
+		switch {
+		case strings.HasPrefix(s[i:], "ns"):
+			unit, i = time.Nanosecond, i+2
+		case strings.HasPrefix(s[i:], "ms"):
+			unit, i = time.Millisecond, i+2
+		case strings.HasPrefix(s[i:], "us"):
+			unit, i = time.Microsecond, i+2
+		case strings.HasPrefix(s[i:], "µs"):
+			unit, i = time.Microsecond, i+len("µs")
+		case strings.HasPrefix(s[i:], "µ"):
+			unit, i = time.Microsecond, i+len("µ")
+		case strings.HasPrefix(s[i:], "u"):
+			unit, i = time.Microsecond, i+1
+		case strings.HasPrefix(s[i:], "s"):
+			unit, i = time.Second, i+1
+		case strings.HasPrefix(s[i:], "m"):
+			unit, i = time.Minute, i+1
+		case strings.HasPrefix(s[i:], "h"):
+			unit, i = time.Hour, i+1
+		case strings.HasPrefix(s[i:], "d"):
+			unit, i = 24*time.Hour, i+1
+		case strings.HasPrefix(s[i:], "w"):
+			unit, i = 7*24*time.Hour, i+1
+		default:
+			return 0, ErrIllegalDuration
+		}
+		d += time.Duration(n) * unit
+	}
+	return
+}
+
+// AST
+
+type Node interface {
+	String() string
+}
+
+type Expr interface {
+	Node
+	expr()
+}
+
+type VarRef struct {
+	Val  string
+	Type string // field or tag, from ::
+}
+
+type Wildcard struct {
+	Type string
+}
+
+type StringLiteral struct {
+	Val string
+}
+
+type NumberLiteral struct {
+	Val   float64
+	Raw   string
+	IsInt bool
+}
+
+type DurationLiteral struct {
+	Val time.Duration
+	Raw string
+}
+
+type BooleanLiteral struct {
+	Val bool
+}
+
+type RegexLiteral struct {
+	Val string
+}
+
+type Call struct {
+	Name string
+	Args []Expr
+}
+
+type UnaryExpr struct {
+	Op   Token
+	Expr Expr
+}
+
+type BinaryExpr struct {
+	Op  Token
+	LHS Expr
+	RHS Expr
+}
+
+type ParenExpr struct {
+	Expr Expr
+}
+
+func (*VarRef) expr()          {}
+func (*Wildcard) expr()        {}
+func (*StringLiteral) expr()   {}
+func (*NumberLiteral) expr()   {}
+func (*DurationLiteral) expr() {}
+func (*BooleanLiteral) expr()  {}
+func (*RegexLiteral) expr()    {}
+func (*Call) expr()            {}
+func (*UnaryExpr) expr()       {}
+func (*BinaryExpr) expr()      {}
+func (*ParenExpr) expr()       {}
+
+var keywords = map[string]bool{
+	"ALL": true, "ALTER": true, "ANY": true, "AS": true, "ASC": true, "BEGIN": true,
+	"BY": true, "CREATE": true, "CONTINUOUS": true, "DATABASE": true, "DATABASES": true,
+	"DEFAULT": true, "DELETE": true, "DESC": true, "DESTINATIONS": true, "DIAGNOSTICS": true,
+	"DISTINCT": true, "DROP": true, "DURATION": true, "END": true, "EVERY": true, "EXPLAIN": true,
+	"FIELD": true, "FOR": true, "FROM": true, "GRANT": true, "GRANTS": true, "GROUP": true,
+	"GROUPS": true, "IN": true, "INF": true, "INSERT": true, "INTO": true, "KEY": true,
+	"KEYS": true, "KILL": true, "LIMIT": true, "MEASUREMENT": true, "MEASUREMENTS": true,
+	"NAME": true, "OFFSET": true, "ON": true, "ORDER": true, "PASSWORD": true, "POLICY": true,
+	"POLICIES": true, "PRIVILEGES": true, "QUERIES": true, "QUERY": true, "READ": true,
+	"REPLICATION": true, "RESAMPLE": true, "RETENTION": true, "REVOKE": true, "SELECT": true,
+	"SERIES": true, "SET": true, "SHARD": true, "SHARDS": true, "SLIMIT": true, "SOFFSET": true,
+	"STATS": true, "SUBSCRIPTION": true, "SUBSCRIPTIONS": true, "TAG": true, "TO": true,
+	"USER": true, "USERS": true, "VALUES": true, "WHERE": true, "WITH": true, "WRITE": true,
+	"AND": true, "OR": true, "TRUE": true, "FALSE": true,
+}
+
+var bareIdent = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// QuoteIdent quotes ident if it can't be written bare.
+func QuoteIdent(ident string) string {
+	if bareIdent.MatchString(ident) && !keywords[strings.ToUpper(ident)] {
+		return ident
+	}
+	r := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+	return "\"" + r.Replace(ident) + "\""
+}
+
+func QuoteString(s string) string {
+	r := strings.NewReplacer("\\", "\\\\", "'", "\\'", "\n", "\\n")
+	return "'" + r.Replace(s) + "'"
+}
+
+func (v *VarRef) String() string {
+	if v.Type != "" {
+		return QuoteIdent(v.Val) + "::" + v.Type
+	}
+	return QuoteIdent(v.Val)
+}
+
+func (w *Wildcard) String() string {
+	if w.Type != "" {
+		return "*::" + w.Type
+	}
+	return "*"
+}
+
+func (s *StringLiteral) String() string {
+	return QuoteString(s.Val)
+}
+
+func (n *NumberLiteral) String() string {
+	if n.Raw != "" {
+		return n.Raw
+	}
+	if n.IsInt {
+		return strconv.FormatInt(int64(n.Val), 10)
+	}
+	return strconv.FormatFloat(n.Val, 'f', -1, 64)
+}
+
+func (d *DurationLiteral) String() string {
+	if d.Raw != "" {
+		return d.Raw
+	}
+	return FormatInfluxDuration(d.Val)
+}
+
+// FormatInfluxDuration writes d with the largest unit that fits exactly.
+func FormatInfluxDuration(d time.Duration) string {
+	units := []struct {
+		d time.Duration
+		s string
+	}{
+		{7 * 24 * time.Hour, "w"}, {24 * time.Hour, "d"}, {time.Hour, "h"},
+		{time.Minute, "m"}, {time.Second, "s"}, {time.Millisecond, "ms"},
+		{time.Microsecond, "u"},
+	}
+	for _, u := range units {
+		if d != 0 && d%u.d == 0 {
+			return strconv.FormatInt(int64(d/u.d), 10) + u.s
+		}
+	}
+	return strconv.FormatInt(int64(d), 10) + "ns"
+}
+
+func (b *BooleanLiteral) String() string {
+	if b.Val {
+		return "true"
+	}
+	return "false"
+}
+
+func (r *RegexLiteral) String() string {
+	return "/" + strings.Replace(r.Val, "/", "\\/", -1) + "/"
+}
+
+func (c *Call) String() string {
+	args := make([]string, len(c.Args))
+	for i, arg := range c.Args {
+		args[i] = arg.String()
+	}
+	return c.Name + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (u *UnaryExpr) String() string {
+	return operators[u.Op] + u.Expr.String()
+}
+
+func (b *BinaryExpr) String() string {
+	return b.LHS.String() + " " + operators[b.Op] + " " + b.RHS.String()
+}
+
+func (p *ParenExpr) String() string {
+	return "(" + p.Expr.String() + ")"
+}
+
+// Measurement is a source in FROM.
+// Pos and End locate it in the query it's parsed from, -1 if not parsed.
+type Measurement struct {
+	Database        string
+	RetentionPolicy string
+	Name            string
+	Regex           *RegexLiteral
+	SubQuery        *SelectStatement
+	Pos             int
+	End             int
+}
+
+func (m *Measurement) String() string {
+	if m.SubQuery != nil {
+		return "(" + m.SubQuery.String() + ")"
+	}
+
+	var buf bytes.Buffer
+	if m.Database != "" {
+		buf.WriteString(QuoteIdent(m.Database))
+		buf.WriteByte('.')
+	}
+	if m.RetentionPolicy != "" {
+		buf.WriteString(QuoteIdent(m.RetentionPolicy))
+		buf.WriteByte('.')
+	} else if m.Database != "" {
+		buf.WriteByte('.')
+	}
+	if m.Regex != nil {
+		buf.WriteString(m.Regex.String())
+	} else {
+		buf.WriteString(QuoteIdent(m.Name))
+	}
+	return buf.String()
+}
+
+type Field struct {
+	Expr  Expr
+	Alias string
+}
+
+func (f *Field) String() string {
+	if f.Alias != "" {
+		return f.Expr.String() + " AS " + QuoteIdent(f.Alias)
+	}
+	return f.Expr.String()
+}
+
+// Name is the column name of the field in the result.
+func (f *Field) Name() string {
+	if f.Alias != "" {
+		return f.Alias
+	}
+	switch e := f.Expr.(type) {
+	case *VarRef:
+		return e.Val
+	case *Call:
+		return e.Name
+	case *ParenExpr:
+		return (&Field{Expr: e.Expr}).Name()
+	case *BinaryExpr, *UnaryExpr:
+		// like influxdb, join names of calls and variables in it.
+		var names []string
+		WalkExpr(e, func(n Expr) bool {
+			switch x := n.(type) {
+			case *VarRef:
+				names = append(names, x.Val)
+			case *Call:
+				names = append(names, x.Name)
+				return false
+			}
+			return true
+		})
+		return strings.Join(names, "_")
+	}
+	return ""
+}
+
+type Statement interface {
+	Node
+	stmt()
+}
+
+type SelectStatement struct {
+	Fields     []*Field
+	Into       string // raw
+	Sources    []*Measurement
+	Condition  Expr
+	Dimensions []Expr
+	Fill       *Call
+	Descending bool
+	Limit      int
+	Offset     int
+	SLimit     int
+	SOffset    int
+	Location   string
+}
+
+// ShowStatement is SHOW TAG KEYS, SHOW FIELD KEYS, SHOW SERIES and alike.
+// Clauses the proxy doesn't look into are kept raw.
+// DBPos and DBEnd locate Database in the query it's parsed from.
+type ShowStatement struct {
+	Kind      string
+	Database  string
+	DBPos     int
+	DBEnd     int
+	Sources   []*Measurement
+	With      string // raw
+	Condition Expr
+	Tail      string // raw, LIMIT and so on
+}
+
+func (*SelectStatement) stmt() {}
+func (*ShowStatement) stmt()   {}
+
+func joinFields(fields []*Field) string {
+	l := make([]string, len(fields))
+	for i, f := range fields {
+		l[i] = f.String()
+	}
+	return strings.Join(l, ", ")
+}
+
+func joinSources(sources []*Measurement) string {
+	l := make([]string, len(sources))
+	for i, m := range sources {
+		l[i] = m.String()
+	}
+	return strings.Join(l, ", ")
+}
+
+func joinExprs(exprs []Expr) string {
+	l := make([]string, len(exprs))
+	for i, e := range exprs {
+		l[i] = e.String()
+	}
+	return strings.Join(l, ", ")
+}
+
+func (s *SelectStatement) String() string {
+	var buf bytes.Buffer
+	buf.WriteString("SELECT ")
+	buf.WriteString(joinFields(s.Fields))
+	if s.Into != "" {
+		buf.WriteString(" INTO ")
+		buf.WriteString(s.Into)
+	}
+	buf.WriteString(" FROM ")
+	buf.WriteString(joinSources(s.Sources))
+	if s.Condition != nil {
+		buf.WriteString(" WHERE ")
+		buf.WriteString(s.Condition.String())
+	}
+	if len(s.Dimensions) != 0 {
+		buf.WriteString(" GROUP BY ")
+		buf.WriteString(joinExprs(s.Dimensions))
+	}
+	if s.Fill != nil {
+		buf.WriteString(" ")
+		buf.WriteString(s.Fill.String())
+	}
+	if s.Descending {
+		buf.WriteString(" ORDER BY time DESC")
+	}
+	if s.Limit > 0 {
+		buf.WriteString(" LIMIT " + strconv.Itoa(s.Limit))
+	}
+	if s.Offset > 0 {
+		buf.WriteString(" OFFSET " + strconv.Itoa(s.Offset))
+	}
+	if s.SLimit > 0 {
+		buf.WriteString(" SLIMIT " + strconv.Itoa(s.SLimit))
+	}
+	if s.SOffset > 0 {
+		buf.WriteString(" SOFFSET " + strconv.Itoa(s.SOffset))
+	}
+	if s.Location != "" {
+		buf.WriteString(" tz(" + QuoteString(s.Location) + ")")
+	}
+	return buf.String()
+}
+
+func (s *ShowStatement) String() string {
+	var buf bytes.Buffer
+	buf.WriteString("SHOW ")
+	buf.WriteString(s.Kind)
+	if s.Database != "" {
+		buf.WriteString(" ON ")
+		buf.WriteString(QuoteIdent(s.Database))
+	}
+	if len(s.Sources) != 0 {
+		buf.WriteString(" FROM ")
+		buf.WriteString(joinSources(s.Sources))
+	}
+	if s.With != "" {
+		buf.WriteString(" WITH ")
+		buf.WriteString(s.With)
+	}
+	if s.Condition != nil {
+		buf.WriteString(" WHERE ")
+		buf.WriteString(s.Condition.String())
+	}
+	if s.Tail != "" {
+		buf.WriteString(" ")
+		buf.WriteString(s.Tail)
+	}
+	return buf.String()
+}
+
+// Parser
+
+type Parser struct {
+	sc  *Scanner
+	buf []Item
+}
+
+func NewParser(q string) *Parser {
+	return &Parser{sc: NewScanner(q)}
+}
+
+func (p *Parser) scan() (it Item) {
+	if n := len(p.buf); n > 0 {
+		it = p.buf[n-1]
+		p.buf = p.buf[:n-1]
+		return
+	}
+	return p.sc.Scan()
+}
+
+func (p *Parser) unscan(it Item) {
+	p.buf = append(p.buf, it)
+}
+
+func (p *Parser) peek() (it Item) {
+	it = p.scan()
+	p.unscan(it)
+	return
+}
+
+func (p *Parser) expectKeyword(kw string) (err error) {
+	it := p.scan()
+	if !it.IsKeyword(kw) {
+		return ErrUnexpectedToken
+	}
+	return
+}
+
+func (p *Parser) scanRegex(pos int) (it Item) {
+	p.buf = p.buf[:0]
+	return p.sc.ScanRegex(pos)
+}
+
+// ParseQuery parses all statements split by ;.
+func ParseQuery(q string) (stmts []Statement, err error) {
+	p := NewParser(q)
+	for {
+		it := p.scan()
+		switch it.Tok {
+		case EOF:
+			return
+		case SEMICOLON:
+			continue
+		}
+		p.unscan(it)
+
+		var stmt Statement
+		stmt, err = p.ParseStatement()
+		if err != nil {
+			return
+		}
+		stmts = append(stmts, stmt)
+
+		it = p.scan()
+		if it.Tok != SEMICOLON && it.Tok != EOF {
+			err = ErrUnexpectedToken
+			return
+		}
+		p.unscan(it)
+	}
+}
+
+// SplitStatements splits q by ; out of quotes, empty ones are skipped.
+func SplitStatements(q string) (stmts []string) {
+	sc := NewScanner(q)
+	start := 0
+	for {
+		it := sc.Scan()
+		if it.Tok != SEMICOLON && it.Tok != EOF {
+			continue
+		}
+		if stmt := strings.TrimSpace(q[start:it.Pos]); stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+		if it.Tok == EOF {
+			return
+		}
+		start = it.End
+	}
+}
+
+func (p *Parser) ParseStatement() (stmt Statement, err error) {
+	it := p.scan()
+	switch {
+	case it.IsKeyword("SELECT"):
+		return p.parseSelect()
+	case it.IsKeyword("SHOW"):
+		return p.parseShow()
+	}
+	return nil, ErrUnsupportedStatement
+}
+
+func (p *Parser) parseSelect() (stmt *SelectStatement, err error) {
+	stmt = &SelectStatement{}
+
+	stmt.Fields, err = p.parseFields()
+	if err != nil {
+		return
+	}
+
+	it := p.scan()
+	if it.IsKeyword("INTO") {
+		start := p.peek().Pos
+		end := start
+		for {
+			it = p.scan()
+			if it.Tok == EOF || it.IsKeyword("FROM") {
+				break
+			}
+			end = it.End
+		}
+		p.unscan(it)
+		stmt.Into = strings.TrimSpace(p.sc.s[start:end])
+		it = p.scan()
+	}
+	if !it.IsKeyword("FROM") {
+		return nil, ErrUnexpectedToken
+	}
+
+	stmt.Sources, err = p.parseSources()
+	if err != nil {
+		return
+	}
+
+	stmt.Condition, err = p.parseCondition()
+	if err != nil {
+		return
+	}
+
+	it = p.scan()
+	if it.IsKeyword("GROUP") {
+		err = p.expectKeyword("BY")
+		if err != nil {
+			return
+		}
+		stmt.Dimensions, err = p.parseExprList()
+		if err != nil {
+			return
+		}
+	} else {
+		p.unscan(it)
+	}
+
+	for {
+		it = p.scan()
+		switch {
+		case it.IsKeyword("fill") && p.peek().Tok == LPAREN:
+			var e Expr
+			e, err = p.parseCall(it)
+			if err != nil {
+				return
+			}
+			stmt.Fill = e.(*Call)
+		case it.IsKeyword("ORDER"):
+			err = p.expectKeyword("BY")
+			if err != nil {
+				return
+			}
+			if err = p.expectKeyword("time"); err != nil {
+				return
+			}
+			next := p.scan()
+			switch {
+			case next.IsKeyword("DESC"):
+				stmt.Descending = true
+			case next.IsKeyword("ASC"):
+			default:
+				p.unscan(next)
+			}
+		case it.IsKeyword("LIMIT"):
+			stmt.Limit, err = p.parseInt()
+		case it.IsKeyword("OFFSET"):
+			stmt.Offset, err = p.parseInt()
+		case it.IsKeyword("SLIMIT"):
+			stmt.SLimit, err = p.parseInt()
+		case it.IsKeyword("SOFFSET"):
+			stmt.SOffset, err = p.parseInt()
+		case it.IsKeyword("tz") && p.peek().Tok == LPAREN:
+			p.scan()
+			s := p.scan()
+			if s.Tok != STRING || p.scan().Tok != RPAREN {
+				return nil, ErrUnexpectedToken
+			}
+			stmt.Location = s.Lit
+		default:
+			p.unscan(it)
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *Parser) parseShow() (stmt *ShowStatement, err error) {
+	stmt = &ShowStatement{}
+
+	var kind []string
+	for {
+		it := p.scan()
+		switch {
+		case it.Tok == IDENT && !it.Quoted && !it.IsKeyword("ON") &&
+			!it.IsKeyword("FROM") && !it.IsKeyword("WITH") && !it.IsKeyword("WHERE") &&
+			!it.IsKeyword("LIMIT") && !it.IsKeyword("OFFSET"):
+			kind = append(kind, it.Lit)
+			continue
+		}
+		p.unscan(it)
+		break
+	}
+	if len(kind) == 0 {
+		return nil, ErrUnexpectedToken
+	}
+	stmt.Kind = strings.Join(kind, " ")
+
+	it := p.scan()
+	if it.IsKeyword("ON") {
+		db := p.scan()
+		if db.Tok != IDENT {
+			return nil, ErrUnexpectedToken
+		}
+		stmt.Database = db.Lit
+		stmt.DBPos, stmt.DBEnd = db.Pos, db.End
+		it = p.scan()
+	}
+
+	if it.IsKeyword("FROM") {
+		stmt.Sources, err = p.parseSources()
+		if err != nil {
+			return
+		}
+		it = p.scan()
+	}
+
+	if it.IsKeyword("WITH") {
+		start := p.peek().Pos
+		end := start
+		for {
+			it = p.scan()
+			if it.Tok == DIV {
+				it = p.scanRegex(it.Pos)
+			}
+			if it.Tok == EOF || it.Tok == SEMICOLON || it.IsKeyword("WHERE") ||
+				it.IsKeyword("LIMIT") || it.IsKeyword("OFFSET") {
+				break
+			}
+			if it.Tok == ILLEGAL {
+				return nil, ErrUnexpectedToken
+			}
+			end = it.End
+		}
+		stmt.With = strings.TrimSpace(p.sc.s[start:end])
+	}
+	p.unscan(it)
+
+	stmt.Condition, err = p.parseCondition()
+	if err != nil {
+		return
+	}
+
+	start := p.peek().Pos
+	end := start
+	for {
+		it = p.scan()
+		if it.Tok == EOF || it.Tok == SEMICOLON {
+			break
+		}
+		if it.Tok == ILLEGAL {
+			return nil, ErrUnexpectedToken
+		}
+		end = it.End
+	}
+	p.unscan(it)
+	stmt.Tail = strings.TrimSpace(p.sc.s[start:end])
+	return
+}
+
+func (p *Parser) parseInt() (n int, err error) {
+	it := p.scan()
+	if it.Tok != INTEGER {
+		return 0, ErrUnexpectedToken
+	}
+	return strconv.Atoi(it.Lit)
+}
+
+func (p *Parser) parseCondition() (cond Expr, err error) {
+	it := p.scan()
+	if !it.IsKeyword("WHERE") {
+		p.unscan(it)
+		return
+	}
+	return p.ParseExpr()
+}
+
+func (p *Parser) parseFields() (fields []*Field, err error) {
+	for {
+		f := &Field{}
+		f.Expr, err = p.ParseExpr()
+		if err != nil {
+			return
+		}
+
+		it := p.scan()
+		if it.IsKeyword("AS") {
+			alias := p.scan()
+			if alias.Tok != IDENT {
+				return nil, ErrUnexpectedToken
+			}
+			f.Alias = alias.Lit
+			it = p.scan()
+		}
+		fields = append(fields, f)
+
+		if it.Tok != COMMA {
+			p.unscan(it)
+			return
+		}
+	}
+}
+
+func (p *Parser) parseExprList() (exprs []Expr, err error) {
+	for {
+		var e Expr
+		e, err = p.ParseExpr()
+		if err != nil {
+			return
+		}
+		exprs = append(exprs, e)
+
+		it := p.scan()
+		if it.Tok != COMMA {
+			p.unscan(it)
+			return
+		}
+	}
+}
+
+func (p *Parser) parseSources() (sources []*Measurement, err error) {
+	for {
+		var m *Measurement
+		m, err = p.parseSource()
+		if err != nil {
+			return
+		}
+		sources = append(sources, m)
+
+		it := p.scan()
+		if it.Tok != COMMA {
+			p.unscan(it)
+			return
+		}
+	}
+}
+
+// segment of db.rp.name, 1h.cpu is legal.
+func isSegment(it Item) bool {
+	switch it.Tok {
+	case IDENT, DURATION, INTEGER:
+		return true
+	}
+	return false
+}
+
+func (p *Parser) parseSource() (m *Measurement, err error) {
+	it := p.scan()
+	m = &Measurement{Pos: it.Pos}
+
+	if it.Tok == LPAREN {
+		sel := p.scan()
+		if !sel.IsKeyword("SELECT") {
+			return nil, ErrUnexpectedToken
+		}
+		m.SubQuery, err = p.parseSelect()
+		if err != nil {
+			return
+		}
+		it = p.scan()
+		if it.Tok != RPAREN {
+			return nil, ErrUnexpectedToken
+		}
+		m.End = it.End
+		return
+	}
+
+	var segments []string
+	for {
+		switch {
+		case it.Tok == DIV:
+			it = p.scanRegex(it.Pos)
+			if it.Tok != REGEX {
+				return nil, ErrUnexpectedToken
+			}
+			m.Regex = &RegexLiteral{Val: it.Lit}
+			segments = append(segments, "")
+			m.End = it.End
+		case isSegment(it):
+			segments = append(segments, it.Lit)
+			m.End = it.End
+			it = p.scan()
+		case it.Tok == DOT:
+			// db..cpu
+			segments = append(segments, "")
+		default:
+			return nil, ErrUnexpectedToken
+		}
+
+		if m.Regex != nil {
+			break
+		}
+		if it.Tok != DOT {
+			p.unscan(it)
+			break
+		}
+		it = p.scan()
+	}
+
+	if len(segments) > 3 {
+		return nil, ErrUnexpectedToken
+	}
+	m.Name = segments[len(segments)-1]
+	if len(segments) > 1 {
+		m.RetentionPolicy = segments[len(segments)-2]
+	}
+	if len(segments) > 2 {
+		m.Database = segments[0]
+	}
+	return
+}
+
+// ParseExpr parses an expression by precedence climbing.
+func ParseExpr(s string) (e Expr, err error) {
+	p := NewParser(s)
+	e, err = p.ParseExpr()
+	if err != nil {
+		return
+	}
+	if p.scan().Tok != EOF {
+		return nil, ErrUnexpectedToken
+	}
+	return
+}
+
+func (p *Parser) ParseExpr() (e Expr, err error) {
+	return p.parseBinary(1)
+}
+
+func (p *Parser) parseBinary(prec int) (e Expr, err error) {
+	e, err = p.parseUnary()
+	if err != nil {
+		return
+	}
+
+	for {
+		it := p.scan()
+		oprec := it.Tok.Precedence()
+		if oprec == 0 || oprec < prec {
+			p.unscan(it)
+			return
+		}
+
+		var rhs Expr
+		if it.Tok == EQREGEX || it.Tok == NEQREGEX {
+			rhs, err = p.parseUnary()
+		} else {
+			rhs, err = p.parseBinary(oprec + 1)
+		}
+		if err != nil {
+			return
+		}
+		e = &BinaryExpr{Op: it.Tok, LHS: e, RHS: rhs}
+	}
+}
+
+func (p *Parser) parseUnary() (e Expr, err error) {
+	it := p.scan()
+	if it.Tok == SUB || it.Tok == ADD {
+		next := p.peek()
+		e, err = p.parseUnary()
+		if err != nil {
+			return
+		}
+		if n, ok := e.(*NumberLiteral); ok && next.Pos == it.End {
+			if it.Tok == SUB {
+				n.Val = -n.Val
+				n.Raw = "-" + n.Raw
+			}
+			return n, nil
+		}
+		if d, ok := e.(*DurationLiteral); ok && it.Tok == SUB && next.Pos == it.End {
+			d.Val = -d.Val
+			d.Raw = "-" + d.Raw
+			return d, nil
+		}
+		return &UnaryExpr{Op: it.Tok, Expr: e}, nil
+	}
+	p.unscan(it)
+	return p.parsePrimary()
+}
+
+func (p *Parser) parsePrimary() (e Expr, err error) {
+	it := p.scan()
+	switch it.Tok {
+	case LPAREN:
+		e, err = p.ParseExpr()
+		if err != nil {
+			return
+		}
+		if p.scan().Tok != RPAREN {
+			return nil, ErrUnexpectedToken
+		}
+		return &ParenExpr{Expr: e}, nil
+	case STRING:
+		return &StringLiteral{Val: it.Lit}, nil
+	case INTEGER, NUMBER:
+		var f float64
+		f, err = strconv.ParseFloat(it.Lit, 64)
+		if err != nil {
+			return
+		}
+		return &NumberLiteral{Val: f, Raw: it.Lit, IsInt: it.Tok == INTEGER}, nil
+	case DURATION:
+		var d time.Duration
+		d, err = ParseInfluxDuration(it.Lit)
+		if err != nil {
+			return
+		}
+		return &DurationLiteral{Val: d, Raw: it.Lit}, nil
+	case DIV:
+		it = p.scanRegex(it.Pos)
+		if it.Tok != REGEX {
+			return nil, ErrUnexpectedToken
+		}
+		return &RegexLiteral{Val: it.Lit}, nil
+	case MUL:
+		w := &Wildcard{}
+		w.Type, err = p.parseType()
+		return w, err
+	case IDENT:
+		if !it.Quoted {
+			switch strings.ToLower(it.Lit) {
+			case "true":
+				return &BooleanLiteral{Val: true}, nil
+			case "false":
+				return &BooleanLiteral{Val: false}, nil
+			}
+			if p.peek().Tok == LPAREN {
+				return p.parseCall(it)
+			}
+		}
+		v := &VarRef{Val: it.Lit}
+		v.Type, err = p.parseType()
+		return v, err
+	}
+	return nil, ErrUnexpectedToken
+}
+
+func (p *Parser) parseType() (t string, err error) {
+	it := p.scan()
+	if it.Tok != DOUBLECOLON {
+		p.unscan(it)
+		return
+	}
+	it = p.scan()
+	if it.Tok != IDENT {
+		return "", ErrUnexpectedToken
+	}
+	return strings.ToLower(it.Lit), nil
+}
+
+func (p *Parser) parseCall(name Item) (e Expr, err error) {
+	if p.scan().Tok != LPAREN {
+		return nil, ErrUnexpectedToken
+	}
+	c := &Call{Name: strings.ToLower(name.Lit)}
+
+	it := p.scan()
+	if it.Tok == RPAREN {
+		return c, nil
+	}
+
+	// distinct in count(distinct x), but not count(distinct(x))
+	keyword := it.IsKeyword("DISTINCT") && p.peek().Tok != LPAREN
+	if !keyword {
+		p.unscan(it)
+	}
+
+	if keyword {
+		var arg Expr
+		arg, err = p.ParseExpr()
+		if err != nil {
+			return
+		}
+		c.Args = []Expr{&Call{Name: "distinct", Args: []Expr{arg}}}
+	} else {
+		c.Args, err = p.parseExprList()
+		if err != nil {
+			return
+		}
+	}
+
+	if p.scan().Tok != RPAREN {
+		return nil, ErrUnexpectedToken
+	}
+	return c, nil
+}
+
+// helpers on AST
+
+// WalkExpr calls fn for e and all its children, stop going down if fn returns false.
+func WalkExpr(e Expr, fn func(Expr) bool) {
+	if e == nil || !fn(e) {
+		return
+	}
+	switch n := e.(type) {
+	case *BinaryExpr:
+		WalkExpr(n.LHS, fn)
+		WalkExpr(n.RHS, fn)
+	case *ParenExpr:
+		WalkExpr(n.Expr, fn)
+	case *UnaryExpr:
+		WalkExpr(n.Expr, fn)
+	case *Call:
+		for _, arg := range n.Args {
+			WalkExpr(arg, fn)
+		}
+	}
+}
+
+// TagConditions collects tag = 'value' which must all be true,
+// which means they are not under OR or NOT. A tag of two values is
+// ErrConflictTags, no series has it.
+func TagConditions(cond Expr) (tags map[string]string, err error) {
+	tags = make(map[string]string)
+	var collect func(Expr)
+	collect = func(e Expr) {
+		switch n := e.(type) {
+		case *ParenExpr:
+			collect(n.Expr)
+		case *BinaryExpr:
+			switch n.Op {
+			case AND:
+				collect(n.LHS)
+				collect(n.RHS)
+			case EQ:
+				ref, ok1 := n.LHS.(*VarRef)
+				val, ok2 := n.RHS.(*StringLiteral)
+				if !ok1 || !ok2 {
+					ref, ok1 = n.RHS.(*VarRef)
+					val, ok2 = n.LHS.(*StringLiteral)
+				}
+				if ok1 && ok2 && ref.Type != "field" {
+					if e := addTagCondition(tags, ref.Val, val.Val); e != nil {
+						err = e
+					}
+				}
+			}
+		}
+	}
+	if cond != nil {
+		collect(cond)
+	}
+	return
+}
+
+// addTagCondition adds tag = value to tags, a tag can't be two values.
+func addTagCondition(tags map[string]string, tag string, value string) (err error) {
+	if v, ok := tags[tag]; ok && v != value {
+		return ErrConflictTags
+	}
+	tags[tag] = value
+	return
+}
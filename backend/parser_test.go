@@ -0,0 +1,257 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSelect(t *testing.T) {
+	tests := []struct {
+		q    string
+		want string
+	}{
+		{
+			q:    "select * from cpu",
+			want: "SELECT * FROM cpu",
+		},
+		{
+			q:    "SELECT mean(\"value\") FROM \"cpu\" WHERE \"region\" = 'uswest' GROUP BY time(10m) fill(0)",
+			want: "SELECT mean(value) FROM cpu WHERE region = 'uswest' GROUP BY time(10m) fill(0)",
+		},
+		{
+			q:    "select cpu_load from \"cpu.load\" WHERE time > now() - 1m and host =~ /^(a|b)$/",
+			want: "SELECT cpu_load FROM \"cpu.load\" WHERE time > now() - 1m AND host =~ /^(a|b)$/",
+		},
+		{
+			q:    "SELECT max(v) AS m, v / 2 FROM \"db\".\"rp\".cpu, db..mem WHERE (a = 'x' OR b::tag = 'y') GROUP BY host, time(1h30m, 5m) ORDER BY time DESC LIMIT 10 SLIMIT 2 tz('Asia/Shanghai')",
+			want: "SELECT max(v) AS m, v / 2 FROM db.rp.cpu, db..mem WHERE (a = 'x' OR b::tag = 'y') GROUP BY host, time(1h30m, 5m) ORDER BY time DESC LIMIT 10 SLIMIT 2 tz('Asia/Shanghai')",
+		},
+		{
+			q:    "SELECT mean(\"value\") INTO \"cpu_1h\".:MEASUREMENT FROM /cpu.*/ WHERE time > -1h",
+			want: "SELECT mean(value) INTO \"cpu_1h\".:MEASUREMENT FROM /cpu.*/ WHERE time > -1h",
+		},
+		{
+			q:    "SELECT count(distinct host) FROM (SELECT last(v) FROM cpu GROUP BY host) -- comment",
+			want: "SELECT count(distinct(host)) FROM (SELECT last(v) FROM cpu GROUP BY host)",
+		},
+		{
+			q:    "SELECT \"select\", 'it''s' FROM /* c */ 1h.cpu WHERE time >= '2017-01-01T00:00:00Z'",
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		stmts, err := ParseQuery(tt.q)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: illegal query passed", tt.q)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.q, err)
+			continue
+		}
+		if len(stmts) != 1 {
+			t.Errorf("%s: %d statements", tt.q, len(stmts))
+			continue
+		}
+		if s := stmts[0].String(); s != tt.want {
+			t.Errorf("%s:\n%s\n%s", tt.q, s, tt.want)
+			continue
+		}
+
+		// parse its own output
+		again, err := ParseQuery(stmts[0].String())
+		if err != nil || again[0].String() != tt.want {
+			t.Errorf("%s: not stable, %v", tt.q, err)
+		}
+	}
+}
+
+func TestParseShow(t *testing.T) {
+	tests := []struct {
+		q       string
+		kind    string
+		sources string
+		want    string
+	}{
+		{
+			q:       "SHOW TAG KEYS FROM \"cpu\" WHERE \"region\" = 'uswest'",
+			kind:    "TAG KEYS",
+			sources: "cpu",
+			want:    "SHOW TAG KEYS FROM cpu WHERE region = 'uswest'",
+		},
+		{
+			q:       "SHOW TAG VALUES FROM \"cpu\" WITH KEY IN (\"region\", \"host\") WHERE \"service\" = 'redis' LIMIT 3",
+			kind:    "TAG VALUES",
+			sources: "cpu",
+			want:    "SHOW TAG VALUES FROM cpu WITH KEY IN (\"region\", \"host\") WHERE service = 'redis' LIMIT 3",
+		},
+		{
+			q:       "SHOW MEASUREMENTS WITH MEASUREMENT =~ /h2o.*/",
+			kind:    "MEASUREMENTS",
+			sources: "",
+			want:    "SHOW MEASUREMENTS WITH MEASUREMENT =~ /h2o.*/",
+		},
+		{
+			q:       "show field keys on mydb from \"1h\".\"cpu.load\"",
+			kind:    "field keys",
+			sources: "\"1h\".\"cpu.load\"",
+			want:    "SHOW field keys ON mydb FROM \"1h\".\"cpu.load\"",
+		},
+	}
+
+	for _, tt := range tests {
+		stmts, err := ParseQuery(tt.q)
+		if err != nil {
+			t.Errorf("%s: %s", tt.q, err)
+			continue
+		}
+		show, ok := stmts[0].(*ShowStatement)
+		if !ok {
+			t.Errorf("%s: not show", tt.q)
+			continue
+		}
+		if show.Kind != tt.kind || joinSources(show.Sources) != tt.sources {
+			t.Errorf("%s: %s, %s", tt.q, show.Kind, joinSources(show.Sources))
+		}
+		if s := show.String(); s != tt.want {
+			t.Errorf("%s:\n%s\n%s", tt.q, s, tt.want)
+		}
+	}
+}
+
+func TestParseSources(t *testing.T) {
+	q := "SELECT v FROM \"db\".\"rp\".\"cpu.load\", 1h.mem, /disk/"
+	stmts, err := ParseQuery(q)
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	sources := stmts[0].(*SelectStatement).Sources
+	if len(sources) != 3 {
+		t.Errorf("sources wrong: %d", len(sources))
+		return
+	}
+
+	m := sources[0]
+	if m.Database != "db" || m.RetentionPolicy != "rp" || m.Name != "cpu.load" {
+		t.Errorf("source wrong: %#v", m)
+	}
+	if q[m.Pos:m.End] != "\"db\".\"rp\".\"cpu.load\"" {
+		t.Errorf("position wrong: %s", q[m.Pos:m.End])
+	}
+
+	m = sources[1]
+	if m.Database != "" || m.RetentionPolicy != "1h" || m.Name != "mem" {
+		t.Errorf("source wrong: %#v", m)
+	}
+
+	m = sources[2]
+	if m.Regex == nil || m.Regex.Val != "disk" || q[m.Pos:m.End] != "/disk/" {
+		t.Errorf("source wrong: %#v", m)
+	}
+}
+
+func TestParseMultiStatements(t *testing.T) {
+	stmts, err := ParseQuery("SELECT v FROM cpu; SELECT v FROM mem;")
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	if len(stmts) != 2 || stmts[1].String() != "SELECT v FROM mem" {
+		t.Errorf("statements wrong: %v", stmts)
+	}
+
+	_, err = ParseQuery("DROP MEASUREMENT cpu")
+	if err != ErrUnsupportedStatement {
+		t.Errorf("drop should not be supported: %v", err)
+	}
+}
+
+func TestParseInfluxDuration(t *testing.T) {
+	tests := []struct {
+		s string
+		d time.Duration
+	}{
+		{"10m", 10 * time.Minute},
+		{"1h30m", 90 * time.Minute},
+		{"2w", 14 * 24 * time.Hour},
+		{"5ms", 5 * time.Millisecond},
+		{"3u", 3 * time.Microsecond},
+	}
+	for _, tt := range tests {
+		d, err := ParseInfluxDuration(tt.s)
+		if err != nil || d != tt.d {
+			t.Errorf("%s: %s, %v", tt.s, d, err)
+		}
+		if s := FormatInfluxDuration(d); s != tt.s && tt.s != "1h30m" {
+			t.Errorf("%s: format to %s", tt.s, s)
+		}
+	}
+
+	_, err := ParseInfluxDuration("10x")
+	if err == nil {
+		t.Errorf("illegal duration passed")
+	}
+}
+
+func TestTagConditions(t *testing.T) {
+	tests := []struct {
+		cond string
+		want map[string]string
+	}{
+		{"tenant = 'foo' AND time > now() - 1h", map[string]string{"tenant": "foo"}},
+		{"('foo' = tenant AND (host = 'a')) AND v > 1", map[string]string{"tenant": "foo", "host": "a"}},
+		{"tenant = 'foo' OR tenant = 'bar'", map[string]string{}},
+		{"tenant::tag = 'foo' AND v::field = 'x'", map[string]string{"tenant": "foo"}},
+		{"tenant =~ /foo/", map[string]string{}},
+		{"tenant = 'foo' AND (tenant = 'foo' OR host = 'a')", map[string]string{"tenant": "foo"}},
+	}
+
+	for _, tt := range tests {
+		cond, err := ParseExpr(tt.cond)
+		if err != nil {
+			t.Errorf("%s: %s", tt.cond, err)
+			continue
+		}
+		tags, err := TagConditions(cond)
+		if err != nil || len(tags) != len(tt.want) {
+			t.Errorf("%s: %v", tt.cond, tags)
+			continue
+		}
+		for k, v := range tt.want {
+			if tags[k] != v {
+				t.Errorf("%s: %v", tt.cond, tags)
+			}
+		}
+	}
+}
+
+func TestTagConditionsConflict(t *testing.T) {
+	cond, err := ParseExpr("tenant = 'foo' AND host = 'a' AND tenant = 'bar'")
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	_, err = TagConditions(cond)
+	if err != ErrConflictTags {
+		t.Errorf("conflict not found: %v", err)
+	}
+}
+
+func BenchmarkParseQuery(b *testing.B) {
+	q := "SELECT mean(\"value\") FROM \"cpu\" WHERE \"region\" = 'uswest' AND time > now() - 1h GROUP BY time(10m) fill(0)"
+	for i := 0; i < b.N; i++ {
+		_, err := ParseQuery(q)
+		if err != nil {
+			b.Errorf("error: %s", err)
+			return
+		}
+	}
+}
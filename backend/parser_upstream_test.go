@@ -0,0 +1,70 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+
+	"github.com/influxdata/influxdb/influxql"
+)
+
+// upstreamString is q as influxql of influxdb prints it.
+func upstreamString(t *testing.T, q string) string {
+	stmt, err := influxql.ParseStatement(q)
+	if err != nil {
+		t.Errorf("%s: influxql error: %s", q, err)
+		return ""
+	}
+	return stmt.String()
+}
+
+// Statements we print should mean the same to influxdb as the ones parsed.
+func TestParseRoundTripUpstream(t *testing.T) {
+	tests := []string{
+		"select * from cpu",
+		"SELECT mean(\"value\") FROM \"cpu\" WHERE \"region\" = 'uswest' GROUP BY time(10m) fill(0)",
+		"select cpu_load from \"cpu.load\" WHERE time > now() - 1m and host =~ /^(a|b)$/",
+		"SELECT max(v) AS m, v / 2 FROM \"db\".\"rp\".cpu, db..mem WHERE (a = 'x' OR b::tag = 'y') GROUP BY host, time(1h30m, 5m) ORDER BY time DESC LIMIT 10 SLIMIT 2",
+		"SELECT mean(\"value\") INTO \"cpu_1h\".:MEASUREMENT FROM /cpu.*/ WHERE time > now() - 1h GROUP BY time(1m), *",
+		"SELECT count(v) FROM cpu WHERE host != 'a\\'b' AND time >= '2017-01-01T00:00:00Z' LIMIT 5 OFFSET 10 SLIMIT 2 SOFFSET 1",
+		"SELECT v * 2 + u FROM cpu WHERE v > -1.5 AND host !~ /^web/",
+		"SHOW TAG KEYS FROM \"cpu\" WHERE \"region\" = 'uswest'",
+		"SHOW TAG VALUES FROM \"cpu\" WITH KEY IN (\"region\", \"host\") WHERE \"service\" = 'redis' LIMIT 3",
+		"SHOW MEASUREMENTS WITH MEASUREMENT =~ /h2o.*/",
+		"show field keys from \"1h\".\"cpu.load\"",
+	}
+
+	for _, q := range tests {
+		stmts, err := ParseQuery(q)
+		if err != nil || len(stmts) != 1 {
+			t.Errorf("%s: %v", q, err)
+			continue
+		}
+		ours := stmts[0].String()
+		if got, want := upstreamString(t, ours), upstreamString(t, q); got != want {
+			t.Errorf("%s:\n%s\n%s", q, got, want)
+		}
+	}
+}
+
+// Queries planned for shards must still be valid to influxdb.
+func TestPlanQueryUpstream(t *testing.T) {
+	tests := []string{
+		"SELECT v FROM cpu LIMIT 10 OFFSET 5 SLIMIT 2 SOFFSET 1",
+		"SELECT mean(v), count(v), max(v) AS top FROM cpu WHERE time > now() - 1h GROUP BY time(10m), host fill(0)",
+		"SELECT spread(v), mean(v) * 2 FROM cpu WHERE time > now() - 1h",
+	}
+
+	for _, q := range tests {
+		plan, err := PlanQuery(q)
+		if err != nil {
+			t.Errorf("%s: %s", q, err)
+			continue
+		}
+		if _, err = influxql.ParseQuery(plan.Query); err != nil {
+			t.Errorf("%s: %s is invalid, %s", q, plan.Query, err)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	STMT_SELECT = "select"
+	STMT_SHOW   = "show"
+	STMT_ADMIN  = "admin"
+)
+
+// AuthzError tells what a user is not authorized to do.
+type AuthzError struct {
+	User     string
+	Action   string
+	Resource string
+}
+
+func (e *AuthzError) Error() string {
+	return "user " + QuoteString(e.User) + " not authorized to " + e.Action + " " + e.Resource
+}
+
+type aclRule struct {
+	db  *regexp.Regexp
+	m   *regexp.Regexp
+	all bool // matches every measurement
+}
+
+// acl is a list of patterns like db:measurement in globs, a pattern without
+// measurement is the whole db. Patterns start with ! deny, they win.
+type acl struct {
+	allow []*aclRule
+	deny  []*aclRule
+}
+
+func newACL(patterns []string) (a *acl, err error) {
+	a = &acl{}
+	for _, pattern := range patterns {
+		deny := strings.HasPrefix(pattern, "!")
+		if deny {
+			pattern = pattern[1:]
+		}
+
+		db, m := pattern, "*"
+		if i := strings.IndexByte(pattern, ':'); i != -1 {
+			db, m = pattern[:i], pattern[i+1:]
+		}
+		r := &aclRule{all: m == "*"}
+		r.db, err = regexp.Compile(GlobToRegexp(db))
+		if err != nil {
+			return
+		}
+		r.m, err = regexp.Compile(GlobToRegexp(m))
+		if err != nil {
+			return
+		}
+
+		if deny {
+			a.deny = append(a.deny, r)
+		} else {
+			a.allow = append(a.allow, r)
+		}
+	}
+	return
+}
+
+// Match tells if measurement m of db is allowed.
+func (a *acl) Match(db, m string) bool {
+	for _, r := range a.deny {
+		if r.db.MatchString(db) && r.m.MatchString(m) {
+			return false
+		}
+	}
+	for _, r := range a.allow {
+		if r.db.MatchString(db) && r.m.MatchString(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchAll tells if every measurement of db is allowed,
+// for regex sources and statements without sources.
+func (a *acl) MatchAll(db string) bool {
+	for _, r := range a.deny {
+		if r.db.MatchString(db) {
+			return false
+		}
+	}
+	for _, r := range a.allow {
+		if r.all && r.db.MatchString(db) {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy is what a user is authorized to do.
+type Policy struct {
+	User       string
+	Admin      bool
+	read       *acl
+	write      *acl
+	statements map[string]bool
+}
+
+func NewPolicy(user string, cfg *UserConfig) (p *Policy, err error) {
+	p = &Policy{
+		User:       user,
+		Admin:      cfg.Admin,
+		statements: make(map[string]bool),
+	}
+	p.read, err = newACL(cfg.Read)
+	if err != nil {
+		return
+	}
+	p.write, err = newACL(cfg.Write)
+	if err != nil {
+		return
+	}
+	for _, stmt := range cfg.Statements {
+		p.statements[strings.ToLower(stmt)] = true
+	}
+	return
+}
+
+func (p *Policy) CanWrite(db, m string) bool {
+	return p.write.Match(db, m)
+}
+
+func (p *Policy) CanRead(db, m string) bool {
+	return p.read.Match(db, m)
+}
+
+// StatementType is select, show, or admin for all the others.
+func StatementType(q string) string {
+	fields := strings.Fields(q)
+	if len(fields) == 0 {
+		return STMT_ADMIN
+	}
+	switch strings.ToLower(fields[0]) {
+	case STMT_SELECT:
+		return STMT_SELECT
+	case STMT_SHOW:
+		return STMT_SHOW
+	}
+	return STMT_ADMIN
+}
+
+// AuthorizeQuery checks types of statements in q, and every source they
+// read or write. Sources without db are in db of request.
+func (p *Policy) AuthorizeQuery(q string, db string) (err error) {
+	stmts, err := ParseQuery(q)
+	if err != nil {
+		// the parser doesn't know one of them, check them one by one.
+		parts := SplitStatements(q)
+		if len(parts) > 1 {
+			for _, part := range parts {
+				err = p.AuthorizeQuery(part, db)
+				if err != nil {
+					return
+				}
+			}
+			return nil
+		}
+		return p.authorizeUnparsed(q, db)
+	}
+
+	for _, stmt := range stmts {
+		switch stmt := stmt.(type) {
+		case *SelectStatement:
+			if !p.statements[STMT_SELECT] {
+				return &AuthzError{User: p.User, Action: "run", Resource: STMT_SELECT}
+			}
+			err = p.authorizeSources(stmt.Sources, db)
+			if err == nil && stmt.Into != "" {
+				err = p.authorizeInto(stmt, db)
+			}
+		case *ShowStatement:
+			if !p.statements[STMT_SHOW] {
+				return &AuthzError{User: p.User, Action: "run", Resource: STMT_SHOW}
+			}
+			showdb := db
+			if stmt.Database != "" {
+				showdb = stmt.Database
+			}
+			if len(stmt.Sources) == 0 && !p.read.MatchAll(showdb) {
+				return &AuthzError{User: p.User, Action: "read", Resource: showdb}
+			}
+			err = p.authorizeSources(stmt.Sources, showdb)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// authorizeUnparsed checks a statement the parser doesn't know as a whole.
+// Selects and shows are parsed, if they can't, their sources are unknown.
+// The others, like delete and drop series, change the measurement.
+func (p *Policy) authorizeUnparsed(q string, db string) (err error) {
+	stmt := StatementType(q)
+	if stmt != STMT_ADMIN {
+		return &AuthzError{User: p.User, Action: "run", Resource: "unparsed " + stmt}
+	}
+	if !p.statements[stmt] {
+		return &AuthzError{User: p.User, Action: "run", Resource: stmt}
+	}
+	m, err := GetMeasurementFromInfluxQL(q)
+	if err != nil || !p.CanWrite(db, m) {
+		return &AuthzError{User: p.User, Action: "write", Resource: db + ":" + m}
+	}
+	return nil
+}
+
+// authorizeInto checks the user can write the measurement stmt writes into.
+// :MEASUREMENT writes into the ones of sources.
+func (p *Policy) authorizeInto(stmt *SelectStatement, db string) (err error) {
+	into := stmt.Into
+	backref := strings.HasSuffix(strings.ToUpper(into), ":MEASUREMENT")
+	if backref {
+		into = into[:len(into)-len(":MEASUREMENT")] + "m"
+	}
+	target, err := NewParser(into).parseSource()
+	if err != nil || target.Regex != nil || target.SubQuery != nil {
+		return &AuthzError{User: p.User, Action: "write", Resource: stmt.Into}
+	}
+	intodb := db
+	if target.Database != "" {
+		intodb = target.Database
+	}
+	if !backref {
+		if !p.CanWrite(intodb, target.Name) {
+			return &AuthzError{User: p.User, Action: "write", Resource: intodb + ":" + target.Name}
+		}
+		return nil
+	}
+	return p.authorizeIntoSources(stmt.Sources, intodb)
+}
+
+func (p *Policy) authorizeIntoSources(sources []*Measurement, intodb string) (err error) {
+	for _, m := range sources {
+		switch {
+		case m.SubQuery != nil:
+			err = p.authorizeIntoSources(m.SubQuery.Sources, intodb)
+			if err != nil {
+				return
+			}
+		case m.Regex != nil:
+			if !p.write.MatchAll(intodb) {
+				return &AuthzError{User: p.User, Action: "write", Resource: intodb + ":" + m.Regex.String()}
+			}
+		case !p.CanWrite(intodb, m.Name):
+			return &AuthzError{User: p.User, Action: "write", Resource: intodb + ":" + m.Name}
+		}
+	}
+	return
+}
+
+func (p *Policy) authorizeSources(sources []*Measurement, db string) (err error) {
+	for _, m := range sources {
+		if m.SubQuery != nil {
+			err = p.authorizeSources(m.SubQuery.Sources, db)
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		mdb := db
+		if m.Database != "" {
+			mdb = m.Database
+		}
+		if m.Regex != nil {
+			if !p.read.MatchAll(mdb) {
+				return &AuthzError{User: p.User, Action: "read", Resource: mdb + ":" + m.Regex.String()}
+			}
+			continue
+		}
+		if !p.CanRead(mdb, m.Name) {
+			return &AuthzError{User: p.User, Action: "read", Resource: mdb + ":" + m.Name}
+		}
+	}
+	return
+}
@@ -0,0 +1,138 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+)
+
+func TestPolicyQuery(t *testing.T) {
+	policy, err := NewPolicy("grafana", &UserConfig{
+		Read:       []string{"team_a", "team_b:cpu*", "!team_a:secret*"},
+		Statements: []string{"select", "show"},
+	})
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+
+	tests := []struct {
+		q  string
+		db string
+		ok bool
+	}{
+		{"SELECT v FROM cpu WHERE time > 0", "team_a", true},
+		{"SELECT v FROM secret_keys WHERE time > 0", "team_a", false},
+		{"SELECT v FROM team_b..cpu_idle WHERE time > 0", "team_a", true},
+		{"SELECT v FROM team_b..mem WHERE time > 0", "team_a", false},
+		{"SELECT v FROM cpu WHERE time > 0; SELECT v FROM mem WHERE time > 0", "team_b", false},
+		{"SELECT max(v) FROM (SELECT v FROM team_b..mem) WHERE time > 0", "team_a", false},
+		{"SELECT v FROM /cpu.*/ WHERE time > 0", "team_b", false},
+		{"SHOW MEASUREMENTS", "team_b", false},
+		{"SHOW TAG KEYS FROM cpu", "team_b", true},
+		{"DROP MEASUREMENT cpu", "team_a", false},
+	}
+	for _, tt := range tests {
+		err := policy.AuthorizeQuery(tt.q, tt.db)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s on %s: %v", tt.q, tt.db, err)
+		}
+	}
+
+	// a deny on the db forbids regex sources, which may read anything.
+	err = policy.AuthorizeQuery("SELECT v FROM /cpu.*/ WHERE time > 0", "team_a")
+	if _, ok := err.(*AuthzError); !ok {
+		t.Errorf("regex source passed: %v", err)
+	}
+}
+
+func TestPolicyQueryStatements(t *testing.T) {
+	policy, err := NewPolicy("grafana", &UserConfig{
+		Read:       []string{"test:cpu", "test:mem"},
+		Write:      []string{"test:cpu_1h"},
+		Statements: []string{"select"},
+	})
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+
+	tests := []struct {
+		q  string
+		ok bool
+	}{
+		// the parser doesn't know delete, every statement is checked still.
+		{"SELECT v FROM cpu WHERE time > now() - 1h; DELETE FROM secret", false},
+		{"DELETE FROM secret; SELECT v FROM cpu WHERE time > now() - 1h", false},
+		{"SELECT v FROM cpu WHERE time > now() - 1h; SELECT v FROM mem WHERE time > now() - 1h", true},
+		{"SELECT v FROM cpu WHERE host = 'a;b' AND time > now() - 1h", true},
+		{"SELECT v FROM cpu WHERE time > now() - 1h; SELECT FROM", false},
+		{"SELECT v INTO cpu_1h FROM cpu WHERE time > now() - 1h", true},
+		{"SELECT v INTO secret FROM cpu WHERE time > now() - 1h", false},
+		{"SELECT v INTO other..cpu_1h FROM cpu WHERE time > now() - 1h", false},
+		{"SELECT v INTO test..:MEASUREMENT FROM cpu WHERE time > now() - 1h", false},
+	}
+	for _, tt := range tests {
+		err := policy.AuthorizeQuery(tt.q, "test")
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.q, err)
+		}
+	}
+
+	policy, err = NewPolicy("admin", &UserConfig{
+		Read:       []string{"test"},
+		Write:      []string{"test"},
+		Statements: []string{"select", "admin"},
+	})
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	for _, q := range []string{
+		"SELECT v FROM cpu WHERE time > now() - 1h; DELETE FROM cpu",
+		"SELECT v INTO test..:MEASUREMENT FROM cpu, mem WHERE time > now() - 1h",
+	} {
+		if err = policy.AuthorizeQuery(q, "test"); err != nil {
+			t.Errorf("%s: %v", q, err)
+		}
+	}
+
+	// deletes change data, reading isn't enough.
+	policy, err = NewPolicy("reader", &UserConfig{
+		Read:       []string{"test"},
+		Write:      []string{"test:cpu_1h"},
+		Statements: []string{"select", "admin"},
+	})
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	for _, q := range []string{
+		"DELETE FROM cpu WHERE time < now() - 1h",
+		"DROP SERIES FROM cpu WHERE host = 'a'",
+		"DROP MEASUREMENT cpu",
+	} {
+		err = policy.AuthorizeQuery(q, "test")
+		if e, ok := err.(*AuthzError); !ok || e.Action != "write" {
+			t.Errorf("%s: %v", q, err)
+		}
+	}
+	if err = policy.AuthorizeQuery("DELETE FROM cpu_1h", "test"); err != nil {
+		t.Errorf("delete of writable measurement: %v", err)
+	}
+}
+
+func TestPolicyWrite(t *testing.T) {
+	policy, err := NewPolicy("collector", &UserConfig{Write: []string{"*:cpu*", "!*:cpu.secret"}})
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+
+	if !policy.CanWrite("team_a", "cpu.load") || policy.CanWrite("team_a", "cpu.secret") ||
+		policy.CanWrite("team_a", "mem") || policy.CanRead("team_a", "cpu") {
+		t.Errorf("policy wrong")
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strconv"
+)
+
+const (
+	RING_VNODES = 160
+)
+
+// HashRing is a consistent hash ring over named shards.
+// Adding or removing a shard only moves the keys of its neighbours.
+type HashRing struct {
+	points []uint32
+	owners []int
+}
+
+type ringPoint struct {
+	hash  uint32
+	owner int
+}
+
+func hashKey(key []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32()
+}
+
+func NewHashRing(names []string, vnodes int) (hr *HashRing) {
+	points := make([]ringPoint, 0, len(names)*vnodes)
+	for i, name := range names {
+		for j := 0; j < vnodes; j++ {
+			points = append(points, ringPoint{
+				hash:  hashKey([]byte(name + "#" + strconv.Itoa(j))),
+				owner: i,
+			})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].owner < points[j].owner
+	})
+
+	hr = &HashRing{
+		points: make([]uint32, len(points)),
+		owners: make([]int, len(points)),
+	}
+	for i, p := range points {
+		hr.points[i] = p.hash
+		hr.owners[i] = p.owner
+	}
+	return
+}
+
+// Get returns the index of the shard which owns key.
+func (hr *HashRing) Get(key []byte) int {
+	h := hashKey(key)
+	i := sort.Search(len(hr.points), func(i int) bool {
+		return hr.points[i] >= h
+	})
+	if i == len(hr.points) {
+		i = 0
+	}
+	return hr.owners[i]
+}
+
+// SeriesKey returns the measurement and the tags sorted by key of a point,
+// still escaped, like cpu,host=a,region=b.
+func SeriesKey(pointbuf []byte) (key []byte, err error) {
+	var parts [][]byte
+	start := 0
+	for i := 0; i < len(pointbuf); i++ {
+		switch pointbuf[i] {
+		case '\\':
+			i++
+		case ',':
+			parts = append(parts, pointbuf[start:i])
+			start = i + 1
+		case ' ':
+			parts = append(parts, pointbuf[start:i])
+			if len(parts) == 1 {
+				return parts[0], nil
+			}
+
+			tags := parts[1:]
+			sort.Slice(tags, func(i, j int) bool {
+				return bytes.Compare(tagKey(tags[i]), tagKey(tags[j])) < 0
+			})
+			return bytes.Join(parts, []byte{','}), nil
+		}
+	}
+	return nil, io.EOF
+}
+
+func tagKey(tag []byte) []byte {
+	for i := 0; i < len(tag); i++ {
+		switch tag[i] {
+		case '\\':
+			i++
+		case '=':
+			return tag[:i]
+		}
+	}
+	return tag
+}
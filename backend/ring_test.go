@@ -0,0 +1,127 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSeriesKey(t *testing.T) {
+	tests := []struct {
+		point string
+		key   string
+	}{
+		{"cpu value=1", "cpu"},
+		{"cpu,region=uswest,host=server01 value=1 1434055562000000000", "cpu,host=server01,region=uswest"},
+		{"cpu,host=server01,region=uswest value=1 1434055562000000000", "cpu,host=server01,region=uswest"},
+		{"c\\ pu,b\\,x=1,a=2 value=1", "c\\ pu,a=2,b\\,x=1"},
+		{"cpu,ab=1,a=2 value=1", "cpu,a=2,ab=1"},
+	}
+
+	for _, tt := range tests {
+		key, err := SeriesKey([]byte(tt.point))
+		if err != nil {
+			t.Errorf("%s: %s", tt.point, err)
+			continue
+		}
+		if string(key) != tt.key {
+			t.Errorf("%s: %s, want %s", tt.point, key, tt.key)
+		}
+	}
+
+	_, err := SeriesKey([]byte("cpu"))
+	if err == nil {
+		t.Errorf("illegal point passed")
+	}
+}
+
+func TestHashRing(t *testing.T) {
+	hr := NewHashRing([]string{"a", "b", "c"}, RING_VNODES)
+
+	counts := make([]int, 3)
+	owners := make(map[string]int)
+	for i := 0; i < 30000; i++ {
+		key := fmt.Sprintf("cpu,host=server%d", i)
+		owner := hr.Get([]byte(key))
+		counts[owner]++
+		owners[key] = owner
+	}
+	for i, c := range counts {
+		if c < 7000 || c > 13000 {
+			t.Errorf("shard %d is unbalanced: %v", i, counts)
+		}
+	}
+
+	// add a shard, only the keys moved to it change owner.
+	hr = NewHashRing([]string{"a", "b", "c", "d"}, RING_VNODES)
+	moved := 0
+	for key, owner := range owners {
+		now := hr.Get([]byte(key))
+		if now == owner {
+			continue
+		}
+		if now != 3 {
+			t.Errorf("%s moved from %d to %d", key, owner, now)
+			return
+		}
+		moved++
+	}
+	if moved < 4000 || moved > 11000 {
+		t.Errorf("%d keys moved", moved)
+	}
+}
+
+func TestShardedRoute(t *testing.T) {
+	var bs []BackendAPI
+	names := []string{"a1", "a2", "b1", "b2"}
+	for _, name := range names {
+		bs = append(bs, &HttpBackend{URL: name})
+	}
+
+	_, err := NewShardedRoute(bs[:3], names[:3], 2)
+	if err == nil {
+		t.Errorf("3 backends can't be split into shards of 2")
+	}
+
+	rt, err := NewShardedRoute(bs, names, 2)
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	if !rt.IsSharded() || len(rt.Shards) != 2 {
+		t.Errorf("shards wrong: %v", rt.Shards)
+		return
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		shard := rt.GetShard([]byte(fmt.Sprintf("cpu,host=server%d", i)))
+		if len(shard) != 2 {
+			t.Errorf("replicas wrong: %v", shard)
+			return
+		}
+		first := shard[0].(*HttpBackend).URL
+		second := shard[1].(*HttpBackend).URL
+		if first[0] != second[0] {
+			t.Errorf("replicas from different shards: %s, %s", first, second)
+		}
+		seen[first] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("not all shards used: %v", seen)
+	}
+}
+
+func BenchmarkSeriesKey(b *testing.B) {
+	line := []byte("cpu,region=uswest,host=server01,dc=a value=1 1434055562000000000")
+	for i := 0; i < b.N; i++ {
+		_, err := SeriesKey(line)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+	}
+}
@@ -0,0 +1,419 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	DEFAULT_KEY = "_default_"
+)
+
+var (
+	ErrUnknownMatch     = errors.New("unknown match type")
+	ErrIllegalShards    = errors.New("backends can't be split into shards")
+	ErrShardUnavailable = errors.New("no backend available in shard")
+)
+
+// GlobToRegexp translates a glob into an anchored regexp.
+// * matches any string, ? matches one char, [...] is a char class.
+func GlobToRegexp(glob string) (s string) {
+	var buf bytes.Buffer
+	buf.WriteByte('^')
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			buf.WriteString(".*")
+		case '?':
+			buf.WriteByte('.')
+		case '[':
+			end := bytes.IndexByte([]byte(glob[i:]), ']')
+			if end == -1 {
+				buf.WriteString(regexp.QuoteMeta(glob[i:]))
+				i = len(glob)
+				continue
+			}
+			class := glob[i+1 : i+end]
+			if class == "" || class == "!" {
+				// an empty class matches nothing, take [ as it is.
+				buf.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			if len(class) > 0 && class[0] == '!' {
+				class = "^" + class[1:]
+			}
+			buf.WriteByte('[')
+			buf.WriteString(class)
+			buf.WriteByte(']')
+			i += end
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			buf.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteByte('$')
+	return buf.String()
+}
+
+// RouteKey is what a point or a query is routed by.
+// Tags is nil unless the router needs them.
+type RouteKey struct {
+	DB          string
+	RP          string
+	Measurement string
+	Tags        map[string]string
+}
+
+// Route is where a measurement goes. Without a ring every backend gets
+// every point. With a ring, Backends are split into Shards of replicas,
+// each point goes to the replicas of one shard by its series key.
+type Route struct {
+	Backends []BackendAPI
+	Shards   [][]BackendAPI
+	ring     *HashRing
+}
+
+func NewRoute(backends []BackendAPI) (rt *Route) {
+	return &Route{Backends: backends}
+}
+
+// NewShardedRoute splits backends into shards of replicas, in order.
+// names are used to place the shards on the ring.
+func NewShardedRoute(backends []BackendAPI, names []string, replicas int) (rt *Route, err error) {
+	if replicas <= 0 || len(backends) == 0 || len(backends)%replicas != 0 || len(names) != len(backends) {
+		return nil, ErrIllegalShards
+	}
+
+	rt = &Route{Backends: backends}
+	var shardnames []string
+	for i := 0; i < len(backends); i += replicas {
+		rt.Shards = append(rt.Shards, backends[i:i+replicas])
+		shardnames = append(shardnames, strings.Join(names[i:i+replicas], "|"))
+	}
+	rt.ring = NewHashRing(shardnames, RING_VNODES)
+	return
+}
+
+func (rt *Route) IsSharded() bool {
+	return rt.ring != nil
+}
+
+// GetShard returns the replicas which the series should be written to.
+func (rt *Route) GetShard(serieskey []byte) (backends []BackendAPI) {
+	if rt.ring == nil {
+		return rt.Backends
+	}
+	return rt.Shards[rt.ring.Get(serieskey)]
+}
+
+// Rule routes the measurements, or the tag values, matched by a regexp.
+type Rule struct {
+	Name     string
+	Priority int
+	Tag      string
+	DB       string
+	RP       string
+	re       *regexp.Regexp
+	route    *Route
+}
+
+func NewRule(name string, cfg *RuleConfig, backends map[string]BackendAPI) (rule *Rule, err error) {
+	rule = &Rule{
+		Name:     name,
+		Priority: cfg.Priority,
+		Tag:      cfg.Tag,
+		DB:       cfg.DB,
+		RP:       cfg.RP,
+	}
+
+	pattern := cfg.Pattern
+	switch cfg.Match {
+	case "regex":
+	case "glob":
+		pattern = GlobToRegexp(pattern)
+	default:
+		err = ErrUnknownMatch
+		log.Printf("rule %s: %s %s", name, err, cfg.Match)
+		return
+	}
+
+	rule.re, err = regexp.Compile(pattern)
+	if err != nil {
+		log.Printf("rule %s: %s", name, err)
+		return
+	}
+
+	var bss []BackendAPI
+	for _, bs_name := range cfg.Backends {
+		bs, ok := backends[bs_name]
+		if !ok {
+			err = ErrBackendNotExist
+			log.Println(bs_name, err)
+			continue
+		}
+		bss = append(bss, bs)
+	}
+	if err != nil {
+		return
+	}
+
+	if cfg.Replicas == 0 {
+		rule.route = NewRoute(bss)
+		return
+	}
+
+	rule.route, err = NewShardedRoute(bss, cfg.Backends, cfg.Replicas)
+	if err != nil {
+		log.Printf("rule %s: %s", name, err)
+		return
+	}
+	return
+}
+
+func (rule *Rule) Match(rk *RouteKey) (ok bool) {
+	if rule.DB != "" && rule.DB != rk.DB {
+		return false
+	}
+	if rule.RP != "" && rule.RP != rk.RP {
+		return false
+	}
+	if rule.Tag == "" {
+		return rule.re.MatchString(rk.Measurement)
+	}
+
+	value, ok := rk.Tags[rule.Tag]
+	if !ok {
+		return false
+	}
+	return rule.re.MatchString(value)
+}
+
+type RuleList []*Rule
+
+func (rl RuleList) Len() int {
+	return len(rl)
+}
+
+func (rl RuleList) Less(i, j int) bool {
+	if rl[i].Priority != rl[j].Priority {
+		return rl[i].Priority < rl[j].Priority
+	}
+	return rl[i].Name < rl[j].Name
+}
+
+func (rl RuleList) Swap(i, j int) {
+	rl[i], rl[j] = rl[j], rl[i]
+}
+
+type prefixNode struct {
+	children map[byte]*prefixNode
+	route    *Route
+}
+
+// keymap finds a measurement by exact key, then the longest prefix,
+// then _default_.
+type keymap struct {
+	exact  map[string]*Route
+	prefix *prefixNode
+	def    *Route
+}
+
+func newKeymap(m2bs map[string][]BackendAPI) (km *keymap) {
+	km = &keymap{
+		exact:  make(map[string]*Route, len(m2bs)),
+		prefix: &prefixNode{},
+	}
+	for key, bs := range m2bs {
+		rt := NewRoute(bs)
+		if key == DEFAULT_KEY {
+			km.def = rt
+			continue
+		}
+		km.exact[key] = rt
+		km.insert(key, rt)
+	}
+	return
+}
+
+func (km *keymap) insert(key string, rt *Route) {
+	node := km.prefix
+	for i := 0; i < len(key); i++ {
+		if node.children == nil {
+			node.children = make(map[byte]*prefixNode)
+		}
+		next, ok := node.children[key[i]]
+		if !ok {
+			next = &prefixNode{}
+			node.children[key[i]] = next
+		}
+		node = next
+	}
+	node.route = rt
+}
+
+func (km *keymap) longestPrefix(key string) (rt *Route) {
+	node := km.prefix
+	rt = node.route
+	for i := 0; i < len(key); i++ {
+		node = node.children[key[i]]
+		if node == nil {
+			return
+		}
+		if node.route != nil {
+			rt = node.route
+		}
+	}
+	return
+}
+
+func (km *keymap) route(key string) (rt *Route, ok bool) {
+	rt, ok = km.exact[key]
+	if ok {
+		return
+	}
+
+	rt = km.longestPrefix(key)
+	if rt != nil {
+		return rt, true
+	}
+
+	return km.def, km.def != nil
+}
+
+// Router maps a measurement to its backends.
+// It tries rules of tags first, then exact keys, then rules of measurements,
+// then the keymap of the db, then the global one. Rules by priority. In a
+// keymap, exact key first, then the longest prefix, then _default_.
+// Build it once when loading config, it's read only after that.
+type Router struct {
+	rules    RuleList
+	needtags bool
+	global   *keymap
+	dbs      map[string]*keymap
+}
+
+func NewRouter(m2bs map[string][]BackendAPI, rules RuleList) (r *Router) {
+	r = &Router{
+		rules:  make(RuleList, len(rules)),
+		global: newKeymap(m2bs),
+		dbs:    make(map[string]*keymap),
+	}
+	copy(r.rules, rules)
+	sort.Sort(r.rules)
+	for _, rule := range r.rules {
+		if rule.Tag != "" {
+			r.needtags = true
+		}
+	}
+	return
+}
+
+// SetDatabase maps measurements of db, before the global ones.
+// Call it only when building the router.
+func (r *Router) SetDatabase(db string, m2bs map[string][]BackendAPI) {
+	r.dbs[db] = newKeymap(m2bs)
+}
+
+// LongestPrefix returns the global route of the longest key, which is a
+// prefix of key.
+func (r *Router) LongestPrefix(key string) (rt *Route) {
+	return r.global.longestPrefix(key)
+}
+
+// NeedTags tells if any rule routes by tag, so RouteKey needs Tags.
+func (r *Router) NeedTags() bool {
+	return r.needtags
+}
+
+// MissingTag returns the tag of a rule on the db and rp of rk, which rk
+// has no value of. Points of a query without it may be on any route.
+func (r *Router) MissingTag(rk *RouteKey) string {
+	for _, rule := range r.rules {
+		if rule.Tag == "" {
+			continue
+		}
+		if rule.DB != "" && rule.DB != rk.DB {
+			continue
+		}
+		if rule.RP != "" && rule.RP != rk.RP {
+			continue
+		}
+		if _, ok := rk.Tags[rule.Tag]; !ok {
+			return rule.Tag
+		}
+	}
+	return ""
+}
+
+// Match returns all backends of the measurement.
+func (r *Router) Match(key string) (backends []BackendAPI, ok bool) {
+	rt, ok := r.Route(&RouteKey{Measurement: key})
+	if !ok {
+		return
+	}
+	return rt.Backends, true
+}
+
+func (r *Router) Route(rk *RouteKey) (rt *Route, ok bool) {
+	rt, ok = r.matchRules(rk, true)
+	if ok {
+		return
+	}
+	km := r.dbs[rk.DB]
+	rt, ok = r.exact(km, rk.Measurement)
+	if ok {
+		return
+	}
+	rt, ok = r.matchRules(rk, false)
+	if ok {
+		return
+	}
+
+	if km != nil {
+		rt, ok = km.route(rk.Measurement)
+		if ok {
+			return rt, true
+		}
+	}
+	return r.global.route(rk.Measurement)
+}
+
+// matchRules tries rules of tags, or the ones of measurements, by priority.
+func (r *Router) matchRules(rk *RouteKey, tag bool) (rt *Route, ok bool) {
+	for _, rule := range r.rules {
+		if (rule.Tag != "") == tag && rule.Match(rk) {
+			return rule.route, true
+		}
+	}
+	return
+}
+
+// exact finds the key same as the measurement, it's mapped on purpose so
+// it's tried before rules. The global one is used only if the keymap of
+// the db doesn't map the measurement at all.
+func (r *Router) exact(km *keymap, key string) (rt *Route, ok bool) {
+	if km != nil {
+		rt, ok = km.exact[key]
+		if ok {
+			return
+		}
+		if _, ok = km.route(key); ok {
+			return nil, false
+		}
+	}
+	rt, ok = r.global.exact[key]
+	return
+}
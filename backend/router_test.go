@@ -0,0 +1,306 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+)
+
+func CreateTestRouter() (r *Router, bs map[string]BackendAPI) {
+	bs = make(map[string]BackendAPI)
+	for _, name := range []string{"cpu", "cpu.load", "cpu.load.avg1", "mem", "default"} {
+		bs[name] = &HttpBackend{URL: name}
+	}
+	r = NewRouter(map[string][]BackendAPI{
+		"cpu":           {bs["cpu"]},
+		"cpu.load":      {bs["cpu.load"]},
+		"cpu.load.avg1": {bs["cpu.load.avg1"]},
+		"mem":           {bs["mem"]},
+		DEFAULT_KEY:     {bs["default"]},
+	}, nil)
+	return
+}
+
+func TestRouterMatch(t *testing.T) {
+	r, _ := CreateTestRouter()
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"cpu", "cpu"},
+		{"cpu.load", "cpu.load"},
+		{"cpu.load.avg", "cpu.load"},
+		{"cpu.load.avg1", "cpu.load.avg1"},
+		{"cpu.load.avg15", "cpu.load.avg1"},
+		{"cpu.loa", "cpu"},
+		{"cpu_idle", "cpu"},
+		{"memory", "mem"},
+		{"me", "default"},
+		{"load.cpu", "default"},
+		{"", "default"},
+	}
+
+	// map iteration is random, so run it many times to catch nondeterminism.
+	for i := 0; i < 100; i++ {
+		for _, tt := range tests {
+			bs, ok := r.Match(tt.key)
+			if !ok || len(bs) != 1 {
+				t.Errorf("%s: no backends", tt.key)
+				return
+			}
+			if url := bs[0].(*HttpBackend).URL; url != tt.want {
+				t.Errorf("%s: route to %s, want %s", tt.key, url, tt.want)
+				return
+			}
+		}
+	}
+}
+
+func TestRouterNoDefault(t *testing.T) {
+	r := NewRouter(map[string][]BackendAPI{
+		"cpu": {&HttpBackend{URL: "cpu"}},
+	}, nil)
+
+	_, ok := r.Match("mem")
+	if ok {
+		t.Errorf("mem should not be matched")
+	}
+
+	_, ok = NewRouter(nil, nil).Match("cpu")
+	if ok {
+		t.Errorf("empty router should not match")
+	}
+}
+
+func TestRouterDatabases(t *testing.T) {
+	r, bs := CreateTestRouter()
+	r.SetDatabase("team_a", map[string][]BackendAPI{
+		"cpu.load": {bs["mem"]},
+	})
+
+	tests := []struct {
+		db   string
+		key  string
+		want string
+	}{
+		{"team_a", "cpu.load.avg", "mem"},
+		{"team_a", "cpu", "cpu"},
+		{"team_a", "disk", "default"},
+		{"team_b", "cpu.load.avg", "cpu.load"},
+		{"", "cpu.load", "cpu.load"},
+	}
+	for _, tt := range tests {
+		rt, ok := r.Route(&RouteKey{DB: tt.db, Measurement: tt.key})
+		if !ok || len(rt.Backends) != 1 {
+			t.Errorf("%s.%s: no backends", tt.db, tt.key)
+			continue
+		}
+		if url := rt.Backends[0].(*HttpBackend).URL; url != tt.want {
+			t.Errorf("%s.%s: route to %s, want %s", tt.db, tt.key, url, tt.want)
+		}
+	}
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob  string
+		key   string
+		match bool
+	}{
+		{"cpu*", "cpu", true},
+		{"cpu*", "cpu.load", true},
+		{"cpu*", "xcpu", false},
+		{"k8s_*_mem", "k8s_pod_mem", true},
+		{"k8s_*_mem", "k8s_pod_mem2", false},
+		{"cpu?", "cpu1", true},
+		{"cpu?", "cpu12", false},
+		{"cpu.[0-3]", "cpu.2", true},
+		{"cpu.[0-3]", "cpu.5", false},
+		{"cpu.[!0-3]", "cpu.5", true},
+		{"a.b", "axb", false},
+		{"a\\*", "a*", true},
+		{"a\\*", "ab", false},
+		{"a[]", "a[]", true},
+		{"a[!]b", "a[!]b", true},
+		{"a[]b]", "a[]b]", true},
+	}
+
+	for _, tt := range tests {
+		re := regexp.MustCompile(GlobToRegexp(tt.glob))
+		if re.MatchString(tt.key) != tt.match {
+			t.Errorf("glob %s on %s should be %v", tt.glob, tt.key, tt.match)
+		}
+	}
+}
+
+func TestRouterRules(t *testing.T) {
+	bs := map[string]BackendAPI{
+		"a":       &HttpBackend{URL: "a"},
+		"b":       &HttpBackend{URL: "b"},
+		"c":       &HttpBackend{URL: "c"},
+		"default": &HttpBackend{URL: "default"},
+	}
+	cfgs := map[string]*RuleConfig{
+		"k8s": {Match: "regex", Pattern: "^k8s_.*_(cpu|mem)$", Priority: 10, Backends: []string{"a"}},
+		"all": {Match: "glob", Pattern: "k8s_*", Priority: 20, Backends: []string{"b"}},
+		"sys": {Match: "glob", Pattern: "sys.*", Priority: 10, Backends: []string{"c"}},
+	}
+
+	var rules RuleList
+	for name, cfg := range cfgs {
+		rule, err := NewRule(name, cfg, bs)
+		if err != nil {
+			t.Errorf("error: %s", err)
+			return
+		}
+		rules = append(rules, rule)
+	}
+
+	r := NewRouter(map[string][]BackendAPI{
+		"k8s_node_cpu": {bs["c"]},
+		DEFAULT_KEY:    {bs["default"]},
+	}, rules)
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"k8s_pod_cpu", "a"},
+		{"k8s_node_cpu", "c"},
+		{"k8s_pod_disk", "b"},
+		{"sys.load", "c"},
+		{"system", "default"},
+	}
+	for _, tt := range tests {
+		bs, ok := r.Match(tt.key)
+		if !ok || len(bs) != 1 {
+			t.Errorf("%s: no backends", tt.key)
+			continue
+		}
+		if url := bs[0].(*HttpBackend).URL; url != tt.want {
+			t.Errorf("%s: route to %s, want %s", tt.key, url, tt.want)
+		}
+	}
+
+	// the db maps it, the global exact key isn't for it.
+	r.SetDatabase("team", map[string][]BackendAPI{DEFAULT_KEY: {bs["default"]}})
+	rt, ok := r.Route(&RouteKey{DB: "team", Measurement: "k8s_node_cpu"})
+	if !ok || rt.Backends[0].(*HttpBackend).URL != "a" {
+		t.Errorf("k8s_node_cpu of team not routed by rule")
+	}
+
+	_, err := NewRule("bad", &RuleConfig{Match: "regex", Pattern: "(", Backends: []string{"a"}}, bs)
+	if err == nil {
+		t.Errorf("illegal regex passed")
+	}
+	_, err = NewRule("bad", &RuleConfig{Match: "like", Pattern: "a", Backends: []string{"a"}}, bs)
+	if err == nil {
+		t.Errorf("illegal match passed")
+	}
+	_, err = NewRule("bad", &RuleConfig{Match: "glob", Pattern: "a", Backends: []string{"x"}}, bs)
+	if err == nil {
+		t.Errorf("unknown backend passed")
+	}
+}
+
+func TestRouterTagRules(t *testing.T) {
+	bs := map[string]BackendAPI{
+		"foo":     &HttpBackend{URL: "foo"},
+		"bar":     &HttpBackend{URL: "bar"},
+		"cpu":     &HttpBackend{URL: "cpu"},
+		"default": &HttpBackend{URL: "default"},
+	}
+	cfgs := map[string]*RuleConfig{
+		"foo": {Match: "glob", Pattern: "foo", Tag: "tenant", Backends: []string{"foo"}},
+		"bar": {Match: "regex", Pattern: "^bar", Tag: "tenant", DB: "team", RP: "hot", Backends: []string{"bar"}},
+	}
+
+	var rules RuleList
+	for name, cfg := range cfgs {
+		rule, err := NewRule(name, cfg, bs)
+		if err != nil {
+			t.Errorf("error: %s", err)
+			return
+		}
+		rules = append(rules, rule)
+	}
+
+	r := NewRouter(map[string][]BackendAPI{
+		"cpu":       {bs["cpu"]},
+		DEFAULT_KEY: {bs["default"]},
+	}, rules)
+	if !r.NeedTags() {
+		t.Errorf("router should need tags")
+		return
+	}
+
+	tests := []struct {
+		rk   *RouteKey
+		want string
+	}{
+		{&RouteKey{Measurement: "cpu", Tags: map[string]string{"tenant": "foo"}}, "foo"},
+		{&RouteKey{Measurement: "mem", Tags: map[string]string{"tenant": "foo"}}, "foo"},
+		{&RouteKey{Measurement: "mem", Tags: map[string]string{"tenant": "foobar"}}, "default"},
+		{&RouteKey{Measurement: "cpu", Tags: map[string]string{"tenant": "bar1"}}, "cpu"},
+		{&RouteKey{DB: "team", RP: "hot", Measurement: "cpu", Tags: map[string]string{"tenant": "bar1"}}, "bar"},
+		{&RouteKey{DB: "team", Measurement: "cpu", Tags: map[string]string{"tenant": "bar1"}}, "cpu"},
+		{&RouteKey{Measurement: "cpu"}, "cpu"},
+	}
+	for _, tt := range tests {
+		rt, ok := r.Route(tt.rk)
+		if !ok || len(rt.Backends) != 1 {
+			t.Errorf("%#v: no backends", tt.rk)
+			continue
+		}
+		if url := rt.Backends[0].(*HttpBackend).URL; url != tt.want {
+			t.Errorf("%#v: route to %s, want %s", tt.rk, url, tt.want)
+		}
+	}
+}
+
+func TestRouterMissingTag(t *testing.T) {
+	bs := map[string]BackendAPI{"foo": &HttpBackend{URL: "foo"}}
+	rule, err := NewRule("foo", &RuleConfig{Match: "glob", Pattern: "foo", Tag: "tenant", DB: "team", Backends: []string{"foo"}}, bs)
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	r := NewRouter(nil, RuleList{rule})
+
+	tests := []struct {
+		rk   *RouteKey
+		want string
+	}{
+		{&RouteKey{DB: "team", Measurement: "cpu", Tags: map[string]string{"tenant": "bar"}}, ""},
+		{&RouteKey{DB: "team", Measurement: "cpu", Tags: map[string]string{"host": "a"}}, "tenant"},
+		{&RouteKey{DB: "team", Measurement: "cpu"}, "tenant"},
+		{&RouteKey{DB: "other", Measurement: "cpu"}, ""},
+	}
+	for _, tt := range tests {
+		if tag := r.MissingTag(tt.rk); tag != tt.want {
+			t.Errorf("%#v: missing %q, want %q", tt.rk, tag, tt.want)
+		}
+	}
+}
+
+func BenchmarkRouterMatch(b *testing.B) {
+	m2bs := make(map[string][]BackendAPI)
+	for i := 0; i < 1000; i++ {
+		m2bs[fmt.Sprintf("name%d.", i)] = []BackendAPI{&HttpBackend{}}
+	}
+	r := NewRouter(m2bs, nil)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, ok := r.Match("name999.load.avg")
+		if !ok {
+			b.Error("no backends")
+			return
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+const (
+	UNKNOWN_DROP   = "drop"
+	UNKNOWN_ASSIGN = "assign"
+	UNKNOWN_HOLD   = "hold"
+
+	ASSIGN_LEAST_LOADED = "least-loaded"
+	ASSIGN_HASH         = "hash"
+	ASSIGN_FIXED        = "fixed"
+)
+
+var (
+	ErrNoAssignGroup = errors.New("no backend group to assign")
+)
+
+// Assigner picks a backend group for new measurements.
+type Assigner struct {
+	Strategy string
+	Groups   [][]string
+}
+
+// NewAssigner reads groups like "a|b", backends in a group are replicas.
+func NewAssigner(strategy string, groups []string) (a *Assigner) {
+	a = &Assigner{Strategy: strategy}
+	for _, g := range groups {
+		var names []string
+		for _, name := range strings.Split(g, "|") {
+			name = strings.TrimSpace(name)
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		if len(names) != 0 {
+			a.Groups = append(a.Groups, names)
+		}
+	}
+	return
+}
+
+// Pick returns the group for measurement key.
+// loads is the number of measurements mapped to every backend.
+func (a *Assigner) Pick(key string, loads map[string]int) (group []string, err error) {
+	if len(a.Groups) == 0 {
+		return nil, ErrNoAssignGroup
+	}
+
+	switch a.Strategy {
+	case ASSIGN_FIXED:
+		return a.Groups[0], nil
+	case ASSIGN_LEAST_LOADED:
+		best, least := 0, -1
+		for i, g := range a.Groups {
+			// a group is as loaded as its busiest backend.
+			load := 0
+			for _, name := range g {
+				if loads[name] > load {
+					load = loads[name]
+				}
+			}
+			if least < 0 || load < least {
+				best, least = i, load
+			}
+		}
+		return a.Groups[best], nil
+	}
+	return a.Groups[hashKey([]byte(key))%uint32(len(a.Groups))], nil
+}
+
+type heldPoint struct {
+	rk     *RouteKey
+	line   []byte
+	params *WriteParams
+}
+
+// HoldingCache keeps points of unknown measurements in memory, until the
+// measurements are mapped. The oldest points are dropped when it's full.
+type HoldingCache struct {
+	lock   sync.Mutex
+	limit  int
+	points []*heldPoint
+}
+
+func NewHoldingCache(limit int) (hc *HoldingCache) {
+	return &HoldingCache{limit: limit}
+}
+
+// Hold keeps a copy of line, returns true if the oldest point is dropped.
+// Points held keep their record in wal, until released or dropped.
+func (hc *HoldingCache) Hold(rk *RouteKey, line []byte, params *WriteParams) (dropped bool) {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+
+	params.wal.add(1)
+	if hc.limit > 0 && len(hc.points) >= hc.limit {
+		hc.points[0].params.wal.done()
+		hc.points[0] = nil
+		hc.points = hc.points[1:]
+		dropped = true
+	}
+	hc.points = append(hc.points, &heldPoint{
+		rk:     rk,
+		line:   append([]byte(nil), line...),
+		params: params,
+	})
+	return
+}
+
+// Release takes out the points fn accepts, in the order they came.
+func (hc *HoldingCache) Release(fn func(rk *RouteKey) bool) (points []*heldPoint) {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+
+	kept := make([]*heldPoint, 0, len(hc.points))
+	for _, hp := range hc.points {
+		if fn(hp.rk) {
+			points = append(points, hp)
+		} else {
+			kept = append(kept, hp)
+		}
+	}
+	hc.points = kept
+	return
+}
+
+// Measurements counts points held of every measurement.
+func (hc *HoldingCache) Measurements() (counts map[string]int) {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+
+	counts = make(map[string]int)
+	for _, hp := range hc.points {
+		counts[hp.rk.Measurement]++
+	}
+	return
+}
@@ -0,0 +1,75 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAssignerPick(t *testing.T) {
+	groups := []string{"a|b", " c ", ""}
+	loads := map[string]int{"a": 1, "b": 3, "c": 2}
+
+	tests := []struct {
+		strategy string
+		want     string
+	}{
+		{ASSIGN_FIXED, "a,b"},
+		{ASSIGN_LEAST_LOADED, "c"},
+	}
+	for _, tt := range tests {
+		a := NewAssigner(tt.strategy, groups)
+		group, err := a.Pick("cpu", loads)
+		if err != nil {
+			t.Errorf("error: %s", err)
+			continue
+		}
+		if strings.Join(group, ",") != tt.want {
+			t.Errorf("%s: %v", tt.strategy, group)
+		}
+	}
+
+	// hash should stay the same for a key.
+	a := NewAssigner(ASSIGN_HASH, groups)
+	first, _ := a.Pick("cpu", nil)
+	for i := 0; i < 10; i++ {
+		group, _ := a.Pick("cpu", nil)
+		if strings.Join(group, ",") != strings.Join(first, ",") {
+			t.Errorf("hash not stable: %v, %v", group, first)
+		}
+	}
+
+	_, err := NewAssigner(ASSIGN_HASH, nil).Pick("cpu", nil)
+	if err != ErrNoAssignGroup {
+		t.Errorf("no group should fail: %v", err)
+	}
+}
+
+func TestHoldingCache(t *testing.T) {
+	hc := NewHoldingCache(3)
+	for i, key := range []string{"cpu", "mem", "cpu", "disk"} {
+		dropped := hc.Hold(&RouteKey{Measurement: key}, []byte(key+" v=1"), &WriteParams{})
+		if dropped != (i == 3) {
+			t.Errorf("%d: dropped %v", i, dropped)
+		}
+	}
+
+	counts := hc.Measurements()
+	if len(counts) != 3 || counts["cpu"] != 1 || counts["mem"] != 1 {
+		t.Errorf("held wrong: %v", counts)
+	}
+
+	points := hc.Release(func(rk *RouteKey) bool {
+		return rk.Measurement != "mem"
+	})
+	if len(points) != 2 || string(points[0].line) != "cpu v=1" || string(points[1].line) != "disk v=1" {
+		t.Errorf("released wrong: %v", points)
+	}
+	counts = hc.Measurements()
+	if len(counts) != 1 || counts["mem"] != 1 {
+		t.Errorf("held wrong: %v", counts)
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	walSuffix = ".wal"
+)
+
+var (
+	ErrWALAppend = errors.New("append to wal failed")
+)
+
+// WAL keeps bodies of write requests in files before they are acknowledged.
+// A segment file is removed, or truncated if it's the one appended, when
+// every backend has the lines of its records sent or in its file.
+// Segments left by the last run are replayed on startup.
+type WAL struct {
+	Dir         string
+	SegmentSize int64
+
+	lock    sync.Mutex
+	file    *os.File
+	seg     uint64
+	size    int64
+	pending map[uint64]int // records not done of segments
+	old     []uint64       // segments of the last run, to replay
+}
+
+// walEntry counts the writes of a record not done yet.
+// It holds one for the request writing it, until done is called.
+type walEntry struct {
+	wal      *WAL
+	seg      uint64
+	pending  int32
+	appended bool
+}
+
+func segmentName(dir string, seg uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016d%s", seg, walSuffix))
+}
+
+func OpenWAL(dir string, segmentSize int64) (w *WAL, err error) {
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+	w = &WAL{Dir: dir, SegmentSize: segmentSize, pending: make(map[uint64]int)}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if !strings.HasSuffix(name, walSuffix) {
+			continue
+		}
+		seg, e := strconv.ParseUint(strings.TrimSuffix(name, walSuffix), 10, 64)
+		if e != nil {
+			continue
+		}
+		if fi.Size() != 0 {
+			w.old = append(w.old, seg)
+		}
+		if seg >= w.seg {
+			w.seg = seg + 1
+		}
+	}
+	sort.Slice(w.old, func(i, j int) bool { return w.old[i] < w.old[j] })
+
+	err = w.open()
+	return
+}
+
+// open a new segment to append. Must hold the lock.
+func (w *WAL) open() (err error) {
+	w.file, err = os.OpenFile(segmentName(w.Dir, w.seg), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0600)
+	w.size = 0
+	return
+}
+
+// Begin an entry, params of the request carry it to backends.
+func (w *WAL) Begin() *walEntry {
+	if w == nil {
+		return nil
+	}
+	return &walEntry{wal: w, pending: 1}
+}
+
+// Append writes p of e to file, and syncs it.
+func (w *WAL) Append(e *walEntry, p []byte, params *WriteParams) (err error) {
+	record := EncodeRecord(params, p)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.SegmentSize > 0 && w.size >= w.SegmentSize {
+		err = w.rotate()
+		if err != nil {
+			return
+		}
+	}
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(record)))
+	_, err = w.file.Write(append(length[:], record...))
+	if err != nil {
+		return
+	}
+	err = w.file.Sync()
+	if err != nil {
+		return
+	}
+	w.size += int64(len(record)) + 4
+
+	e.seg = w.seg
+	e.appended = true
+	w.pending[w.seg]++
+	return
+}
+
+// rotate to the next segment, or truncate this one if it's all done.
+// Must hold the lock.
+func (w *WAL) rotate() (err error) {
+	if w.pending[w.seg] == 0 {
+		return w.truncate()
+	}
+	err = w.file.Close()
+	if err != nil {
+		return
+	}
+	w.seg++
+	return w.open()
+}
+
+// Must hold the lock.
+func (w *WAL) truncate() (err error) {
+	err = w.file.Truncate(0)
+	if err != nil {
+		return
+	}
+	w.size = 0
+	return
+}
+
+func (w *WAL) finish(seg uint64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.pending[seg]--
+	if w.pending[seg] > 0 {
+		return
+	}
+	delete(w.pending, seg)
+
+	var err error
+	if seg == w.seg {
+		err = w.truncate()
+	} else {
+		err = os.Remove(segmentName(w.Dir, seg))
+	}
+	if err != nil {
+		log.Printf("truncate wal error: %s\n", err)
+	}
+}
+
+// Size of the segment appended.
+func (w *WAL) Size() int64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.size
+}
+
+// Replay calls fn with every record of segments of the last run,
+// and removes them.
+func (w *WAL) Replay(fn func(p []byte, params *WriteParams)) (err error) {
+	w.lock.Lock()
+	old := w.old
+	w.old = nil
+	w.lock.Unlock()
+
+	for _, seg := range old {
+		err = replaySegment(segmentName(w.Dir, seg), fn)
+		if err != nil {
+			return
+		}
+		err = os.Remove(segmentName(w.Dir, seg))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func replaySegment(filename string, fn func(p []byte, params *WriteParams)) (err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		var length uint32
+		err = binary.Read(r, binary.BigEndian, &length)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			break
+		}
+		record := make([]byte, length)
+		_, err = io.ReadFull(r, record)
+		if err != nil {
+			break
+		}
+
+		params, p, e := DecodeRecord(record)
+		if e != nil {
+			log.Printf("decode wal record error: %s\n", e)
+			continue
+		}
+		fn(p, params)
+	}
+	// the last record was being written when it stopped, never acknowledged.
+	log.Printf("wal %s ends in a partial record: %s\n", filename, err)
+	return nil
+}
+
+func (w *WAL) Close() (err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.file.Close()
+}
+
+func (e *walEntry) add(n int32) {
+	if e != nil {
+		atomic.AddInt32(&e.pending, n)
+	}
+}
+
+func (e *walEntry) done() {
+	if e == nil {
+		return
+	}
+	if atomic.AddInt32(&e.pending, -1) == 0 && e.appended {
+		e.wal.finish(e.seg)
+	}
+}
+
+// track holds e until ack gets the result, which goes on to the returned.
+// A write not delivered keeps e, so the record is replayed by the next run.
+func (e *walEntry) track(ack <-chan error) <-chan error {
+	if e == nil {
+		return ack
+	}
+	e.add(1)
+	out := make(chan error, 1)
+	go func() {
+		err := <-ack
+		out <- err
+		if !Delivered(err) {
+			log.Printf("write lost, kept in wal: %s\n", err)
+			return
+		}
+		e.done()
+	}()
+	return out
+}
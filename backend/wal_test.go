@@ -0,0 +1,207 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func walSegments(t *testing.T, dir string) (names []string) {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+walSuffix))
+	if err != nil {
+		t.Errorf("error: %s", err)
+	}
+	return
+}
+
+func TestWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := OpenWAL(dir, 1)
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	e1, e2 := w.Begin(), w.Begin()
+	w.Append(e1, []byte("cpu value=1\n"), &WriteParams{DB: "test"})
+	w.Append(e2, []byte("cpu value=2\n"), &WriteParams{DB: "test"})
+	if n := len(walSegments(t, dir)); n != 2 {
+		t.Errorf("%d segments after rotating", n)
+	}
+	e1.done()
+	if n := len(walSegments(t, dir)); n != 1 {
+		t.Errorf("%d segments after the first is done", n)
+	}
+	e2.add(1)
+	e2.done()
+	if w.Size() == 0 {
+		t.Errorf("wal truncated with a write pending")
+	}
+	e2.done()
+	if w.Size() != 0 {
+		t.Errorf("wal not truncated when done")
+	}
+
+	// writes lost keep the record.
+	e4 := w.Begin()
+	w.Append(e4, []byte("cpu value=4\n"), &WriteParams{DB: "test"})
+	lost, cached := make(chan error, 1), make(chan error, 1)
+	lost <- ErrNotCached
+	cached <- ErrNotConfirmed
+	<-e4.track(lost)
+	<-e4.track(cached)
+	e4.done()
+	time.Sleep(10 * time.Millisecond)
+	if w.Size() == 0 {
+		t.Errorf("wal truncated with a write lost")
+	}
+
+	// stops before it's done, the next run replays it.
+	e3 := w.Begin()
+	w.Append(e3, []byte("cpu value=3\n"), &WriteParams{DB: "test", RP: "one_week", User: "writer", Password: "secret"})
+	for _, name := range walSegments(t, dir) {
+		data, _ := ioutil.ReadFile(name)
+		if bytes.Contains(data, []byte("secret")) {
+			t.Errorf("password kept in %s", name)
+		}
+		fi, err := os.Stat(name)
+		if err != nil || fi.Mode().Perm() != 0600 {
+			t.Errorf("mode of %s wrong: %v %v", name, fi, err)
+		}
+	}
+	w, err = OpenWAL(dir, 1)
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	var lines []string
+	err = w.Replay(func(p []byte, params *WriteParams) {
+		lines = append(lines, string(p))
+		if params.DB != "test" || len(lines) == 2 && params.RP != "one_week" {
+			t.Errorf("wrong params: %v", params)
+		}
+	})
+	if err != nil || len(lines) != 2 || lines[1] != "cpu value=3\n" {
+		t.Errorf("wrong replay: %v, %v", lines, err)
+	}
+	if n := len(walSegments(t, dir)); n != 1 {
+		t.Errorf("%d segments after replay", n)
+	}
+}
+
+type recordBackend struct {
+	dummyBackend
+	lines []string
+}
+
+func (rb *recordBackend) Write(p []byte, params *WriteParams) (err error) {
+	rb.lines = append(rb.lines, string(p))
+	return
+}
+
+func waitWALTruncated(w *WAL) bool {
+	for i := 0; i < 100; i++ {
+		if w.Size() == 0 {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestInfluxdbClusterWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	bs, ts := createAckBackends(t, "wal", 204)
+	defer ts.Close()
+	defer os.Remove("wal.dat")
+	defer os.Remove("wal.rec")
+
+	ic := NewInfluxCluster(&RedisConfigSource{}, &NodeConfig{WALDir: dir})
+	ic.router = NewRouter(map[string][]BackendAPI{"cpu": {bs}}, nil)
+	ic.unknownPolicy = UNKNOWN_HOLD
+	err = ic.OpenWAL()
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+
+	err = ic.Write([]byte("cpu value=1\n"), &WriteParams{DB: "test"})
+	if err != nil {
+		t.Errorf("error: %s", err)
+	}
+	if !waitWALTruncated(ic.wal) {
+		t.Errorf("wal not truncated after backend has it")
+	}
+
+	// held points keep their records.
+	err = ic.Write([]byte("mem value=1\n"), &WriteParams{DB: "test"})
+	if err != nil {
+		t.Errorf("error: %s", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if ic.wal.Size() == 0 {
+		t.Errorf("wal truncated with points held")
+	}
+	ic.router = NewRouter(map[string][]BackendAPI{"cpu": {bs}, "mem": {bs}}, nil)
+	ic.ReleaseHeld()
+	if !waitWALTruncated(ic.wal) {
+		t.Errorf("wal not truncated after held points released")
+	}
+
+	// a backend never has it, then it stops.
+	stuck, err := createStuckBackends("wal")
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	defer os.Remove("queue_wal.dat")
+	defer os.Remove("queue_wal.rec")
+	ic.router = NewRouter(map[string][]BackendAPI{"cpu": {stuck}}, nil)
+	err = ic.Write([]byte("cpu value=2\n"), &WriteParams{DB: "test"})
+	if err != nil {
+		t.Errorf("error: %s", err)
+	}
+
+	rb := &recordBackend{}
+	ic = NewInfluxCluster(&RedisConfigSource{}, &NodeConfig{WALDir: dir})
+	ic.router = NewRouter(map[string][]BackendAPI{"cpu": {rb}}, nil)
+	err = ic.OpenWAL()
+	if err != nil || len(rb.lines) != 1 || rb.lines[0] != "cpu value=2\n" {
+		t.Errorf("wrong replay: %v, %v", rb.lines, err)
+	}
+	if ic.stats.PointsReplayed != 1 {
+		t.Errorf("%d points replayed", ic.stats.PointsReplayed)
+	}
+
+	// nothing is written if it's not in wal.
+	ic.wal.Close()
+	err = ic.Write([]byte("cpu value=3\n"), &WriteParams{DB: "test"})
+	if err != ErrWALAppend || len(rb.lines) != 1 {
+		t.Errorf("written without wal: %v, %v", rb.lines, err)
+	}
+
+	// a wal can't be opened fails the node.
+	file := filepath.Join(dir, "file")
+	ioutil.WriteFile(file, nil, 0644)
+	ic = NewInfluxCluster(&RedisConfigSource{}, &NodeConfig{WALDir: file})
+	if err = ic.OpenWAL(); err == nil {
+		t.Errorf("wal opened in a file")
+	}
+}
@@ -8,22 +8,57 @@
 '''
 from __future__ import absolute_import, division,\
     print_function, unicode_literals
+import os
 import sys
 import getopt
+import hashlib
+import binascii
 import redis
 
 
+def hash_password(password, iterations=10000):
+    salt = os.urandom(16)
+    key = hashlib.pbkdf2_hmac('sha256', password.encode('utf-8'), salt, iterations)
+    return 'pbkdf2_sha256$%d$%s$%s' % (
+        iterations, binascii.hexlify(salt).decode(), binascii.hexlify(key).decode())
+
+
+def hash_token(token):
+    return hashlib.sha256(token.encode('utf-8')).hexdigest()
+
+
 # backends key use for KEYMAPS, NODES, cache file
-# url: influxdb addr or other http backend which supports influxdb line protocol
-# db: influxdb db 
+# durations accept a unit like '10s' or '500ms', a bare integer is milliseconds
+# url: influxdb addr or other http backend which supports influxdb line protocol, required
+# db: influxdb db, clients' dbs not in databases are written to it,
+#     if empty, they keep their names
+# databases: client's db to db of this backend, 'team_a=a,team_b=b' or 'databases.team_a': 'a'
+# rps: client's rp to rp of this backend, like databases,
+#      db and rp in queries, like "db"."rp"."cpu", and writes are renamed by databases and rps
 # zone: same zone first query
-# interval: default config is 1000ms, wait 1 second write whether point count has bigger than maxrowlimit config
-# timeout: default config is 10000ms, write timeout until 10 seconds
-# timeoutquery: default config is 600000ms, query timeout until 600 seconds
+# interval: default config is 1s, wait 1 second write whether point count has bigger than maxrowlimit config
+# timeout: default config is 10s, write timeout until 10 seconds
+# timeoutquery: default config is 10m, query timeout until 600 seconds
 # maxrowlimit: default config is 10000, wait 10000 points write 
-# checkinterval: default config is 1000ms, check backend active every 1 second
-# rewriteinterval: default config is 10000ms, rewrite every 10 seconds
-# writeonly: default 0
+# checkinterval: default config is 1s, check backend active every 1 second
+# rewriteinterval: default config is 10s, rewrite every 10 seconds
+# queuesize: default config is 1024, writes queued to be batched, lines of a request to the backend are one write,
+#            writes never wait for a full queue
+# queuefull: what to do with a write when the queue is full, default is spill
+#            spill: write it to the file, rewritten later
+#            drop-oldest: drop the oldest write queued
+#            reject: answer the write with 503 and Retry-After, points of it may be written to other backends
+# maxbatchbytes: flush a batch when it has so many bytes, 0 is no limit
+# maxbatchcompressed: flush a batch when it has so many bytes gzipped, 0 is no limit,
+#                     the size is known only as far as gzip has compressed, so a batch may go over it a bit
+# maxbatchage: flush a batch older than it in ms, even if no more points come, 0 is no limit
+# adaptivebatch: default false, the row limit halves when a batch is written slower than slowwrite,
+#                and grows back to maxrowlimit by a tenth when written in half of it
+# minrowlimit: default config is 100, the row limit never goes below it
+# slowwrite: default config is 1s
+# writeonly: default false
+# headers: extra http headers sent to backend, 'k1=v1,k2=v2' or 'headers.k1': 'v1'
+# username, password: credentials of auth-enabled influxdb, instead of the ones of clients
 BACKENDS = {
     'local': {
         'url': 'http://localhost:8086', 
@@ -35,40 +70,234 @@ BACKENDS = {
         'maxrowlimit':10000,  
         'checkinterval':1000, 
         'rewriteinterval':10000,
+        'queuesize': 1024,
+        'queuefull': 'spill',
+        'maxbatchbytes': 4194304,
+        'adaptivebatch': 'true',
     },
     'local2': {
         'url': 'http://influxdb-test:8086',
-        'db': 'test2',
         'interval': 200,
+        'databases': 'test=test2',
+        'rps': 'one_year=archive',
     },
 }
 
 # measurement:[backends keys], the key must be in the BACKENDS
 # data with the measurement will write to the backends
+# measurement matches the key exactly first, then the longest key which is its prefix,
+# then _default_
 KEYMAPS = {
     'cpu': ['local'],
     'temperature': ['local2'],
     '_default_': ['local']
 }
 
+# db:{measurement:[backends keys]}, same as KEYMAPS, but only for the db.
+# they are tried before KEYMAPS, a db can't have ':' in its name
+DB_KEYMAPS = {
+    'team_a': {
+        'cpu': ['local2'],
+    },
+}
+
+# rules route measurements by pattern, tried by priority (lower first) after exact keys,
+# before prefixes and _default_ of DB_KEYMAPS and KEYMAPS, rules with tag before all
+# match: regex or glob, default is regex
+# pattern: regex is not anchored, glob matches the whole measurement
+# tag: if set, pattern matches the value of this tag instead of measurement,
+#      queries use the tag = 'value' conditions in their where clause,
+#      queries on the db and rp of the rule without one, or with two values, are rejected
+# db, rp: if set, the rule only matches writes and queries on them
+# priority: default is 0, same priority is ordered by rule name
+# backends: the backends keys, split with ','
+# replicas: if set, backends are split into shards of this many replicas in order,
+#           each series goes to one shard by consistent hash of measurement and tags,
+#           queries go to one replica of every shard and the results are merged
+RULES = {
+    'k8s': {
+        'match': 'regex',
+        'pattern': '^k8s_.*_(cpu|mem)$',
+        'priority': 10,
+        'backends': 'local2',
+    },
+    'tenant_foo': {
+        'match': 'glob',
+        'pattern': 'foo',
+        'tag': 'tenant',
+        'backends': 'local',
+    },
+    'archive': {
+        'match': 'regex',
+        'pattern': '.*',
+        'rp': 'one_year',
+        'priority': 5,
+        'backends': 'local2',
+    },
+    'sharded_mem': {
+        'match': 'glob',
+        'pattern': 'mem',
+        'backends': 'local,local2',
+        'replicas': 1,
+    },
+}
+
+# query filters, named rules on queries, reloaded by /reload
+# type: forbid (default), a query matches it is rejected,
+#       or require, a query must match one of them
+# pattern: regex on the query
+# reason: told to the client with the rule name, like 'query forbidden by no_delete: ...'
+# without any filter, the default ones below are used
+QUERY_FILTERS = {
+    'no_select_all': {
+        'pattern': '(?i)select\\s+\\*',
+        'reason': 'list the fields instead of *',
+    },
+    'no_admin': {
+        'pattern': '(?i)^\\s*(delete|drop|grant|revoke)',
+        'reason': 'delete, drop, grant and revoke are not allowed',
+    },
+    'time_bound': {
+        'type': 'require',
+        'pattern': '(?i)where.*time',
+        'reason': 'select needs a time condition',
+    },
+    'show_from': {
+        'type': 'require',
+        'pattern': '(?i)show.*from',
+        'reason': 'show needs from',
+    },
+}
+
+# limits on clients, reloaded by /reload, a client hits one gets 429 with Retry-After
+# key: ip (default), user or db, every client matching has its own limit,
+#      user is ip if auth isn't enabled, credentials not checked can be anyone's
+# match: glob on the value of key, default is '*'
+# writepoints, writebytes: points and bytes written a second, 0 (default) is unlimited
+# queries: queries a second, 0 (default) is unlimited
+# concurrent: queries running at the same time, 0 (default) is unlimited
+# burst: buckets hold the rates of it, a bare integer is ms, default is '1s'
+LIMITS = {
+    'per_ip': {
+        'key': 'ip',
+        'writepoints': 100000,
+        'writebytes': 10 * 1024 * 1024,
+        'queries': 50,
+    },
+    'analysts': {
+        'key': 'user',
+        'match': 'grafana',
+        'concurrent': 10,
+        'burst': '5s',
+    },
+}
+
+# users of proxy, when authenabled of node is set
+# password: hashed by hash_password, never the plain one
+# tokens: bearer tokens hashed by hash_token, split with ','
+# read, write: patterns of 'db:measurement' in glob, split with ',', 'db' is all measurements of db,
+#              patterns start with '!' deny, they win. queries are checked on every source,
+#              writes on every line. regex sources need all measurements of the db
+# statements: types of statements allowed, select, show and admin (the others), default is 'select,show'
+#             admin ones like delete and drop series need write on the measurement
+# admin: can call /reload and /debug, default is false
+USERS = {
+    'grafana': {
+        'password': hash_password('grafana'),
+        'read': 'test,team_a,!team_a:secret_*',
+    },
+    'collector': {
+        'tokens': hash_token('change-me'),
+        'write': '*:cpu*,*:mem*',
+        'statements': '',
+    },
+    'ops': {
+        'password': hash_password('ops'),
+        'read': '*',
+        'admin': 1,
+    },
+}
+
 # this config will cover default_node config
 # listenaddr: proxy listen addr                
-# db: proxy db, client's db must be same with it
+# db: dbs the proxy serves, split with ',', client's db must be one of them,
+#     any db is served if empty
 # zone: use for query
 # nexts: the backends keys, will accept all data, split with ','
-# interval: collect Statistics
-# idletimeout: keep-alives wait time 
-# writetracing: enable logging for the write,default is 0
-# querytracing: enable logging for the query,default is 0
+# interval: collect Statistics, a bare integer is seconds, default is 10s
+# idletimeout: keep-alives wait time, a bare integer is seconds, default is 10s
+# writetracing: enable logging for the write,default is false
+# querytracing: enable logging for the query,default is false
+# validatelines: parse every line written, reject bad ones and answer a partial write error
+#                like influxdb, instead of letting them fail the batch, default is false
+# authenabled: clients must be USERS, with u and p, basic auth or 'Authorization: Bearer <token>',
+#              /reload and /debug too, default is false
+# unknownpolicy: points of measurements no rule or KEYMAPS matches, default is drop
+#                drop: drop them
+#                assign: map the measurement to one of assigngroups
+#                hold: keep them in memory, until the measurement is mapped and /reload
+# assignstrategy: hash (default), least-loaded (fewest measurements) or fixed (the first group)
+# assigngroups: backend groups to assign, split with ',', backends in a group are joined by '|'
+# assignpersist: save the assignment to KEYMAPS in redis, default is true
+# holdlimit: max points held, the oldest are dropped, default is 100000
+# guardrails on select, checked on the parsed query, the error tells the limit hit:
+# requiretimebound: select needs a lower bound of time, like time > now() - 1h, default is false
+# maxtimerange: max time range of select, upper bound is now if not given, a bare integer is seconds
+# maxpoints: max points of a series in group by time(), time range / interval
+# forbidselectall: SELECT * needs LIMIT, default is false
+# forbidgroupbyall: GROUP BY * needs SLIMIT, default is false
+# defaulttimerange: add time > now() - defaulttimerange to select without lower bound of time
+# cachesize: bytes of query results cached in memory, least recently used are evicted, 0 (default) disables it
+# cachettl: how long results of time ranges in the past are cached, default is 10m
+# cacherecentttl: how long results are cached, if time range ends later than cachettl ago,
+#                 or the statement isn't a select, default is 10s
+# coalescequeries: identical queries at the same time share one backend round-trip and its response,
+#                  default is false
+# coalescetimeout: a shared query runs until it, even if clients asking for it are gone,
+#                  a bare integer is seconds, default is 10m
+# readbalance: how queries are spread on active replicas in the zone, default is order
+#              order: the order of KEYMAPS, the first active one takes all
+#              round-robin: in turn
+#              least-outstanding: the one with fewest queries running
+#              ewma: the lowest latency (moving average) times queries running
+#              p2c: the one with fewer queries running of two random ones
+# hedgedelay: if a replica hasn't answered a query in it, send the query to the next one too,
+#             the first answer wins and the other is canceled, a bare integer is ms, default is 0 (no hedging)
+# hedgepercentile: use this percentile of latency of the replica as delay, like 95,
+#                  hedgedelay is used until the replica has 10 reads, default is 0
+# writeack: when a write is acknowledged, a request can ask for another by ack=, default is enqueue
+#           enqueue: queued in memory of backends
+#           durable: appended to the files of backends on local disk, the rewriter sends them at once
+#           quorum: written to writequorum of backends of every line
+# writequorum: backends of a line to confirm it, a request can ask for another by quorum=,
+#              default is 0 (the majority)
+# writeacktimeout: how long to wait for backends to confirm, a bare integer is ms, default is 10s
+# waldir: directory of the ingest wal, writes are appended to it before acknowledged,
+#         and replayed on startup if backends hadn't got them, default is empty (no wal)
+# walsegmentsize: bytes of a wal file before the next one, default is 64MB
 NODES = {
     'l1': { 
         'listenaddr': ':6666',
-        'db': 'test',
+        'db': 'test,team_a',
         'zone': 'local',
         'interval':10,
         'idletimeout':10,
         'writetracing':0,
         'querytracing':0,
+        'unknownpolicy': 'assign',
+        'assignstrategy': 'least-loaded',
+        'assigngroups': 'local,local2',
+        'maxtimerange': '168h',
+        'maxpoints': 10000,
+        'defaulttimerange': '1h',
+        'cachesize': 64 * 1024 * 1024,
+        'cachettl': '10m',
+        'cacherecentttl': '10s',
+        'readbalance': 'least-outstanding',
+        'hedgedelay': 200,
+        'hedgepercentile': 95,
+        'writeack': 'enqueue',
+        'waldir': 'wal',
     }
 }
 
@@ -94,6 +323,11 @@ def write_configs(client, o, prefix):
                 client.rpush(prefix+k, i)
 
 
+def write_db_keymaps(client, o):
+    for db, keymaps in o.items():
+        write_configs(client, keymaps, 'd:%s:' % db)
+
+
 def write_config(client, d, name):
     for k, v in d.items():
         client.hset(name, k, v)
@@ -114,12 +348,17 @@ def main():
         password=optdict.get('-P', '')
     )
 
-    cleanups(client, ['default_node', 'b:*', 'm:*', 'n:*'])
+    cleanups(client, ['default_node', 'b:*', 'd:*', 'm:*', 'n:*', 'r:*', 'u:*', 'f:*', 'l:*'])
 
     write_config(client, DEFAULT_NODE, "default_node")
     write_configs(client, BACKENDS, 'b:')
     write_configs(client, NODES, 'n:')
     write_configs(client, KEYMAPS, 'm:')
+    write_db_keymaps(client, DB_KEYMAPS)
+    write_configs(client, RULES, 'r:')
+    write_configs(client, USERS, 'u:')
+    write_configs(client, QUERY_FILTERS, 'f:')
+    write_configs(client, LIMITS, 'l:')
 
 
 if __name__ == '__main__':
@@ -6,38 +6,92 @@ package main
 
 import (
 	"compress/gzip"
+	"encoding/json"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/pprof"
+	"strconv"
 	"strings"
 
 	"github.com/shell909090/influx-proxy/backend"
 )
 
 type HttpService struct {
-	db string
-	ic *backend.InfluxCluster
+	dbs map[string]bool
+	ic  *backend.InfluxCluster
 }
 
-func NewHttpService(ic *backend.InfluxCluster, db string) (hs *HttpService) {
+// NewHttpService serves databases in dbs, or any database if dbs is empty.
+func NewHttpService(ic *backend.InfluxCluster, dbs []string) (hs *HttpService) {
 	hs = &HttpService{
-		db: db,
-		ic: ic,
+		dbs: make(map[string]bool, len(dbs)),
+		ic:  ic,
 	}
-	if hs.db != "" {
-		log.Print("http database: ", hs.db)
+	for _, db := range dbs {
+		hs.dbs[db] = true
+	}
+	if len(dbs) != 0 {
+		log.Print("http databases: ", strings.Join(dbs, ","))
 	}
 	return
 }
 
+func (hs *HttpService) checkDB(db string) bool {
+	return len(hs.dbs) == 0 || hs.dbs[db]
+}
+
 func (hs *HttpService) Register(mux *http.ServeMux) {
-	mux.HandleFunc("/reload", hs.HandlerReload)
+	mux.HandleFunc("/reload", hs.private(hs.HandlerReload))
 	mux.HandleFunc("/ping", hs.HandlerPing)
 	mux.HandleFunc("/query", hs.HandlerQuery)
 	mux.HandleFunc("/write", hs.HandlerWrite)
-	mux.HandleFunc("/debug/pprof/", pprof.Index)
-	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/held", hs.private(hs.HandlerHeld))
+	mux.HandleFunc("/debug/pprof/", hs.private(pprof.Index))
+	mux.HandleFunc("/debug/pprof/profile", hs.private(pprof.Profile))
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	body, _ := json.Marshal(map[string]string{"error": err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// writeLimited answers 429 with Retry-After.
+func writeLimited(w http.ResponseWriter, err error) {
+	if le, ok := err.(*backend.LimitError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(le.RetryAfterSeconds()))
+	}
+	writeError(w, 429, err)
+}
+
+// authenticate answers 401 like influxdb, if auth is enabled and
+// the request has no user of proxy. policy is nil if auth is not enabled.
+func (hs *HttpService) authenticate(w http.ResponseWriter, req *http.Request) (policy *backend.Policy, ok bool) {
+	policy, err := hs.ic.Authenticate(req)
+	if err != nil {
+		log.Printf("auth error: %s,the client is %s\n", err, req.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"InfluxDB\"")
+		writeError(w, 401, err)
+		return nil, false
+	}
+	return policy, true
+}
+
+// private wraps handlers which only admin users can call.
+func (hs *HttpService) private(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		policy, ok := hs.authenticate(w, req)
+		if !ok {
+			return
+		}
+		if policy != nil && !policy.Admin {
+			writeError(w, 403, &backend.AuthzError{User: policy.User, Action: "call", Resource: req.URL.Path})
+			return
+		}
+		h(w, req)
+	}
 }
 
 func (hs *HttpService) HandlerReload(w http.ResponseWriter, req *http.Request) {
@@ -55,6 +109,25 @@ func (hs *HttpService) HandlerReload(w http.ResponseWriter, req *http.Request) {
 	return
 }
 
+// HandlerHeld lists the measurements held by unknown policy, with the number
+// of their points, so operator knows what to map.
+func (hs *HttpService) HandlerHeld(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	w.Header().Add("X-Influxdb-Version", backend.VERSION)
+
+	p, err := json.Marshal(hs.ic.HeldMeasurements())
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(p)
+	return
+}
+
 func (hs *HttpService) HandlerPing(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	version, err := hs.ic.Ping()
@@ -72,21 +145,47 @@ func (hs *HttpService) HandlerQuery(w http.ResponseWriter, req *http.Request) {
 	w.Header().Add("X-Influxdb-Version", backend.VERSION)
 
 	db := req.FormValue("db")
-	if hs.db != "" {
-		if db != hs.db {
-			w.WriteHeader(404)
-			w.Write([]byte("database not exist."))
+	policy, ok := hs.authenticate(w, req)
+	if !ok {
+		return
+	}
+	if hs.ic.AuthEnabled {
+		// they are for proxy, not backends.
+		req.Form.Del("u")
+		req.Form.Del("p")
+		req.Header.Del("Authorization")
+	}
+
+	if !hs.checkDB(db) {
+		w.WriteHeader(404)
+		w.Write([]byte("database not exist."))
+		return
+	}
+
+	q := strings.TrimSpace(req.FormValue("q"))
+	if policy != nil {
+		err := policy.AuthorizeQuery(q, db)
+		if err != nil {
+			log.Printf("query error: %s,the query is %s,the client is %s\n", err, q, req.RemoteAddr)
+			writeError(w, 403, err)
 			return
 		}
 	}
 
-	q := strings.TrimSpace(req.FormValue("q"))
-	err := hs.ic.Query(w, req)
+	done, err := hs.ic.LimitQuery(backend.NewClient(req, db, policy))
 	if err != nil {
 		log.Printf("query error: %s,the query is %s,the client is %s\n", err, q, req.RemoteAddr)
+		writeLimited(w, err)
 		return
 	}
-	if hs.ic.QueryTracing != 0 {
+	defer done()
+
+	err = hs.ic.Query(w, req)
+	if err != nil {
+		log.Printf("query error: %s,the query is %s,the client is %s\n", err, q, req.RemoteAddr)
+		return
+	}
+	if hs.ic.QueryTracing {
 		log.Printf("the query is %s,the client is %s\n", q, req.RemoteAddr)
 	}
 
@@ -103,14 +202,16 @@ func (hs *HttpService) HandlerWrite(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	db := req.URL.Query().Get("db")
+	policy, ok := hs.authenticate(w, req)
+	if !ok {
+		return
+	}
 
-	if hs.db != "" {
-		if db != hs.db {
-			w.WriteHeader(404)
-			w.Write([]byte("database not exist."))
-			return
-		}
+	db := req.URL.Query().Get("db")
+	if !hs.checkDB(db) {
+		w.WriteHeader(404)
+		w.Write([]byte("database not exist."))
+		return
 	}
 
 	body := req.Body
@@ -132,11 +233,62 @@ func (hs *HttpService) HandlerWrite(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = hs.ic.Write(p)
-	if err == nil {
+	err = hs.ic.LimitWrite(backend.NewClient(req, db, policy), p)
+	if err != nil {
+		log.Printf("write error: %s,the client is %s\n", err, req.RemoteAddr)
+		writeLimited(w, err)
+		return
+	}
+
+	query := req.URL.Query()
+	ack, quorum, err := backend.ParseAck(query.Get("ack"), query.Get("quorum"))
+	if err != nil {
+		writeError(w, 400, err)
+		return
+	}
+	params := &backend.WriteParams{
+		DB:          db,
+		RP:          query.Get("rp"),
+		Precision:   query.Get("precision"),
+		Consistency: query.Get("consistency"),
+		User:        query.Get("u"),
+		Password:    query.Get("p"),
+		Policy:      policy,
+		Ack:         ack,
+		Quorum:      quorum,
+	}
+	if user, password, ok := req.BasicAuth(); ok {
+		params.User, params.Password = user, password
+	}
+	if hs.ic.AuthEnabled {
+		// they are for proxy, not backends.
+		params.User, params.Password = "", ""
+	}
+
+	err = hs.ic.Write(p, params)
+	switch err.(type) {
+	case nil:
 		w.WriteHeader(204)
+	case *backend.PartialWriteError:
+		// same as influxdb, good lines are written, bad ones are told.
+		writeError(w, 400, err)
+	case *backend.AuthzError:
+		writeError(w, 403, err)
+	default:
+		switch err {
+		case backend.ErrQueueFull:
+			// a backend is too slow to keep up, come back later.
+			w.Header().Set("Retry-After", "1")
+			writeError(w, 503, err)
+		case backend.ErrNotDurable, backend.ErrWALAppend:
+			writeError(w, 500, err)
+		case backend.ErrNoQuorum:
+			writeError(w, 503, err)
+		default:
+			writeError(w, 500, err)
+		}
 	}
-	if hs.ic.WriteTracing != 0 {
+	if hs.ic.WriteTracing {
 		log.Printf("Write body received by handler: %s,the client is %s\n", p, req.RemoteAddr)
 	}
 	return
@@ -106,6 +106,11 @@ func main() {
 
 	ic := backend.NewInfluxCluster(rcs, &nodecfg)
 	ic.LoadConfig()
+	err = ic.OpenWAL()
+	if err != nil {
+		log.Printf("open wal failed: %s", err)
+		return
+	}
 
 	mux := http.NewServeMux()
 	NewHttpService(ic, nodecfg.DB).Register(mux)
@@ -114,7 +119,7 @@ func main() {
 	server := &http.Server{
 		Addr:        nodecfg.ListenAddr,
 		Handler:     mux,
-		IdleTimeout: time.Duration(nodecfg.IdleTimeout) * time.Second,
+		IdleTimeout: nodecfg.IdleTimeout,
 	}
 	if nodecfg.IdleTimeout <= 0 {
 		server.IdleTimeout = 10 * time.Second